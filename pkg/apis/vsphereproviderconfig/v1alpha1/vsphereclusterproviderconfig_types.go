@@ -36,6 +36,22 @@ type VsphereClusterProviderStatus struct {
 	// Important: Run "make" to regenerate code after modifying this file
 	LastUpdated string    `json:"lastUpdated"`
 	APIStatus   APIStatus `json:"clusterApiStatus"`
+	// OrphanedVMs are the VMs of the cluster which belong to no Machine, as
+	// found by the orphaned VM collector
+	OrphanedVMs []OrphanedVM `json:"orphanedVMs,omitempty"`
+}
+
+// OrphanedVM is a VM of the cluster whose instance UUID is the UID of no
+// Machine.
+type OrphanedVM struct {
+	// Name of the VM
+	Name string `json:"name"`
+	// MachineRef is the managed object reference of the VM
+	MachineRef string `json:"machineRef"`
+	// InstanceUUID is the instance UUID of the VM
+	InstanceUUID string `json:"instanceUUID"`
+	// DetectedAt is the time the VM was first found orphaned
+	DetectedAt metav1.Time `json:"detectedAt"`
 }
 
 // +genclient
@@ -47,10 +63,67 @@ type VsphereClusterProviderConfig struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	VsphereUser             string `json:"vsphereUser,omitempty"`
-	VspherePassword         string `json:"vspherePassword,omitempty"`
-	VsphereServer           string `json:"vsphereServer"`
-	VsphereCredentialSecret string `json:"vsphereCredentialSecret,omitempty"`
+	VsphereUser             string              `json:"vsphereUser,omitempty"`
+	VspherePassword         string              `json:"vspherePassword,omitempty"`
+	VsphereServer           string              `json:"vsphereServer"`
+	VsphereCredentialSecret string              `json:"vsphereCredentialSecret,omitempty"`
+	AntiAffinity            *AntiAffinityConfig `json:"antiAffinity,omitempty"`
+	FailureDomains          []FailureDomain     `json:"failureDomains,omitempty"`
+	VMFolderLayout          *VMFolderLayout     `json:"vmFolderLayout,omitempty"`
+	OrphanedVMPolicy        *OrphanedVMPolicy   `json:"orphanedVMPolicy,omitempty"`
+}
+
+// OrphanedVMPolicy destroys the orphaned VMs of the cluster, i.e. the VMs
+// which belong to no Machine, e.g. when a clone completed after its Machine was
+// deleted. The orphaned VMs are only reported when the policy is not set.
+type OrphanedVMPolicy struct {
+	// GracePeriod is the time a VM must have been found orphaned for before it
+	// is destroyed
+	GracePeriod metav1.Duration `json:"gracePeriod"`
+}
+
+// VMFolderLayout puts the VMs of the Machines which do not set a vmFolder in
+// the folder <base>/<namespace>/<cluster name>. The folders are created when
+// missing, and the folder of the cluster is removed along with the cluster once
+// empty.
+type VMFolderLayout struct {
+	// Datacenter of the folders of the layout, the default datacenter if
+	// unset. The Machines placed in the folders of the layout must be in
+	// that datacenter.
+	Datacenter string `json:"datacenter,omitempty"`
+	// BaseFolder is the path of the base folder, relative to the datacenter
+	// unless absolute. The VM folder of the datacenter is used if unset.
+	BaseFolder string `json:"baseFolder,omitempty"`
+}
+
+// FailureDomain is a zone of the cluster mapped to a vSphere compute cluster,
+// or to a DRS host group of a compute cluster. The Machines placed in the
+// failure domain get the zone and region topology labels on their Node.
+type FailureDomain struct {
+	// Name of the failure domain, used as the zone label of the Nodes
+	Name string `json:"name"`
+	// Region is used as the region label of the Nodes, if set
+	Region string `json:"region,omitempty"`
+	// ComputeCluster is the name or path of the vSphere compute cluster
+	ComputeCluster string `json:"computeCluster"`
+	// HostGroup is the name of a DRS host group of the compute cluster to
+	// place the VMs on, if set
+	HostGroup string `json:"hostGroup,omitempty"`
+	// Datastore is the datastore of the Machines that do not set one
+	Datastore string `json:"datastore,omitempty"`
+	// Network is the network of the Machine networks that do not set one
+	Network string `json:"network,omitempty"`
+}
+
+// AntiAffinityConfig defines the DRS VM-VM anti-affinity rules maintained for
+// the cluster. One rule is maintained per role (control-plane and worker) and
+// vSphere compute cluster, keeping the VMs of the role on separate hosts.
+type AntiAffinityConfig struct {
+	// Enabled sets whether the rules are enforced by DRS
+	Enabled bool `json:"enabled"`
+	// Mandatory sets whether the rules are mandatory, in which case DRS does
+	// not power on VMs violating them
+	Mandatory bool `json:"mandatory,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -0,0 +1,72 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// VsphereIPPoolSpec defines the addresses handed out by the pool. Addresses
+// are allocated from the CIDRs in order, skipping the network and broadcast
+// addresses, the gateway and the exclusions. An exclusion is either a single
+// address or a CIDR.
+type VsphereIPPoolSpec struct {
+	CIDRs      []string `json:"cidrs"`
+	Gateway    string   `json:"gateway,omitempty"`
+	Dns        []string `json:"dns,omitempty"`
+	Exclusions []string `json:"exclusions,omitempty"`
+}
+
+// VsphereIPPoolStatus records the allocated addresses. The allocations are
+// keyed by address.
+type VsphereIPPoolStatus struct {
+	Allocations map[string]IPAllocation `json:"allocations,omitempty"`
+}
+
+// IPAllocation is the claim of an address by the NIC of a Machine. The NIC is
+// identified by the index of its network in the machine spec.
+type IPAllocation struct {
+	Machine      string `json:"machine"`
+	MachineUID   string `json:"machineUID"`
+	NetworkIndex int    `json:"networkIndex"`
+}
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// VsphereIPPool is the Schema for the vsphereippools API
+// +k8s:openapi-gen=true
+type VsphereIPPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VsphereIPPoolSpec   `json:"spec,omitempty"`
+	Status VsphereIPPoolStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// VsphereIPPoolList contains a list of VsphereIPPool
+type VsphereIPPoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VsphereIPPool `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&VsphereIPPool{}, &VsphereIPPoolList{})
+}
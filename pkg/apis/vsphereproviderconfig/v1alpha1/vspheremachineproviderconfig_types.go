@@ -27,8 +27,51 @@ import (
 type VsphereMachineProviderStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
-	LastUpdated string `json:"lastUpdated"`
-	TaskRef     string `json:"taskRef"`
+	LastUpdated   string           `json:"lastUpdated"`
+	TaskRef       string           `json:"taskRef"`
+	Datastore     string           `json:"datastore,omitempty"`
+	FailureDomain string           `json:"failureDomain,omitempty"`
+	Resources     *ResourcesStatus `json:"resources,omitempty"`
+	PowerCycle    bool             `json:"powerCycle,omitempty"`
+	Networks      []NetworkStatus  `json:"networks,omitempty"`
+	// ShutdownStarted is the time the guest shutdown of the VM was requested
+	// by the deletion of the Machine
+	ShutdownStarted *metav1.Time `json:"shutdownStarted,omitempty"`
+	// PowerState is the last observed power state of the VM: poweredOn,
+	// poweredOff or suspended
+	PowerState string `json:"powerState,omitempty"`
+	// Snapshots lists the snapshots of the VM, oldest first
+	Snapshots []SnapshotStatus `json:"snapshots,omitempty"`
+	// PreUpdateSnapshot is the name of the snapshot taken before the pending
+	// version change or reconfigure of the Machine
+	PreUpdateSnapshot string `json:"preUpdateSnapshot,omitempty"`
+}
+
+// SnapshotStatus is a snapshot of the VM, to which the Machine can be rolled
+// back.
+type SnapshotStatus struct {
+	Name       string      `json:"name"`
+	CreateTime metav1.Time `json:"createTime"`
+}
+
+// NetworkStatus is the NIC of the VM connected to the network at the same
+// index of the machine spec. The MAC address is reported once the VM is
+// created.
+type NetworkStatus struct {
+	NetworkName string            `json:"networkName"`
+	DeviceType  NetworkDeviceType `json:"deviceType"`
+	MACAddress  string            `json:"macAddress,omitempty"`
+}
+
+// ResourcesStatus is the CPU and memory configuration of the VM
+type ResourcesStatus struct {
+	NumCPUs                      int32              `json:"numCPUs"`
+	NumCoresPerSocket            int32              `json:"numCoresPerSocket,omitempty"`
+	MemoryMB                     int64              `json:"memoryMB"`
+	CPUHotAddEnabled             bool               `json:"cpuHotAddEnabled,omitempty"`
+	MemoryHotAddEnabled          bool               `json:"memoryHotAddEnabled,omitempty"`
+	MemoryReservationLockedToMax bool               `json:"memoryReservationLockedToMax,omitempty"`
+	Allocation                   ResourceAllocation `json:"allocation"`
 }
 
 // +genclient
@@ -59,32 +102,226 @@ func init() {
 //**** New extensions
 
 type VsphereMachineSpec struct {
-	Datacenter       string        `json:"datacenter"`
-	Datastore        string        `json:"datastore"`
-	ResourcePool     string        `json:"resourcePool,omitempty"`
-	VMFolder         string        `json:"vmFolder,omitempty"`
-	Networks         []NetworkSpec `json:"networks"`
-	NumCPUs          int32         `json:"numCPUs,omitempty"`
-	MemoryMB         int64         `json:"memoryMB,omitempty"`
-	VMTemplate       string        `json:"template" yaml:"template"`
-	Disks            []DiskSpec    `json:"disks"`
-	Preloaded        bool          `json:"preloaded,omitempty"`
-	VsphereCloudInit bool          `json:"vsphereCloudInit,omitempty"`
-	TrustedCerts     []string      `json:"trustedCerts,omitempty"`
-	NTPServers       []string      `json:"ntpServers,omitempty"`
+	Datacenter                   string              `json:"datacenter"`
+	Datastore                    string              `json:"datastore"`
+	DatastoreCluster             string              `json:"datastoreCluster,omitempty"`
+	FailureDomain                string              `json:"failureDomain,omitempty"`
+	StoragePolicyName            string              `json:"storagePolicyName,omitempty"`
+	ResourcePool                 string              `json:"resourcePool,omitempty"`
+	VMFolder                     string              `json:"vmFolder,omitempty"`
+	Networks                     []NetworkSpec       `json:"networks"`
+	Bonds                        []BondSpec          `json:"bonds,omitempty"`
+	NumCPUs                      int32               `json:"numCPUs,omitempty"`
+	NumCoresPerSocket            int32               `json:"numCoresPerSocket,omitempty"`
+	MemoryMB                     int64               `json:"memoryMB,omitempty"`
+	CPUHotAddEnabled             bool                `json:"cpuHotAddEnabled,omitempty"`
+	MemoryHotAddEnabled          bool                `json:"memoryHotAddEnabled,omitempty"`
+	MemoryReservationLockedToMax bool                `json:"memoryReservationLockedToMax,omitempty"`
+	Resources                    *ResourceAllocation `json:"resources,omitempty"`
+	VMTemplate                   string              `json:"template" yaml:"template"`
+	ContentLibrary               string              `json:"contentLibrary,omitempty"`
+	LibraryItem                  string              `json:"libraryItem,omitempty"`
+	CloneMode                    CloneMode           `json:"cloneMode,omitempty"`
+	Snapshot                     string              `json:"snapshot,omitempty"`
+	Disks                        []DiskSpec          `json:"disks"`
+	Preloaded                    bool                `json:"preloaded,omitempty"`
+	VsphereCloudInit             bool                `json:"vsphereCloudInit,omitempty"`
+	BootstrapFormat              BootstrapFormat     `json:"bootstrapFormat,omitempty"`
+	Customization                *CustomizationSpec  `json:"customization,omitempty"`
+	TrustedCerts                 []string            `json:"trustedCerts,omitempty"`
+	NTPServers                   []string            `json:"ntpServers,omitempty"`
+	ExtraConfig                  map[string]string   `json:"extraConfig,omitempty"`
+	VAppProperties               map[string]string   `json:"vAppProperties,omitempty"`
+	Tags                         []TagSpec           `json:"tags,omitempty"`
+	GuestShutdownTimeout         *metav1.Duration    `json:"guestShutdownTimeout,omitempty"`
+	PowerPolicy                  PowerPolicy         `json:"powerPolicy,omitempty"`
+	SnapshotPolicy               *SnapshotPolicy     `json:"snapshotPolicy,omitempty"`
+}
+
+// SnapshotPolicy is the way the snapshots of the VM are taken by the provider.
+// The memory of the VM is included in the snapshots when Memory is set, and the
+// guest file systems are quiesced when Quiesce is set. With BeforeUpdate, the
+// VM is snapshotted before a version change or an in-place reconfigure. Only
+// the Retention most recent snapshots taken by the provider are kept, 3 by
+// default.
+type SnapshotPolicy struct {
+	Memory       bool `json:"memory,omitempty"`
+	Quiesce      bool `json:"quiesce,omitempty"`
+	BeforeUpdate bool `json:"beforeUpdate,omitempty"`
+	Retention    int  `json:"retention,omitempty"`
+}
+
+// PowerPolicy is the way the power state of the VM is reconciled once created.
+// With alwaysOn, the default, the VM is powered on again when found powered off
+// or suspended. With manual, the power state is left to the operator.
+type PowerPolicy string
+
+const (
+	PowerPolicyAlwaysOn PowerPolicy = "alwaysOn"
+	PowerPolicyManual   PowerPolicy = "manual"
+)
+
+// TagSpec is a vSphere tag attached to the VM in addition to the tags of the
+// cluster and role set by the provider. The category and the tag are created
+// when missing.
+type TagSpec struct {
+	Category string `json:"category"`
+	Name     string `json:"name"`
+}
+
+// ResourceAllocation is the CPU and memory allocation of the VM. The CPU
+// reservation and limit are in MHz, the memory reservation and limit in MB.
+type ResourceAllocation struct {
+	CPU    *ResourceAllocationInfo `json:"cpu,omitempty"`
+	Memory *ResourceAllocationInfo `json:"memory,omitempty"`
+}
+
+// ResourceAllocationInfo is the allocation of a resource of the VM. A limit of
+// -1 means that the resource usage is unlimited.
+type ResourceAllocationInfo struct {
+	Reservation *int64      `json:"reservation,omitempty"`
+	Limit       *int64      `json:"limit,omitempty"`
+	Shares      *SharesInfo `json:"shares,omitempty"`
+}
+
+// SharesInfo is the relative priority of the VM for a resource. The number of
+// shares is only honored for the custom level.
+type SharesInfo struct {
+	Level  SharesLevel `json:"level"`
+	Shares int32       `json:"shares,omitempty"`
+}
+
+type SharesLevel string
+
+const (
+	SharesLevelLow    SharesLevel = "low"
+	SharesLevelNormal SharesLevel = "normal"
+	SharesLevelHigh   SharesLevel = "high"
+	SharesLevelCustom SharesLevel = "custom"
+)
+
+// CloneMode is the way the VM is cloned from the template. For linked clones
+// the VsphereMachineSpec.Snapshot names the template snapshot to clone from,
+// the current snapshot of the template is used if unset.
+type CloneMode string
+
+const (
+	// FullClone creates a full copy of the template disks
+	FullClone CloneMode = "fullClone"
+	// LinkedClone creates child disks backed by a snapshot of the template
+	LinkedClone CloneMode = "linkedClone"
+)
+
+// BootstrapFormat is the format of the user data bootstrapping the VM. Ignition
+// configs are passed via the guestinfo.ignition.config.data property, for
+// templates such as Flatcar Container Linux, and carry no network config thus
+// the networks of such Machines must use DHCP.
+type BootstrapFormat string
+
+const (
+	CloudConfigBootstrapFormat BootstrapFormat = "cloud-config"
+	IgnitionBootstrapFormat    BootstrapFormat = "ignition"
+)
+
+// CustomizationSpec enables the guest OS customization of the VM by vSphere,
+// for templates without cloud-init. When SpecName is set, the named spec stored
+// in the customization spec manager of vCenter is used. Otherwise a Linux
+// customization is built from the Machine name, the Networks of the machine
+// spec and the DNS and time settings below. The startup script is passed to the
+// guest via the guestinfo.startup-script property.
+type CustomizationSpec struct {
+	SpecName      string   `json:"specName,omitempty"`
+	Domain        string   `json:"domain,omitempty"`
+	TimeZone      string   `json:"timeZone,omitempty"`
+	HwClockUTC    *bool    `json:"hwClockUTC,omitempty"`
+	DNSServers    []string `json:"dnsServers,omitempty"`
+	DNSSuffixList []string `json:"dnsSuffixList,omitempty"`
 }
 
+// NetworkSpec is a NIC of the VM. The NICs are added in the order of the
+// networks in the machine spec, as vmxnet3 devices by default. The MAC address
+// is generated by vSphere unless MACAddress is set.
+//
+// The network is found by the NetworkName, which is either a name or a full
+// inventory path. The port group named NetworkName of the DistributedSwitch is
+// used when DistributedSwitch is set. Alternatively, a distributed port group
+// can be referenced by its PortGroupKey and an opaque (NSX) network by its
+// OpaqueNetworkID, in which case the NetworkName is only informational.
+//
+// A static IPConfig takes its address from the VsphereIPPool named IPPool in
+// the namespace of the Machine when IPPool is set. The netmask, gateway and
+// DNS servers of the pool are used unless set in the IPConfig.
+//
+// The NIC is a member of the bond named Bond when set, in which case the NIC
+// has no IPConfig of its own. VLANs are VLAN interfaces on top of the NIC.
 type NetworkSpec struct {
-	NetworkName string   `json:"networkName"`
-	IPConfig    IPConfig `json:"ipConfig,omitempty"`
+	NetworkName       string            `json:"networkName"`
+	DistributedSwitch string            `json:"distributedSwitch,omitempty"`
+	PortGroupKey      string            `json:"portGroupKey,omitempty"`
+	OpaqueNetworkID   string            `json:"opaqueNetworkID,omitempty"`
+	DeviceType        NetworkDeviceType `json:"deviceType,omitempty"`
+	MACAddress        string            `json:"macAddress,omitempty"`
+	IPConfig          IPConfig          `json:"ipConfig,omitempty"`
+	IPPool            string            `json:"ipPool,omitempty"`
+	MTU               int64             `json:"mtu,omitempty"`
+	Bond              string            `json:"bond,omitempty"`
+	VLANs             []VLANSpec        `json:"vlans,omitempty"`
+}
+
+// BondSpec is a bond of the NICs which reference it by name. The Mode is one
+// of the Linux bonding modes, e.g. active-backup or 802.3ad, and defaults to
+// balance-rr. MIIMonitorInterval is the link monitoring interval in
+// milliseconds.
+type BondSpec struct {
+	Name               string     `json:"name"`
+	Mode               string     `json:"mode,omitempty"`
+	MIIMonitorInterval int32      `json:"miiMonitorInterval,omitempty"`
+	MTU                int64      `json:"mtu,omitempty"`
+	IPConfig           IPConfig   `json:"ipConfig,omitempty"`
+	VLANs              []VLANSpec `json:"vlans,omitempty"`
 }
 
+// VLANSpec is a VLAN interface with the given VLAN ID on top of a NIC or a
+// bond. The interface is named <link>.<id> unless a Name is set.
+type VLANSpec struct {
+	ID       int32    `json:"id"`
+	Name     string   `json:"name,omitempty"`
+	MTU      int64    `json:"mtu,omitempty"`
+	IPConfig IPConfig `json:"ipConfig,omitempty"`
+}
+
+type NetworkDeviceType string
+
+const (
+	Vmxnet3NetworkDevice NetworkDeviceType = "vmxnet3"
+	Vmxnet2NetworkDevice NetworkDeviceType = "vmxnet2"
+	E1000NetworkDevice   NetworkDeviceType = "e1000"
+	E1000eNetworkDevice  NetworkDeviceType = "e1000e"
+)
+
+// IPConfig is the IP configuration of a NIC. A static config has an IPv4
+// address given by the IP and Netmask, and any number of IPv4 and IPv6
+// addresses with their prefix length given by the IPs, e.g. 10.0.0.10/24 or
+// fd00::10/64. Gateway is the default IPv4 gateway and Gateway6 the default
+// IPv6 gateway. The DNS servers and SearchDomains apply to either type, as do
+// the static Routes.
 type IPConfig struct {
-	NetworkType NetworkType `json:"networkType"`
-	IP          string      `json:"ip,omitempty"`
-	Netmask     string      `json:"netmask,omitempty"`
-	Gateway     string      `json:"gateway,omitempty"`
-	Dns         []string    `json:"dns,omitempty"`
+	NetworkType   NetworkType `json:"networkType"`
+	IP            string      `json:"ip,omitempty"`
+	Netmask       string      `json:"netmask,omitempty"`
+	IPs           []string    `json:"ips,omitempty"`
+	Gateway       string      `json:"gateway,omitempty"`
+	Gateway6      string      `json:"gateway6,omitempty"`
+	Dns           []string    `json:"dns,omitempty"`
+	SearchDomains []string    `json:"searchDomains,omitempty"`
+	Routes        []RouteSpec `json:"routes,omitempty"`
+}
+
+// RouteSpec is a static route to the network To, a CIDR, via the gateway Via.
+type RouteSpec struct {
+	To     string `json:"to"`
+	Via    string `json:"via"`
+	Metric int32  `json:"metric,omitempty"`
 }
 
 type NetworkType string
@@ -92,9 +329,35 @@ type NetworkType string
 const (
 	Static NetworkType = "static"
 	DHCP   NetworkType = "dhcp"
+	// None leaves the interface without address, e.g. a NIC carrying VLANs
+	None NetworkType = "none"
 )
 
+// DiskSpec describes a disk of the Machine. When DiskLabel is set the spec
+// resizes the matching disk of the template, otherwise a new disk is added to
+// the cloned VM.
 type DiskSpec struct {
 	DiskSizeGB int64  `json:"diskSizeGB,omitempty"`
 	DiskLabel  string `json:"diskLabel,omitempty"`
+	// The following properties are only honored for new disks
+	Datastore         string               `json:"datastore,omitempty"`
+	StoragePolicyName string               `json:"storagePolicyName,omitempty"`
+	ProvisioningType  DiskProvisioningType `json:"provisioningType,omitempty"`
+	// ControllerNumber is the bus number of the SCSI controller the disk is
+	// attached to. The first SCSI controller of the template is used if unset.
+	ControllerNumber *int32 `json:"controllerNumber,omitempty"`
+	// UnitNumber is the unit number of the disk on the SCSI controller. The
+	// next free unit number is used if unset.
+	UnitNumber *int32 `json:"unitNumber,omitempty"`
+	// DiskMode is one of the vSphere virtual disk modes, such as persistent
+	// or independent_persistent. Defaults to persistent.
+	DiskMode string `json:"diskMode,omitempty"`
 }
+
+type DiskProvisioningType string
+
+const (
+	ThinProvisioned             DiskProvisioningType = "thin"
+	ThickProvisioned            DiskProvisioningType = "thick"
+	EagerZeroedThickProvisioned DiskProvisioningType = "eagerZeroedThick"
+)
@@ -30,6 +30,7 @@ import (
 	"k8s.io/klog"
 	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
 	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/constants"
+	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/provisioner/govmomi"
 	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
 	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
 	clusterv1alpha1 "sigs.k8s.io/cluster-api/pkg/client/clientset_generated/clientset/typed/cluster/v1alpha1"
@@ -43,15 +44,22 @@ type ClusterActuator struct {
 	lister          v1alpha1.Interface
 	eventRecorder   record.EventRecorder
 	k8sClient       kubernetes.Interface
+	provisioner     *govmomi.Provisioner
 }
 
 // NewClusterActuator creates the instance for the ClusterActuator
 func NewClusterActuator(clusterV1alpha1 clusterv1alpha1.ClusterV1alpha1Interface, k8sClient kubernetes.Interface, lister v1alpha1.Interface, eventRecorder record.EventRecorder) (*ClusterActuator, error) {
+	// The cluster actuator does not allocate addresses from the IP pools
+	provisioner, err := govmomi.New(clusterV1alpha1, k8sClient, lister, eventRecorder, nil)
+	if err != nil {
+		return nil, err
+	}
 	return &ClusterActuator{
 		clusterV1alpha1: clusterV1alpha1,
 		lister:          lister,
 		eventRecorder:   eventRecorder,
 		k8sClient:       k8sClient,
+		provisioner:     provisioner,
 	}, nil
 }
 
@@ -87,9 +95,24 @@ func (ca *ClusterActuator) Reconcile(cluster *clusterv1.Cluster) error {
 	if err != nil {
 		return err
 	}
+	err = ca.ensureAntiAffinityRules(cluster)
+	if err != nil {
+		klog.Infof("Error setting the anti-affinity rules for the cluster: %s", err)
+		return err
+	}
 	return nil
 }
 
+// ensureAntiAffinityRules keeps the DRS anti-affinity rules of the cluster in
+// sync with the Machines of the cluster.
+func (ca *ClusterActuator) ensureAntiAffinityRules(cluster *clusterv1.Cluster) error {
+	machines, err := vsphereutils.GetMachinesForCluster(cluster, ca.lister)
+	if err != nil {
+		return err
+	}
+	return ca.provisioner.ReconcileAntiAffinityRules(cluster, machines)
+}
+
 func (ca *ClusterActuator) updateK8sAPIStatus(cluster *clusterv1.Cluster) error {
 	currentClusterAPIStatus, err := ca.getClusterAPIStatus(cluster)
 	if err != nil {
@@ -259,5 +282,22 @@ func (ca *ClusterActuator) setMasterNodeIPAsEndpoint(cluster *clusterv1.Cluster)
 func (ca *ClusterActuator) Delete(cluster *clusterv1.Cluster) error {
 	ca.eventRecorder.Eventf(cluster, corev1.EventTypeNormal, "Deleted", "Deleting cluster %s", cluster.Name)
 	klog.Infof("Attempting to cleaning up resources of cluster %s", cluster.ObjectMeta.Name)
-	return nil
+	clusterConfig, err := vsphereutils.GetClusterProviderSpec(cluster.Spec.ProviderSpec)
+	if err != nil {
+		return err
+	}
+	if clusterConfig.VMFolderLayout == nil {
+		return nil
+	}
+	// The folder of the cluster holds the VMs of the Machines of the cluster
+	// until deleted, the Machines of the other clusters are not waited for
+	machines, err := vsphereutils.GetMachinesForCluster(cluster, ca.lister)
+	if err != nil {
+		return err
+	}
+	if len(machines) > 0 {
+		klog.Infof("Waiting for the deletion of %d machines of cluster %s", len(machines), cluster.Name)
+		return &clustererror.RequeueAfterError{RequeueAfter: constants.RequeueAfterSeconds}
+	}
+	return ca.provisioner.DeleteClusterFolder(cluster)
 }
@@ -11,7 +11,14 @@ const (
 	KubeletVersionAnnotationKey      = "kubelet-version"
 	CreateEventAction                = "Create"
 	DeleteEventAction                = "Delete"
+	UpdateEventAction                = "Update"
+	AllowPowerCycleAnnotationKey     = "allow-power-cycle"
+	SnapshotAnnotationKey            = "take-snapshot"
+	RollbackAnnotationKey            = "rollback-to-snapshot"
 	DefaultAPITimeout                = 5 * time.Minute
+	DefaultGuestShutdownTimeout      = 5 * time.Minute
+	OrphanedVMCollectionInterval     = 10 * time.Minute
+	DefaultSnapshotRetention         = 3
 	VirtualMachineTaskRef            = "current-task-ref"
 	KubeadmToken                     = "k8s-token"
 	KubeadmTokenExpiryTime           = "k8s-token-expiry-time"
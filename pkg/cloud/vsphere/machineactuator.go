@@ -47,7 +47,7 @@ func NewGovmomiMachineActuator(m manager.Manager, clusterV1alpha1 clusterv1alpha
 		klog.Fatalf("Invalid API configuration for kubeconfig-control: %v", err)
 	}
 
-	provisioner, err := govmomi.New(clusterClient.ClusterV1alpha1(), k8sClient, lister, eventRecorder)
+	provisioner, err := govmomi.New(clusterClient.ClusterV1alpha1(), k8sClient, lister, eventRecorder, m.GetClient())
 	if err != nil {
 		return nil, err
 	}
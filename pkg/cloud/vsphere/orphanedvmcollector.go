@@ -0,0 +1,87 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/constants"
+	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/provisioner/govmomi"
+	clusterv1alpha1 "sigs.k8s.io/cluster-api/pkg/client/clientset_generated/clientset/typed/cluster/v1alpha1"
+	v1alpha1 "sigs.k8s.io/cluster-api/pkg/client/informers_generated/externalversions/cluster/v1alpha1"
+)
+
+// OrphanedVMCollector periodically looks for the VMs of the clusters which
+// belong to no Machine, e.g. the clones which completed after their Machine was
+// deleted, or after the controller crashed before recording the clone task.
+type OrphanedVMCollector struct {
+	lister      v1alpha1.Interface
+	provisioner *govmomi.Provisioner
+}
+
+// NewOrphanedVMCollector creates the instance for the OrphanedVMCollector
+func NewOrphanedVMCollector(clusterV1alpha1 clusterv1alpha1.ClusterV1alpha1Interface, k8sClient kubernetes.Interface, lister v1alpha1.Interface, eventRecorder record.EventRecorder) (*OrphanedVMCollector, error) {
+	provisioner, err := govmomi.New(clusterV1alpha1, k8sClient, lister, eventRecorder, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &OrphanedVMCollector{
+		lister:      lister,
+		provisioner: provisioner,
+	}, nil
+}
+
+// Start collects the orphaned VMs every OrphanedVMCollectionInterval until the
+// stop channel is closed. The collection only starts once the Machines are
+// cached, as every VM would be orphaned otherwise.
+func (c *OrphanedVMCollector) Start(stop <-chan struct{}) error {
+	if !cache.WaitForCacheSync(stop, c.lister.Clusters().Informer().HasSynced, c.lister.Machines().Informer().HasSynced) {
+		return fmt.Errorf("failed to wait for the caches of the orphaned VM collector to sync")
+	}
+	wait.Until(c.collect, constants.OrphanedVMCollectionInterval, stop)
+	return nil
+}
+
+func (c *OrphanedVMCollector) collect() {
+	clusters, err := c.lister.Clusters().Lister().List(labels.Everything())
+	if err != nil {
+		klog.Warningf("Error listing the clusters to collect the orphaned VMs: %s", err)
+		return
+	}
+	// The VMs are matched against the Machines of every cluster, a VM being
+	// annotated with the name of its cluster only
+	machines, err := c.lister.Machines().Lister().List(labels.Everything())
+	if err != nil {
+		klog.Warningf("Error listing the machines to collect the orphaned VMs: %s", err)
+		return
+	}
+	machineUIDs := make(map[string]bool)
+	for _, machine := range machines {
+		machineUIDs[string(machine.UID)] = true
+	}
+	for _, cluster := range clusters {
+		if err := c.provisioner.CollectOrphanedVMs(cluster, machineUIDs); err != nil {
+			klog.Warningf("Error collecting the orphaned VMs of cluster %s: %s", cluster.Name, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// IgnitionVersion is the version of the Ignition spec of the generated configs,
+// as supported by Flatcar Container Linux.
+const IgnitionVersion = "2.3.0"
+
+const (
+	ignitionUser          = "core"
+	ignitionBootScript    = "/opt/bin/boot.sh"
+	ignitionBootstrapUnit = "kubeadm-bootstrap.service"
+	ignitionCloudConfig   = "/etc/kubernetes/cloud-config/cloud-config.yaml"
+)
+
+// The unit runs the startup script once, on the first boot with network.
+const ignitionBootstrapUnitContents = `[Unit]
+Description=Bootstrap the Kubernetes node with kubeadm
+Wants=network-online.target
+After=network-online.target
+ConditionPathExists=!/etc/kubernetes/.bootstrapped
+
+[Service]
+Type=oneshot
+ExecStart=` + ignitionBootScript + `
+ExecStartPost=/usr/bin/touch /etc/kubernetes/.bootstrapped
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// IgnitionTemplate holds the inputs of the Ignition config, which are the
+// ones of the cloud-init user data along with the hostname of the VM.
+type IgnitionTemplate struct {
+	CloudInitTemplate
+	Hostname string
+}
+
+type ignitionConfig struct {
+	Ignition ignitionInfo    `json:"ignition"`
+	Passwd   ignitionPasswd  `json:"passwd"`
+	Storage  ignitionStorage `json:"storage"`
+	Systemd  ignitionSystemd `json:"systemd"`
+}
+
+type ignitionInfo struct {
+	Version string `json:"version"`
+}
+
+type ignitionPasswd struct {
+	Users []ignitionUserConfig `json:"users,omitempty"`
+}
+
+type ignitionUserConfig struct {
+	Name              string   `json:"name"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+}
+
+type ignitionStorage struct {
+	Files []ignitionFile `json:"files,omitempty"`
+}
+
+type ignitionFile struct {
+	Filesystem string               `json:"filesystem"`
+	Path       string               `json:"path"`
+	Mode       int                  `json:"mode"`
+	Contents   ignitionFileContents `json:"contents"`
+}
+
+type ignitionFileContents struct {
+	Source string `json:"source"`
+}
+
+type ignitionSystemd struct {
+	Units []ignitionUnit `json:"units,omitempty"`
+}
+
+type ignitionUnit struct {
+	Name     string `json:"name"`
+	Enabled  bool   `json:"enabled"`
+	Contents string `json:"contents"`
+}
+
+// GetIgnitionConfig returns the Ignition config bootstrapping the node. The
+// startup script is run by a systemd unit on the first boot, the other inputs
+// are written as files.
+func GetIgnitionConfig(params IgnitionTemplate) (string, error) {
+	config := ignitionConfig{Ignition: ignitionInfo{Version: IgnitionVersion}}
+	config.Passwd.Users = []ignitionUserConfig{{Name: ignitionUser}}
+	if params.SSHPublicKey != "" {
+		config.Passwd.Users[0].SSHAuthorizedKeys = []string{strings.TrimSpace(params.SSHPublicKey)}
+	}
+	// The script, the cloud provider config and the trusted certs are already
+	// base64 encoded
+	files := []ignitionFile{
+		ignitionFileData("/etc/hostname", 0644, base64.StdEncoding.EncodeToString([]byte(params.Hostname+"\n"))),
+		ignitionFileData(ignitionBootScript, 0755, params.Script),
+	}
+	if params.IsMaster {
+		files = append(files, ignitionFileData(ignitionCloudConfig, 0600, params.CloudProviderConfig))
+	}
+	for i, cert := range params.TrustedCerts {
+		if _, err := base64.StdEncoding.DecodeString(cert); err != nil {
+			return "", fmt.Errorf("trusted cert %d is not base64 encoded: %s", i, err)
+		}
+		files = append(files, ignitionFileData(fmt.Sprintf("/etc/ssl/certs/cluster-api-trusted-%d.pem", i), 0644, cert))
+	}
+	if len(params.NTPServers) > 0 {
+		timesyncd := fmt.Sprintf("[Time]\nNTP=%s\n", strings.Join(params.NTPServers, " "))
+		files = append(files, ignitionFileData("/etc/systemd/timesyncd.conf", 0644, base64.StdEncoding.EncodeToString([]byte(timesyncd))))
+	}
+	config.Storage.Files = files
+	config.Systemd.Units = []ignitionUnit{
+		{Name: ignitionBootstrapUnit, Enabled: true, Contents: ignitionBootstrapUnitContents},
+	}
+	out, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// ignitionFileData returns a file of the root filesystem with the base64
+// encoded data as contents.
+func ignitionFileData(path string, mode int, data string) ignitionFile {
+	return ignitionFile{
+		Filesystem: "root",
+		Path:       path,
+		Mode:       mode,
+		Contents:   ignitionFileContents{Source: "data:;base64," + data},
+	}
+}
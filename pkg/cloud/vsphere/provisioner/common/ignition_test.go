@@ -0,0 +1,182 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"path"
+	"strings"
+	"testing"
+)
+
+// ignitionSpec lists the properties allowed by the Ignition spec 2.3.0 for
+// the objects generated, along with the required ones.
+var ignitionSpec = map[string]struct {
+	allowed  []string
+	required []string
+}{
+	"config":   {allowed: []string{"ignition", "networkd", "passwd", "storage", "systemd"}, required: []string{"ignition"}},
+	"ignition": {allowed: []string{"config", "proxy", "security", "timeouts", "version"}, required: []string{"version"}},
+	"passwd":   {allowed: []string{"groups", "users"}},
+	"user":     {allowed: []string{"name", "passwordHash", "sshAuthorizedKeys", "uid", "gecos", "homeDir", "noCreateHome", "primaryGroup", "groups", "noUserGroup", "system", "noLogInit", "shell", "create"}, required: []string{"name"}},
+	"storage":  {allowed: []string{"directories", "disks", "files", "filesystems", "links", "raid"}},
+	"file":     {allowed: []string{"filesystem", "path", "overwrite", "append", "contents", "mode", "user", "group"}, required: []string{"filesystem", "path"}},
+	"contents": {allowed: []string{"compression", "source", "verification", "httpHeaders"}},
+	"systemd":  {allowed: []string{"units"}},
+	"unit":     {allowed: []string{"name", "enabled", "mask", "contents", "dropins", "enable"}, required: []string{"name"}},
+}
+
+// validateIgnitionConfig checks the config against the Ignition spec and
+// returns the decoded contents of the files by path.
+func validateIgnitionConfig(t *testing.T, data string) (map[string]interface{}, map[string]string) {
+	var config map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		t.Fatalf("invalid JSON: %s", err)
+	}
+	validateIgnitionObject(t, "config", config)
+	ignition := config["ignition"].(map[string]interface{})
+	validateIgnitionObject(t, "ignition", ignition)
+	if ignition["version"] != IgnitionVersion {
+		t.Errorf("unexpected version %v", ignition["version"])
+	}
+	passwd := config["passwd"].(map[string]interface{})
+	validateIgnitionObject(t, "passwd", passwd)
+	for _, user := range passwd["users"].([]interface{}) {
+		validateIgnitionObject(t, "user", user.(map[string]interface{}))
+	}
+	storage := config["storage"].(map[string]interface{})
+	validateIgnitionObject(t, "storage", storage)
+	files := make(map[string]string)
+	for _, f := range storage["files"].([]interface{}) {
+		file := f.(map[string]interface{})
+		validateIgnitionObject(t, "file", file)
+		filePath := file["path"].(string)
+		if !path.IsAbs(filePath) || path.Clean(filePath) != filePath {
+			t.Errorf("file path %s is not absolute and clean", filePath)
+		}
+		if file["filesystem"] != "root" {
+			t.Errorf("unexpected filesystem %v of %s", file["filesystem"], filePath)
+		}
+		if mode, ok := file["mode"].(float64); !ok || mode < 0 || mode > 07777 {
+			t.Errorf("unexpected mode %v of %s", file["mode"], filePath)
+		}
+		contents := file["contents"].(map[string]interface{})
+		validateIgnitionObject(t, "contents", contents)
+		source := contents["source"].(string)
+		if !strings.HasPrefix(source, "data:;base64,") {
+			t.Errorf("unexpected source %s of %s", source, filePath)
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(source, "data:;base64,"))
+		if err != nil {
+			t.Errorf("invalid data URL of %s: %s", filePath, err)
+		}
+		files[filePath] = string(decoded)
+	}
+	systemd := config["systemd"].(map[string]interface{})
+	validateIgnitionObject(t, "systemd", systemd)
+	for _, u := range systemd["units"].([]interface{}) {
+		unit := u.(map[string]interface{})
+		validateIgnitionObject(t, "unit", unit)
+		if name := unit["name"].(string); !strings.HasSuffix(name, ".service") || strings.Contains(name, "/") {
+			t.Errorf("invalid unit name %s", name)
+		}
+	}
+	return config, files
+}
+
+func validateIgnitionObject(t *testing.T, kind string, object map[string]interface{}) {
+	spec := ignitionSpec[kind]
+	for key := range object {
+		if !contains(spec.allowed, key) {
+			t.Errorf("property %s is not allowed in %s", key, kind)
+		}
+	}
+	for _, key := range spec.required {
+		if _, ok := object[key]; !ok {
+			t.Errorf("property %s is required in %s", key, kind)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGetIgnitionConfig(t *testing.T) {
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	cert := "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+	params := IgnitionTemplate{
+		CloudInitTemplate: CloudInitTemplate{
+			Script:              encode("#!/bin/bash\nkubeadm init\n"),
+			IsMaster:            true,
+			CloudProviderConfig: encode("[Global]\n"),
+			SSHPublicKey:        "ssh-rsa AAAA user@host\n",
+			TrustedCerts:        []string{encode(cert)},
+			NTPServers:          []string{"0.pool.ntp.org", "1.pool.ntp.org"},
+		},
+		Hostname: "machine1",
+	}
+	data, err := GetIgnitionConfig(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, files := validateIgnitionConfig(t, data)
+
+	users := config["passwd"].(map[string]interface{})["users"].([]interface{})
+	keys := users[0].(map[string]interface{})["sshAuthorizedKeys"].([]interface{})
+	if len(keys) != 1 || keys[0] != "ssh-rsa AAAA user@host" {
+		t.Errorf("unexpected SSH keys %v", keys)
+	}
+	expected := map[string]string{
+		"/etc/hostname":                            "machine1\n",
+		"/opt/bin/boot.sh":                         "#!/bin/bash\nkubeadm init\n",
+		ignitionCloudConfig:                        "[Global]\n",
+		"/etc/ssl/certs/cluster-api-trusted-0.pem": cert,
+		"/etc/systemd/timesyncd.conf":              "[Time]\nNTP=0.pool.ntp.org 1.pool.ntp.org\n",
+	}
+	for filePath, contents := range expected {
+		if files[filePath] != contents {
+			t.Errorf("unexpected contents %q of %s, expected %q", files[filePath], filePath, contents)
+		}
+	}
+	units := config["systemd"].(map[string]interface{})["units"].([]interface{})
+	unit := units[0].(map[string]interface{})
+	if unit["name"] != ignitionBootstrapUnit || unit["enabled"] != true || !strings.Contains(unit["contents"].(string), "ExecStart="+ignitionBootScript) {
+		t.Errorf("unexpected bootstrap unit %v", unit)
+	}
+
+	// The cloud provider config is only written on the control plane
+	params.IsMaster = false
+	if data, err = GetIgnitionConfig(params); err != nil {
+		t.Fatal(err)
+	}
+	if _, files = validateIgnitionConfig(t, data); files[ignitionCloudConfig] != "" {
+		t.Error("expected no cloud provider config on nodes")
+	}
+
+	params.TrustedCerts = []string{cert}
+	if _, err = GetIgnitionConfig(params); err == nil {
+		t.Error("expected a trusted cert which is not base64 encoded to fail")
+	}
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"sigs.k8s.io/yaml"
+)
+
+// NetworkConfigVersion is the version of the cloud-init network config, the
+// version 2 being the netplan format
+const NetworkConfigVersion = 2
+
+// bondModes are the Linux bonding modes supported by netplan
+var bondModes = []string{"balance-rr", "active-backup", "balance-xor", "broadcast", "802.3ad", "balance-tlb", "balance-alb"}
+
+// The netplan types only have the properties generated below.
+
+type netplanConfig struct {
+	Version   int                      `json:"version"`
+	Ethernets map[string]netplanDevice `json:"ethernets,omitempty"`
+	Bonds     map[string]netplanDevice `json:"bonds,omitempty"`
+	VLANs     map[string]netplanDevice `json:"vlans,omitempty"`
+}
+
+type netplanDevice struct {
+	Match       *netplanMatch          `json:"match,omitempty"`
+	SetName     string                 `json:"set-name,omitempty"`
+	Interfaces  []string               `json:"interfaces,omitempty"`
+	Parameters  *netplanBondParameters `json:"parameters,omitempty"`
+	ID          int32                  `json:"id,omitempty"`
+	Link        string                 `json:"link,omitempty"`
+	MTU         int64                  `json:"mtu,omitempty"`
+	DHCP4       bool                   `json:"dhcp4,omitempty"`
+	DHCP6       bool                   `json:"dhcp6,omitempty"`
+	Addresses   []string               `json:"addresses,omitempty"`
+	Gateway4    string                 `json:"gateway4,omitempty"`
+	Gateway6    string                 `json:"gateway6,omitempty"`
+	Nameservers *netplanNameservers    `json:"nameservers,omitempty"`
+	Routes      []netplanRoute         `json:"routes,omitempty"`
+}
+
+type netplanMatch struct {
+	MACAddress string `json:"macaddress"`
+}
+
+type netplanBondParameters struct {
+	Mode               string `json:"mode,omitempty"`
+	MIIMonitorInterval int32  `json:"mii-monitor-interval,omitempty"`
+}
+
+type netplanNameservers struct {
+	Addresses []string `json:"addresses,omitempty"`
+	Search    []string `json:"search,omitempty"`
+}
+
+type netplanRoute struct {
+	To     string `json:"to"`
+	Via    string `json:"via"`
+	Metric int32  `json:"metric,omitempty"`
+}
+
+// GetNetworkConfig returns the cloud-init network config of the machine spec
+// in the netplan format. The NICs are named eth0, eth1, ... in the order of
+// the networks, and matched by MAC address when the network sets one. The
+// DHCP interfaces use DHCPv6 as well when the cluster has IPv6 pod or service
+// CIDRs.
+func GetNetworkConfig(cluster *clusterv1.Cluster, machineSpec *vsphereconfigv1.VsphereMachineSpec) (string, error) {
+	config := netplanConfig{
+		Version:   NetworkConfigVersion,
+		Ethernets: make(map[string]netplanDevice),
+	}
+	members := make(map[string][]string)
+	for _, bond := range machineSpec.Bonds {
+		if bond.Name == "" {
+			return "", fmt.Errorf("[FATAL] A bond in the machineSpec has no name")
+		}
+		if _, ok := members[bond.Name]; ok {
+			return "", fmt.Errorf("[FATAL] Bond %s is defined twice in the machineSpec", bond.Name)
+		}
+		members[bond.Name] = []string{}
+	}
+	for i, network := range machineSpec.Networks {
+		name := fmt.Sprintf("eth%d", i)
+		var device netplanDevice
+		if network.Bond != "" {
+			if _, ok := members[network.Bond]; !ok {
+				return "", fmt.Errorf("[FATAL] Network %d is a member of the bond %s which is not defined in the machineSpec", i, network.Bond)
+			}
+			if network.IPConfig.NetworkType != "" || network.IPPool != "" || len(network.VLANs) > 0 {
+				return "", fmt.Errorf("[FATAL] Network %d is a member of the bond %s and cannot have an ipConfig, ipPool or vlans", i, network.Bond)
+			}
+			members[network.Bond] = append(members[network.Bond], name)
+			device.MTU = network.MTU
+		} else {
+			var err error
+			if device, err = newNetplanDevice(network.IPConfig, network.MTU); err != nil {
+				return "", fmt.Errorf("[FATAL] Network %d in the machineSpec: %v", i, err)
+			}
+		}
+		if network.MACAddress != "" {
+			device.Match = &netplanMatch{MACAddress: strings.ToLower(network.MACAddress)}
+			device.SetName = name
+		}
+		config.Ethernets[name] = device
+		if err := addVLANs(&config, name, network.VLANs); err != nil {
+			return "", err
+		}
+	}
+	for _, bond := range machineSpec.Bonds {
+		if len(members[bond.Name]) == 0 {
+			return "", fmt.Errorf("[FATAL] Bond %s has no member network", bond.Name)
+		}
+		if bond.Mode != "" && !containsString(bondModes, bond.Mode) {
+			return "", fmt.Errorf("[FATAL] Unknown mode %q for the bond %s, must be one of %s", bond.Mode, bond.Name, strings.Join(bondModes, ", "))
+		}
+		device, err := newNetplanDevice(bond.IPConfig, bond.MTU)
+		if err != nil {
+			return "", fmt.Errorf("[FATAL] Bond %s in the machineSpec: %v", bond.Name, err)
+		}
+		device.Interfaces = members[bond.Name]
+		if bond.Mode != "" || bond.MIIMonitorInterval != 0 {
+			device.Parameters = &netplanBondParameters{Mode: bond.Mode, MIIMonitorInterval: bond.MIIMonitorInterval}
+		}
+		if config.Bonds == nil {
+			config.Bonds = make(map[string]netplanDevice)
+		}
+		config.Bonds[bond.Name] = device
+		if err := addVLANs(&config, bond.Name, bond.VLANs); err != nil {
+			return "", err
+		}
+	}
+	if (TemplateParams{Cluster: cluster}).IPv6Enabled() {
+		for _, devices := range []map[string]netplanDevice{config.Ethernets, config.Bonds, config.VLANs} {
+			for name, device := range devices {
+				device.DHCP6 = device.DHCP4
+				devices[name] = device
+			}
+		}
+	}
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// addVLANs adds the VLAN interfaces on top of the link to the config.
+func addVLANs(config *netplanConfig, link string, vlans []vsphereconfigv1.VLANSpec) error {
+	for _, vlan := range vlans {
+		if vlan.ID < 1 || vlan.ID > 4094 {
+			return fmt.Errorf("[FATAL] Invalid VLAN id %d on %s, must be between 1 and 4094", vlan.ID, link)
+		}
+		name := vlan.Name
+		if name == "" {
+			name = fmt.Sprintf("%s.%d", link, vlan.ID)
+		}
+		if _, ok := config.VLANs[name]; ok {
+			return fmt.Errorf("[FATAL] VLAN %s is defined twice in the machineSpec", name)
+		}
+		device, err := newNetplanDevice(vlan.IPConfig, vlan.MTU)
+		if err != nil {
+			return fmt.Errorf("[FATAL] VLAN %s in the machineSpec: %v", name, err)
+		}
+		device.ID = vlan.ID
+		device.Link = link
+		if config.VLANs == nil {
+			config.VLANs = make(map[string]netplanDevice)
+		}
+		config.VLANs[name] = device
+	}
+	return nil
+}
+
+// newNetplanDevice returns the device configured by the IPConfig. A static
+// config requires the prefix length of its addresses, thus the netmask of an
+// ip.
+func newNetplanDevice(ipConfig vsphereconfigv1.IPConfig, mtu int64) (netplanDevice, error) {
+	device := netplanDevice{MTU: mtu}
+	switch ipConfig.NetworkType {
+	case vsphereconfigv1.Static:
+		addresses, err := vsphereutils.GetIPAddresses(ipConfig)
+		if err != nil {
+			return device, err
+		}
+		if len(addresses) == 0 {
+			return device, fmt.Errorf("static network config has neither an ip nor ips")
+		}
+		for _, address := range addresses {
+			if !address.IsIPv6() && address.Prefix == 0 {
+				return device, fmt.Errorf("no netmask for the address %s", address.IP)
+			}
+			device.Addresses = append(device.Addresses, address.CIDR())
+		}
+		device.Gateway4, device.Gateway6 = vsphereutils.GetGateways(ipConfig)
+	case "", vsphereconfigv1.DHCP:
+		device.DHCP4 = true
+	case vsphereconfigv1.None:
+	default:
+		return device, fmt.Errorf("unknown networkType %q", ipConfig.NetworkType)
+	}
+	if len(ipConfig.Dns) > 0 || len(ipConfig.SearchDomains) > 0 {
+		device.Nameservers = &netplanNameservers{Addresses: ipConfig.Dns, Search: ipConfig.SearchDomains}
+	}
+	for _, route := range ipConfig.Routes {
+		if _, _, err := net.ParseCIDR(route.To); err != nil {
+			return device, fmt.Errorf("route destination %q is not a CIDR", route.To)
+		}
+		if net.ParseIP(route.Via) == nil {
+			return device, fmt.Errorf("route gateway %q is not an address", route.Via)
+		}
+		device.Routes = append(device.Routes, netplanRoute{To: route.To, Via: route.Via, Metric: route.Metric})
+	}
+	return device, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,285 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+var update = flag.Bool("update", false, "update the golden files of the network configs")
+
+func TestGetCloudInitMetaDataNetworkConfig(t *testing.T) {
+	dualStack := &clusterv1.Cluster{}
+	dualStack.Spec.ClusterNetwork.Pods.CIDRBlocks = []string{"10.244.0.0/16", "fd00:244::/56"}
+	tests := []struct {
+		name        string
+		cluster     *clusterv1.Cluster
+		machineSpec vsphereconfigv1.VsphereMachineSpec
+	}{
+		{
+			name: "dhcp",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{
+				Networks: []vsphereconfigv1.NetworkSpec{
+					{NetworkName: "VM Network", IPConfig: vsphereconfigv1.IPConfig{NetworkType: vsphereconfigv1.DHCP}},
+				},
+			},
+		},
+		{
+			name: "static",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{
+				Networks: []vsphereconfigv1.NetworkSpec{
+					{
+						NetworkName: "VM Network",
+						MACAddress:  "00:50:56:3F:00:01",
+						IPConfig: vsphereconfigv1.IPConfig{
+							NetworkType:   vsphereconfigv1.Static,
+							IP:            "192.168.10.20",
+							Netmask:       "255.255.255.0",
+							Gateway:       "192.168.10.1",
+							Dns:           []string{"192.168.10.2"},
+							SearchDomains: []string{"example.com"},
+						},
+					},
+					{
+						NetworkName: "storage",
+						MTU:         9000,
+						IPConfig: vsphereconfigv1.IPConfig{
+							NetworkType: vsphereconfigv1.Static,
+							IPs:         []string{"10.20.0.20/24", "fd00:20::20/64"},
+							Routes: []vsphereconfigv1.RouteSpec{
+								{To: "10.30.0.0/16", Via: "10.20.0.1", Metric: 100},
+								{To: "fd00:30::/48", Via: "fd00:20::1"},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "ipv6-only",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{
+				Networks: []vsphereconfigv1.NetworkSpec{
+					{
+						NetworkName: "VM Network",
+						IPConfig: vsphereconfigv1.IPConfig{
+							NetworkType: vsphereconfigv1.Static,
+							IPs:         []string{"fd00::10/64", "fd01::10/64"},
+							// An IPv6 gateway is used as gateway6
+							Gateway: "fd00::1",
+							Dns:     []string{"fd00::53"},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "dual-stack",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{
+				Networks: []vsphereconfigv1.NetworkSpec{
+					{
+						NetworkName: "VM Network",
+						IPConfig: vsphereconfigv1.IPConfig{
+							NetworkType: vsphereconfigv1.Static,
+							IPs:         []string{"10.0.0.10/24", "fd00::10/64"},
+							Gateway:     "10.0.0.1",
+							Gateway6:    "fd00::1",
+						},
+					},
+				},
+			},
+		},
+		{
+			name:    "dual-stack-dhcp",
+			cluster: dualStack,
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{
+				Networks: []vsphereconfigv1.NetworkSpec{
+					{NetworkName: "VM Network", IPConfig: vsphereconfigv1.IPConfig{NetworkType: vsphereconfigv1.DHCP}},
+					{
+						NetworkName: "storage",
+						IPConfig: vsphereconfigv1.IPConfig{
+							NetworkType: vsphereconfigv1.Static,
+							IPs:         []string{"10.20.0.20/24", "fd00:20::20/64"},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "bond-vlans",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{
+				Networks: []vsphereconfigv1.NetworkSpec{
+					{
+						NetworkName: "VM Network",
+						IPConfig:    vsphereconfigv1.IPConfig{NetworkType: vsphereconfigv1.None},
+						VLANs: []vsphereconfigv1.VLANSpec{
+							{ID: 100, IPConfig: vsphereconfigv1.IPConfig{NetworkType: vsphereconfigv1.Static, IPs: []string{"10.100.0.20/24"}}},
+						},
+					},
+					{NetworkName: "trunk-a", Bond: "bond0", MTU: 9000},
+					{NetworkName: "trunk-b", Bond: "bond0", MTU: 9000},
+				},
+				Bonds: []vsphereconfigv1.BondSpec{
+					{
+						Name:               "bond0",
+						Mode:               "active-backup",
+						MIIMonitorInterval: 100,
+						MTU:                9000,
+						IPConfig:           vsphereconfigv1.IPConfig{NetworkType: vsphereconfigv1.DHCP},
+						VLANs: []vsphereconfigv1.VLANSpec{
+							{
+								ID:   200,
+								Name: "storage",
+								MTU:  9000,
+								IPConfig: vsphereconfigv1.IPConfig{
+									NetworkType: vsphereconfigv1.Static,
+									IPs:         []string{"10.200.0.20/24"},
+									Routes:      []vsphereconfigv1.RouteSpec{{To: "10.210.0.0/16", Via: "10.200.0.1"}},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metadata, err := GetCloudInitMetaData("machine1", test.cluster, &vsphereconfigv1.VsphereMachineProviderConfig{MachineSpec: test.machineSpec})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fields map[string]string
+			if err := json.Unmarshal([]byte(metadata), &fields); err != nil {
+				t.Fatalf("invalid metadata: %v", err)
+			}
+			if fields["local-hostname"] != "machine1" || fields["network.encoding"] != "base64" {
+				t.Errorf("unexpected metadata %v", fields)
+			}
+			networkConfig, err := base64.StdEncoding.DecodeString(fields["network"])
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", "network-"+test.name+".yaml")
+			if *update {
+				if err := ioutil.WriteFile(golden, networkConfig, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(networkConfig) != string(expected) {
+				t.Errorf("network config does not match %s, got:\n%s", golden, networkConfig)
+			}
+		})
+	}
+}
+
+func TestGetNetworkConfigErrors(t *testing.T) {
+	static := vsphereconfigv1.IPConfig{NetworkType: vsphereconfigv1.Static, IPs: []string{"10.0.0.10/24"}}
+	tests := []struct {
+		name        string
+		machineSpec vsphereconfigv1.VsphereMachineSpec
+	}{
+		{
+			name: "no netmask",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{Networks: []vsphereconfigv1.NetworkSpec{
+				{IPConfig: vsphereconfigv1.IPConfig{NetworkType: vsphereconfigv1.Static, IP: "10.0.0.10"}},
+			}},
+		},
+		{
+			name: "no address",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{Networks: []vsphereconfigv1.NetworkSpec{
+				{IPConfig: vsphereconfigv1.IPConfig{NetworkType: vsphereconfigv1.Static, Gateway: "10.0.0.1"}},
+			}},
+		},
+		{
+			name: "ipv6 in ip",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{Networks: []vsphereconfigv1.NetworkSpec{
+				{IPConfig: vsphereconfigv1.IPConfig{NetworkType: vsphereconfigv1.Static, IP: "fd00::10"}},
+			}},
+		},
+		{
+			name: "no prefix length",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{Networks: []vsphereconfigv1.NetworkSpec{
+				{IPConfig: vsphereconfigv1.IPConfig{NetworkType: vsphereconfigv1.Static, IPs: []string{"fd00::10"}}},
+			}},
+		},
+		{
+			name: "invalid route",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{Networks: []vsphereconfigv1.NetworkSpec{
+				{IPConfig: vsphereconfigv1.IPConfig{NetworkType: vsphereconfigv1.DHCP, Routes: []vsphereconfigv1.RouteSpec{{To: "10.1.0.0", Via: "10.0.0.1"}}}},
+			}},
+		},
+		{
+			name: "unknown bond",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{Networks: []vsphereconfigv1.NetworkSpec{
+				{Bond: "bond0"},
+			}},
+		},
+		{
+			name: "bond member with ipConfig",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{
+				Networks: []vsphereconfigv1.NetworkSpec{{Bond: "bond0", IPConfig: static}},
+				Bonds:    []vsphereconfigv1.BondSpec{{Name: "bond0"}},
+			},
+		},
+		{
+			name: "bond without members",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{
+				Networks: []vsphereconfigv1.NetworkSpec{{IPConfig: static}},
+				Bonds:    []vsphereconfigv1.BondSpec{{Name: "bond0"}},
+			},
+		},
+		{
+			name: "unknown bond mode",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{
+				Networks: []vsphereconfigv1.NetworkSpec{{Bond: "bond0"}},
+				Bonds:    []vsphereconfigv1.BondSpec{{Name: "bond0", Mode: "lacp"}},
+			},
+		},
+		{
+			name: "invalid vlan id",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{Networks: []vsphereconfigv1.NetworkSpec{
+				{IPConfig: static, VLANs: []vsphereconfigv1.VLANSpec{{ID: 4095}}},
+			}},
+		},
+		{
+			name: "duplicate vlan",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{Networks: []vsphereconfigv1.NetworkSpec{
+				{IPConfig: static, VLANs: []vsphereconfigv1.VLANSpec{{ID: 10, Name: "vlan10"}}},
+				{IPConfig: static, VLANs: []vsphereconfigv1.VLANSpec{{ID: 10, Name: "vlan10"}}},
+			}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := GetNetworkConfig(nil, &test.machineSpec); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -20,6 +20,9 @@ import (
 	"bytes"
 	"encoding/base64"
 	"fmt"
+	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 
@@ -38,6 +41,74 @@ type TemplateParams struct {
 	Machine           *clusterv1.Machine
 	DockerImages      []string
 	Preloaded         bool
+	// Zone and Region are the topology labels of the failure domain of the
+	// Machine, if any
+	Zone   string
+	Region string
+}
+
+const (
+	// ZoneLabel is the Node label of the failure domain of the Machine
+	ZoneLabel = "topology.kubernetes.io/zone"
+	// RegionLabel is the Node label of the region of the failure domain
+	RegionLabel = "topology.kubernetes.io/region"
+)
+
+// NodeLabels returns the labels of the Machine along with the topology labels
+// to register the Node with.
+func (params TemplateParams) NodeLabels() map[string]string {
+	labels := make(map[string]string)
+	if params.Machine != nil {
+		for k, v := range params.Machine.Spec.Labels {
+			labels[k] = v
+		}
+	}
+	if params.Zone != "" {
+		labels[ZoneLabel] = params.Zone
+	}
+	if params.Region != "" {
+		labels[RegionLabel] = params.Region
+	}
+	return labels
+}
+
+// clusterCIDRs returns the pod and service CIDRs of the cluster, the pod
+// CIDRs first.
+func (params TemplateParams) clusterCIDRs() []string {
+	if params.Cluster == nil {
+		return nil
+	}
+	network := params.Cluster.Spec.ClusterNetwork
+	return append(append([]string{}, network.Pods.CIDRBlocks...), network.Services.CIDRBlocks...)
+}
+
+// IPv6Primary returns whether IPv6 is the primary IP family of the cluster,
+// i.e. the first pod CIDR is an IPv6 range. The nodes then register with
+// their IPv6 address.
+func (params TemplateParams) IPv6Primary() bool {
+	cidrs := params.clusterCIDRs()
+	return len(cidrs) > 0 && vsphereutils.IsIPv6CIDR(cidrs[0])
+}
+
+// IPv6Enabled returns whether any pod or service CIDR is an IPv6 range.
+func (params TemplateParams) IPv6Enabled() bool {
+	for _, cidr := range params.clusterCIDRs() {
+		if vsphereutils.IsIPv6CIDR(cidr) {
+			return true
+		}
+	}
+	return false
+}
+
+// DualStack returns whether the cluster has both IPv4 and IPv6 pod or
+// service CIDRs.
+func (params TemplateParams) DualStack() bool {
+	for _, cidr := range params.clusterCIDRs() {
+		if !vsphereutils.IsIPv6CIDR(cidr) {
+			return params.IPv6Enabled()
+		}
+	}
+	return false
 }
 
 // Returns the startup script for the nodes.
@@ -55,6 +126,16 @@ func GetNodeStartupScript(params TemplateParams) (string, error) {
 }
 
 func GetMasterStartupScript(params TemplateParams) (string, error) {
+	if params.DualStack() {
+		// kubeadm supports dual-stack clusters as of 1.16
+		v, err := version.ParseGeneric(params.MajorMinorVersion)
+		if err != nil {
+			return "", err
+		}
+		if v.LessThan(version.MustParseGeneric("1.16")) {
+			return "", fmt.Errorf("[FATAL] dual-stack clusters require Kubernetes 1.16 or later, the control plane version is %s", params.MajorMinorVersion)
+		}
+	}
 	var buf bytes.Buffer
 	tName := "fullScript"
 	if isPreloaded(params) {
@@ -98,23 +179,27 @@ func preloadScript(t *template.Template, k8sVersion string, dockerImages []strin
 }
 
 var (
-	nodeStartupScriptTemplate        *template.Template
-	masterStartupScriptTemplate      *template.Template
-	cloudInitUserDataTemplate        *template.Template
-	cloudProviderConfigTemplate      *template.Template
-	cloudInitMetaDataNetworkTemplate *template.Template
-	cloudInitMetaDataTemplate        *template.Template
+	nodeStartupScriptTemplate   *template.Template
+	masterStartupScriptTemplate *template.Template
+	cloudInitUserDataTemplate   *template.Template
+	cloudProviderConfigTemplate *template.Template
+	cloudInitMetaDataTemplate   *template.Template
 )
 
 func init() {
 	endpoint := func(apiEndpoint *clusterv1.APIEndpoint) string {
-		return fmt.Sprintf("%s:%d", apiEndpoint.Host, apiEndpoint.Port)
+		return net.JoinHostPort(apiEndpoint.Host, strconv.Itoa(apiEndpoint.Port))
 	}
 
 	labelMap := func(labels map[string]string) string {
+		keys := make([]string, 0, len(labels))
+		for k := range labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
 		var builder strings.Builder
-		for k, v := range labels {
-			builder.WriteString(fmt.Sprintf("%s=%s,", k, v))
+		for _, k := range keys {
+			builder.WriteString(fmt.Sprintf("%s=%s,", k, labels[k]))
 		}
 		return strings.TrimRight(builder.String(), ",")
 	}
@@ -147,6 +232,7 @@ func init() {
 	funcMap := map[string]interface{}{
 		"endpoint":     endpoint,
 		"getSubnet":    vsphereutils.GetSubnet,
+		"getSubnets":   vsphereutils.GetSubnets,
 		"labelMap":     labelMap,
 		"taintMap":     taintMap,
 		"base64Decode": base64Decode,
@@ -158,25 +244,21 @@ func init() {
 	masterStartupScriptTemplate = template.Must(masterStartupScriptTemplate.Parse(genericTemplates))
 	cloudInitUserDataTemplate = template.Must(template.New("cloudInitUserData").Funcs(funcMap).Parse(cloudInitUserData))
 	cloudProviderConfigTemplate = template.Must(template.New("cloudProviderConfig").Parse(cloudProviderConfig))
-	cloudInitMetaDataNetworkTemplate = template.Must(template.New("cloudInitMetaDataNetwork").Parse(networkSpec))
 	cloudInitMetaDataTemplate = template.Must(template.New("cloudInitMetaData").Parse(cloudInitMetaData))
 }
 
 // Returns the startup script for the nodes.
-func GetCloudInitMetaData(name string, params *vsphereconfigv1.VsphereMachineProviderConfig) (string, error) {
-	var buf bytes.Buffer
-	param := CloudInitMetadataNetworkTemplate{
-		Networks: params.MachineSpec.Networks,
-	}
-	if err := cloudInitMetaDataNetworkTemplate.Execute(&buf, param); err != nil {
+func GetCloudInitMetaData(name string, cluster *clusterv1.Cluster, params *vsphereconfigv1.VsphereMachineProviderConfig) (string, error) {
+	networkConfig, err := GetNetworkConfig(cluster, &params.MachineSpec)
+	if err != nil {
 		return "", err
 	}
-	param2 := CloudInitMetadataTemplate{
-		NetworkSpec: base64.StdEncoding.EncodeToString(buf.Bytes()),
+	var buf bytes.Buffer
+	param := CloudInitMetadataTemplate{
+		NetworkSpec: base64.StdEncoding.EncodeToString([]byte(networkConfig)),
 		Hostname:    name,
 	}
-	buf.Reset()
-	if err := cloudInitMetaDataTemplate.Execute(&buf, param2); err != nil {
+	if err := cloudInitMetaDataTemplate.Execute(&buf, param); err != nil {
 		return "", err
 	}
 	return buf.String(), nil
@@ -222,9 +304,6 @@ type CloudInitTemplate struct {
 	NTPServers          []string
 }
 
-type CloudInitMetadataNetworkTemplate struct {
-	Networks []vsphereconfigv1.NetworkSpec
-}
 type CloudInitMetadataTemplate struct {
 	NetworkSpec string
 	Hostname    string
@@ -238,34 +317,6 @@ const cloudInitMetaData = `
 }
 `
 
-const networkSpec = `
-version: 1
-config:
-{{- range $index, $network := .Networks}}
-  - type: physical
-    name: eth{{ $index }}
-    subnets:
-    {{- if eq $network.IPConfig.NetworkType "static" }}
-      - type: static
-        address: {{ $network.IPConfig.IP }}
-        {{- if $network.IPConfig.Gateway }}
-        gateway: {{ $network.IPConfig.Gateway }}
-        {{- end }}
-        {{- if $network.IPConfig.Netmask }}
-        netmask: {{ $network.IPConfig.Netmask }}
-        {{- end }}
-        {{- if $network.IPConfig.Dns }}
-        dns_nameservers:
-        {{- range $network.IPConfig.Dns }}
-          - {{ . }}
-        {{- end }}
-        {{- end }}
-    {{- else }}
-      - type: dhcp
-    {{- end }}
-{{- end }}
-`
-
 const cloudInitUserData = `
 #cloud-config
 users:
@@ -368,6 +419,10 @@ set -x
 (
 {{- end }}
 
+{{ define "nodeIP" -}}
+{{ if .IPv6Primary }}ip -6 route get 2001:4860:4860::8888{{ else }}ip route get 8.8.8.8{{ end }} | awk '{for(i=1; i<=NF; i++) if($i~/src/) print $(i+1)}'
+{{- end }}
+
 {{define "endScript" -}}
 
 echo done.
@@ -437,7 +492,7 @@ apt-get install -y kubelet=${KUBELET} kubeadm=${KUBEADM} kubectl=${KUBECTL}
 TOKEN={{ .Token }}
 MASTER={{ index .Cluster.Status.APIEndpoints 0 | endpoint }}
 MACHINE={{ .Machine.ObjectMeta.Namespace }}/{{ .Machine.ObjectMeta.Name }}
-NODE_LABEL_OPTION={{ if .Machine.Spec.Labels }}--node-labels={{ labelMap .Machine.Spec.Labels }}{{ end }}
+NODE_LABEL_OPTION={{ if .NodeLabels }}--node-labels={{ labelMap .NodeLabels }}{{ end }}
 NODE_TAINTS_OPTION={{ if .Machine.Spec.Taints }}--register-with-taints={{ taintMap .Machine.Spec.Taints }}{{ end }}
 
 # Disable swap otherwise kubelet won't run
@@ -448,9 +503,12 @@ systemctl enable docker || true
 systemctl start docker || true
 
 sysctl net.bridge.bridge-nf-call-iptables=1
+{{- if .IPv6Enabled }}
+sysctl net.bridge.bridge-nf-call-ip6tables=1
+sysctl net.ipv6.conf.all.forwarding=1
+{{- end }}
 
-` +
-	"PUBLICIP=`ip route get 8.8.8.8 | awk '{for(i=1; i<=NF; i++) if($i~/src/) print $(i+1)}'`" + `
+PUBLICIP=$({{ template "nodeIP" . }})
 
 cat > /etc/systemd/system/kubelet.service.d/20-cloud.conf << EOF
 [Service]
@@ -536,9 +594,9 @@ PORT=443
 MACHINE={{ .Machine.ObjectMeta.Name }}
 CONTROL_PLANE_VERSION={{ .Machine.Spec.Versions.ControlPlane }}
 CLUSTER_DNS_DOMAIN={{ .Cluster.Spec.ClusterNetwork.ServiceDomain }}
-POD_CIDR={{ getSubnet .Cluster.Spec.ClusterNetwork.Pods }}
-SERVICE_CIDR={{ getSubnet .Cluster.Spec.ClusterNetwork.Services }}
-NODE_LABEL_OPTION={{ if .Machine.Spec.Labels }}--node-labels={{ labelMap .Machine.Spec.Labels }}{{ end }}
+POD_CIDR={{ getSubnets .Cluster.Spec.ClusterNetwork.Pods }}
+SERVICE_CIDR={{ getSubnets .Cluster.Spec.ClusterNetwork.Services }}
+NODE_LABEL_OPTION={{ if .NodeLabels }}--node-labels={{ labelMap .NodeLabels }}{{ end }}
 NODE_TAINTS_OPTION={{ if .Machine.Spec.Taints }}--register-with-taints={{ taintMap .Machine.Spec.Taints }}{{ end }}
 
 # Disable swap otherwise kubelet won't run
@@ -548,11 +606,14 @@ sed -i '/ swap / s/^/#/' /etc/fstab
 systemctl enable docker
 systemctl start docker
 
-` +
-	"PRIVATEIP=`ip route get 8.8.8.8 | awk '{for(i=1; i<=NF; i++) if($i~/src/) print $(i+1)}'`" + `
+{{- if .IPv6Enabled }}
+sysctl net.bridge.bridge-nf-call-ip6tables=1
+sysctl net.ipv6.conf.all.forwarding=1
+{{- end }}
+
+PRIVATEIP=$({{ template "nodeIP" . }})
 echo $PRIVATEIP > /tmp/.ip
-` +
-	"PUBLICIP=`ip route get 8.8.8.8 | awk '{for(i=1; i<=NF; i++) if($i~/src/) print $(i+1)}'`" + `
+PUBLICIP=$({{ template "nodeIP" . }})
 
 cat > /etc/systemd/system/kubelet.service.d/20-cloud.conf << EOF
 [Service]
@@ -626,6 +687,10 @@ localAPIEndpoint:
 ---
 apiVersion: kubeadm.k8s.io/v1beta1
 kind: ClusterConfiguration
+{{- if .DualStack }}
+featureGates:
+  IPv6DualStack: true
+{{- end }}
 etcd:
   local:
     imageRepository: "k8s.gcr.io"
@@ -666,6 +731,10 @@ scheduler:
 apiVersion: kubelet.config.k8s.io/v1beta1
 kind: KubeletConfiguration
 clusterDomain: ${CLUSTER_DNS_DOMAIN}
+{{- if .DualStack }}
+featureGates:
+  IPv6DualStack: true
+{{- end }}
 EOF
 
 {{- end }}{{/* end MajorMinorVersion 1.13 */}}
@@ -789,7 +858,7 @@ items:
                 - /home/weave/launch.sh
               env:
                 - name: IPALLOC_RANGE
-                  value: ${POD_CIDR}
+                  value: {{ getSubnet .Cluster.Spec.ClusterNetwork.Pods }}
                 - name: HOSTNAME
                   valueFrom:
                     fieldRef:
@@ -0,0 +1,94 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"strings"
+	"testing"
+
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+func TestMasterStartupScriptIPFamilies(t *testing.T) {
+	newParams := func(version string, pods, services []string) TemplateParams {
+		cluster := &clusterv1.Cluster{}
+		cluster.Spec.ClusterNetwork.Pods.CIDRBlocks = pods
+		cluster.Spec.ClusterNetwork.Services.CIDRBlocks = services
+		cluster.Spec.ClusterNetwork.ServiceDomain = "cluster.local"
+		machine := &clusterv1.Machine{}
+		machine.Spec.Versions.ControlPlane = version
+		machine.Spec.Versions.Kubelet = version
+		return TemplateParams{
+			MajorMinorVersion: version[:strings.LastIndex(version, ".")],
+			Cluster:           cluster,
+			Machine:           machine,
+		}
+	}
+
+	script, err := GetMasterStartupScript(newParams("1.13.1", []string{"192.168.0.0/16"}, []string{"10.96.0.0/12"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"POD_CIDR=192.168.0.0/16\n", "ip route get 8.8.8.8", "value: 192.168.0.0/16"} {
+		if !strings.Contains(script, s) {
+			t.Errorf("expected %q in the IPv4 script", s)
+		}
+	}
+	for _, s := range []string{"IPv6DualStack", "ip6tables"} {
+		if strings.Contains(script, s) {
+			t.Errorf("unexpected %q in the IPv4 script", s)
+		}
+	}
+
+	script, err = GetMasterStartupScript(newParams("1.16.2", []string{"fd00:10::/56", "192.168.0.0/16"}, []string{"fd00:20::/112", "10.96.0.0/12"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"POD_CIDR=fd00:10::/56,192.168.0.0/16\n",
+		"SERVICE_CIDR=fd00:20::/112,10.96.0.0/12\n",
+		"ip -6 route get 2001:4860:4860::8888",
+		"featureGates:\n  IPv6DualStack: true\netcd:",
+		"clusterDomain: ${CLUSTER_DNS_DOMAIN}\nfeatureGates:\n  IPv6DualStack: true\nEOF",
+		"sysctl net.ipv6.conf.all.forwarding=1",
+	} {
+		if !strings.Contains(script, s) {
+			t.Errorf("expected %q in the dual-stack script", s)
+		}
+	}
+
+	if _, err := GetMasterStartupScript(newParams("1.13.1", []string{"fd00:10::/56", "192.168.0.0/16"}, nil)); err == nil {
+		t.Error("expected an error for a dual-stack cluster before 1.16")
+	}
+}
+
+func TestNodeStartupScriptIPv6Endpoint(t *testing.T) {
+	cluster := &clusterv1.Cluster{}
+	cluster.Spec.ClusterNetwork.Pods.CIDRBlocks = []string{"fd00:10::/56"}
+	cluster.Status.APIEndpoints = []clusterv1.APIEndpoint{{Host: "fd00::10", Port: 443}}
+	machine := &clusterv1.Machine{}
+	machine.Spec.Versions.Kubelet = "1.13.1"
+	script, err := GetNodeStartupScript(TemplateParams{MajorMinorVersion: "1.13", Cluster: cluster, Machine: machine})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"MASTER=[fd00::10]:443", "ip -6 route get 2001:4860:4860::8888"} {
+		if !strings.Contains(script, s) {
+			t.Errorf("expected %q in the script", s)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package govmomi
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"sigs.k8s.io/cluster-api/pkg/util"
+)
+
+const (
+	controlPlaneRole = "controlplane"
+	workerRole       = "worker"
+)
+
+// antiAffinityRuleName returns the name of the DRS rule keeping the VMs of the
+// given role of the cluster on separate hosts.
+func antiAffinityRuleName(cluster *clusterv1.Cluster, role string) string {
+	return fmt.Sprintf("cluster-api-%s-%s-%s", cluster.Namespace, cluster.Name, role)
+}
+
+func machineRole(machine *clusterv1.Machine) string {
+	if util.IsControlPlaneMachine(machine) {
+		return controlPlaneRole
+	}
+	return workerRole
+}
+
+// ReconcileAntiAffinityRules makes sure that the DRS anti-affinity rules of the
+// cluster contain exactly the VMs of the passed machines, and that the rules
+// have the settings of the cluster provider config. The rules left with less
+// than two VMs are removed from every compute cluster. Nothing is done when the
+// cluster does not configure anti-affinity rules. The machines whose VM cannot
+// be looked up are reported and left out of the rules.
+func (pv *Provisioner) ReconcileAntiAffinityRules(cluster *clusterv1.Cluster, machines []*clusterv1.Machine) error {
+	clusterConfig, err := vsphereutils.GetClusterProviderSpec(cluster.Spec.ProviderSpec)
+	if err != nil {
+		return err
+	}
+	if clusterConfig.AntiAffinity == nil {
+		return nil
+	}
+	s, err := pv.sessionFromProviderConfig(cluster, nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(*s.context)
+	defer cancel()
+
+	// The VMs of each rule, keyed by compute cluster and role
+	type ruleKey struct {
+		computeCluster types.ManagedObjectReference
+		role           string
+	}
+	rules := make(map[ruleKey][]types.ManagedObjectReference)
+	for _, machine := range machines {
+		moref, err := vsphereutils.GetMachineRef(machine)
+		if err != nil {
+			pv.antiAffinityFailed(machine, err)
+			continue
+		}
+		if moref == "" {
+			// The VM of the machine is not created yet
+			continue
+		}
+		vmref := types.ManagedObjectReference{Type: "VirtualMachine", Value: moref}
+		ccr, err := computeClusterForVM(ctx, s, vmref)
+		if err != nil {
+			pv.antiAffinityFailed(machine, err)
+			continue
+		}
+		if ccr == nil {
+			continue
+		}
+		key := ruleKey{computeCluster: ccr.Reference(), role: machineRole(machine)}
+		rules[key] = append(rules[key], vmref)
+	}
+	// Every compute cluster is visited, so that the rules of the roles left
+	// with less than two VMs in a compute cluster are removed as well
+	ccrs, err := find.NewFinder(s.session.Client, false).ClusterComputeResourceList(ctx, "/...")
+	if err != nil {
+		if _, ok := err.(*find.NotFoundError); !ok {
+			return err
+		}
+	}
+	for _, ccr := range ccrs {
+		for _, role := range []string{controlPlaneRole, workerRole} {
+			vms := rules[ruleKey{computeCluster: ccr.Reference(), role: role}]
+			name := antiAffinityRuleName(cluster, role)
+			err := updateAntiAffinityRule(ctx, ccr, name, clusterConfig.AntiAffinity, func([]types.ManagedObjectReference) []types.ManagedObjectReference {
+				return vms
+			})
+			if err != nil {
+				return fmt.Errorf("error updating the anti-affinity rule %s: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// addToAntiAffinityRule adds the VM of the machine to the anti-affinity rule
+// of its role. Failures are only reported as the rules are reconciled along
+// with the cluster as well.
+func (pv *Provisioner) addToAntiAffinityRule(ctx context.Context, s *SessionContext, cluster *clusterv1.Cluster, machine *clusterv1.Machine, vmref types.ManagedObjectReference) {
+	pv.updateMachineAntiAffinityRule(ctx, s, cluster, machine, vmref, func(vms []types.ManagedObjectReference) []types.ManagedObjectReference {
+		for _, vm := range vms {
+			if vm == vmref {
+				return vms
+			}
+		}
+		return append(vms, vmref)
+	})
+}
+
+// removeFromAntiAffinityRule removes the VM of the machine from the
+// anti-affinity rule of its role. Failures are only reported as vSphere drops
+// the VM from the rule when the VM is destroyed anyway.
+func (pv *Provisioner) removeFromAntiAffinityRule(ctx context.Context, s *SessionContext, cluster *clusterv1.Cluster, machine *clusterv1.Machine, vmref types.ManagedObjectReference) {
+	pv.updateMachineAntiAffinityRule(ctx, s, cluster, machine, vmref, func(vms []types.ManagedObjectReference) []types.ManagedObjectReference {
+		var remaining []types.ManagedObjectReference
+		for _, vm := range vms {
+			if vm != vmref {
+				remaining = append(remaining, vm)
+			}
+		}
+		return remaining
+	})
+}
+
+func (pv *Provisioner) updateMachineAntiAffinityRule(ctx context.Context, s *SessionContext, cluster *clusterv1.Cluster, machine *clusterv1.Machine,
+	vmref types.ManagedObjectReference, update func([]types.ManagedObjectReference) []types.ManagedObjectReference) {
+	clusterConfig, err := vsphereutils.GetClusterProviderSpec(cluster.Spec.ProviderSpec)
+	if err != nil || clusterConfig.AntiAffinity == nil {
+		return
+	}
+	ccr, err := computeClusterForVM(ctx, s, vmref)
+	if err == nil && ccr != nil {
+		err = updateAntiAffinityRule(ctx, ccr, antiAffinityRuleName(cluster, machineRole(machine)), clusterConfig.AntiAffinity, update)
+	}
+	if err != nil {
+		pv.antiAffinityFailed(machine, err)
+	}
+}
+
+func (pv *Provisioner) antiAffinityFailed(machine *clusterv1.Machine, err error) {
+	klog.Warningf("Error updating the anti-affinity rule for Machine %s: %s", machine.Name, err)
+	if pv.eventRecorder != nil {
+		pv.eventRecorder.Eventf(machine, corev1.EventTypeWarning, "AntiAffinityFailed", "Error updating the anti-affinity rule: %s", err)
+	}
+}
+
+// computeClusterForVM returns the compute cluster the VM runs in, or nil if
+// the VM runs on a standalone host, which has no DRS rules.
+func computeClusterForVM(ctx context.Context, s *SessionContext, vmref types.ManagedObjectReference) (*object.ClusterComputeResource, error) {
+	var vm mo.VirtualMachine
+	if err := s.session.RetrieveOne(ctx, vmref, []string{"runtime.host"}, &vm); err != nil {
+		return nil, err
+	}
+	if vm.Runtime.Host == nil {
+		return nil, nil
+	}
+	var host mo.HostSystem
+	if err := s.session.RetrieveOne(ctx, *vm.Runtime.Host, []string{"parent"}, &host); err != nil {
+		return nil, err
+	}
+	if host.Parent == nil || host.Parent.Type != "ClusterComputeResource" {
+		return nil, nil
+	}
+	return object.NewClusterComputeResource(s.session.Client, *host.Parent), nil
+}
+
+// updateAntiAffinityRule updates the VMs of the named rule with the passed
+// function and applies the rule settings. vSphere requires at least two VMs
+// in an anti-affinity rule, thus the rule is only created once there are two
+// VMs and removed when less than two VMs are left.
+func updateAntiAffinityRule(ctx context.Context, ccr *object.ClusterComputeResource, name string, config *vsphereconfigv1.AntiAffinityConfig,
+	update func([]types.ManagedObjectReference) []types.ManagedObjectReference) error {
+	clusterConfig, err := ccr.Configuration(ctx)
+	if err != nil {
+		return err
+	}
+	var rule *types.ClusterAntiAffinityRuleSpec
+	for _, r := range clusterConfig.Rule {
+		if r.GetClusterRuleInfo().Name == name {
+			antiAffinity, ok := r.(*types.ClusterAntiAffinityRuleSpec)
+			if !ok {
+				return fmt.Errorf("[FATAL] DRS rule %s exists but is not a VM anti-affinity rule", name)
+			}
+			rule = antiAffinity
+			break
+		}
+	}
+
+	var current []types.ManagedObjectReference
+	if rule != nil {
+		current = rule.Vm
+	}
+	vms := update(current)
+	info := &types.ClusterAntiAffinityRuleSpec{
+		ClusterRuleInfo: types.ClusterRuleInfo{
+			Name:      name,
+			Enabled:   types.NewBool(config.Enabled),
+			Mandatory: types.NewBool(config.Mandatory),
+		},
+		Vm: vms,
+	}
+	ruleSpec := types.ClusterRuleSpec{Info: info}
+	switch {
+	case rule == nil && len(vms) < 2:
+		return nil
+	case rule == nil:
+		klog.V(4).Infof("Creating anti-affinity rule %s with %d VMs", name, len(vms))
+		ruleSpec.Operation = types.ArrayUpdateOperationAdd
+	case len(vms) < 2:
+		klog.V(4).Infof("Removing anti-affinity rule %s", name)
+		ruleSpec.Operation = types.ArrayUpdateOperationRemove
+		ruleSpec.RemoveKey = rule.Key
+	case sameVMs(rule.Vm, vms) && isTrue(rule.Enabled) == config.Enabled && isTrue(rule.Mandatory) == config.Mandatory:
+		// Nothing to update
+		return nil
+	default:
+		klog.V(4).Infof("Updating anti-affinity rule %s with %d VMs", name, len(vms))
+		ruleSpec.Operation = types.ArrayUpdateOperationEdit
+		info.Key = rule.Key
+	}
+	task, err := ccr.Reconfigure(ctx, &types.ClusterConfigSpecEx{
+		RulesSpec: []types.ClusterRuleSpec{ruleSpec},
+	}, true)
+	if err != nil {
+		return err
+	}
+	return task.Wait(ctx)
+}
+
+func sameVMs(a, b []types.ManagedObjectReference) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	vms := make(map[types.ManagedObjectReference]bool, len(a))
+	for _, vm := range a {
+		vms[vm] = true
+	}
+	for _, vm := range b {
+		if !vms[vm] {
+			return false
+		}
+	}
+	return true
+}
+
+func isTrue(b *bool) bool {
+	return b != nil && *b
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package govmomi
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"testing"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/client-go/tools/record"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+func TestAntiAffinityRules(t *testing.T) {
+	model := simulator.VPX()
+	model.Host = 0 // ClusterHost only
+
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	cluster := newSimulatorCluster(s)
+	cluster.Name = "cluster1"
+	cluster.Namespace = "default"
+
+	ccr := simulator.Map.Any("ClusterComputeResource").(*simulator.ClusterComputeResource)
+	var machines []*clusterv1.Machine
+	for _, e := range simulator.Map.All("VirtualMachine") {
+		vm := e.(*simulator.VirtualMachine)
+		machineSpec := newSimulatorMachineSpec(vm, nil)
+		machine := newSimulatorMachine(machineSpec)
+		setSimulatorMachineRef(machine, vm.Reference().Value)
+		machines = append(machines, machine)
+	}
+	if len(machines) < 2 {
+		t.Fatalf("expected at least two VMs in the simulator, found %d", len(machines))
+	}
+	machines = machines[:2]
+
+	p := newSimulatorProvisioner()
+
+	// No rules are maintained unless configured
+	if err = p.ReconcileAntiAffinityRules(cluster, machines); err != nil {
+		t.Fatal(err)
+	}
+	if rule := findSimulatorRule(ccr, antiAffinityRuleName(cluster, controlPlaneRole)); rule != nil {
+		t.Fatal("expected no anti-affinity rule without antiAffinity config")
+	}
+
+	setSimulatorAntiAffinity(cluster, &vsphereconfigv1.AntiAffinityConfig{Enabled: true, Mandatory: true})
+	if err = p.ReconcileAntiAffinityRules(cluster, machines); err != nil {
+		t.Fatal(err)
+	}
+	rule := findSimulatorRule(ccr, antiAffinityRuleName(cluster, controlPlaneRole))
+	if rule == nil {
+		t.Fatal("expected the control-plane anti-affinity rule to be created")
+	}
+	if len(rule.Vm) != 2 || !isTrue(rule.Enabled) || !isTrue(rule.Mandatory) {
+		t.Errorf("unexpected anti-affinity rule %+v", rule)
+	}
+
+	setSimulatorAntiAffinity(cluster, &vsphereconfigv1.AntiAffinityConfig{Enabled: false})
+	if err = p.ReconcileAntiAffinityRules(cluster, machines); err != nil {
+		t.Fatal(err)
+	}
+	rule = findSimulatorRule(ccr, antiAffinityRuleName(cluster, controlPlaneRole))
+	if rule == nil || isTrue(rule.Enabled) || isTrue(rule.Mandatory) {
+		t.Errorf("expected the anti-affinity rule settings to be updated, got %+v", rule)
+	}
+
+	// The Machines whose VM cannot be looked up are reported and skipped
+	recorder := record.NewFakeRecorder(10)
+	p.eventRecorder = recorder
+	stale := newSimulatorMachine(newSimulatorMachineSpec(simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine), nil))
+	setSimulatorMachineRef(stale, "vm-stale")
+	invalid := newSimulatorMachine(newSimulatorMachineSpec(simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine), nil))
+	invalid.Spec.ProviderSpec.Value.Raw = []byte("{")
+	if err = p.ReconcileAntiAffinityRules(cluster, append([]*clusterv1.Machine{stale, invalid}, machines...)); err != nil {
+		t.Fatal(err)
+	}
+	if rule := findSimulatorRule(ccr, antiAffinityRuleName(cluster, controlPlaneRole)); rule == nil || len(rule.Vm) != 2 {
+		t.Errorf("expected the anti-affinity rule to keep the VMs of the other Machines, got %+v", rule)
+	}
+	if len(recorder.Events) != 2 {
+		t.Errorf("expected an event for each skipped Machine, got %d", len(recorder.Events))
+	}
+	p.eventRecorder = nil
+
+	// Removing a VM leaves a single VM, thus the rule is removed
+	ses, err := p.sessionFromProviderConfig(cluster, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moref, _ := vsphereutils.GetMachineRef(machines[0])
+	p.removeFromAntiAffinityRule(context.Background(), ses, cluster, machines[0], types.ManagedObjectReference{Type: "VirtualMachine", Value: moref})
+	if rule := findSimulatorRule(ccr, antiAffinityRuleName(cluster, controlPlaneRole)); rule != nil {
+		t.Errorf("expected the anti-affinity rule to be removed, got %+v", rule)
+	}
+
+	// The rule of a role left without Machines is removed by the reconcile
+	if err = p.ReconcileAntiAffinityRules(cluster, machines); err != nil {
+		t.Fatal(err)
+	}
+	if rule := findSimulatorRule(ccr, antiAffinityRuleName(cluster, controlPlaneRole)); rule == nil {
+		t.Fatal("expected the control-plane anti-affinity rule to be created again")
+	}
+	if err = p.ReconcileAntiAffinityRules(cluster, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rule := findSimulatorRule(ccr, antiAffinityRuleName(cluster, controlPlaneRole)); rule != nil {
+		t.Errorf("expected the anti-affinity rule without Machines to be removed, got %+v", rule)
+	}
+}
+
+func findSimulatorRule(ccr *simulator.ClusterComputeResource, name string) *types.ClusterAntiAffinityRuleSpec {
+	for _, rule := range ccr.ConfigurationEx.(*types.ClusterConfigInfoEx).Rule {
+		if rule.GetClusterRuleInfo().Name == name {
+			return rule.(*types.ClusterAntiAffinityRuleSpec)
+		}
+	}
+	return nil
+}
+
+func setSimulatorMachineRef(machine *clusterv1.Machine, moref string) {
+	machineConfig, err := vsphereutils.GetMachineProviderSpec(machine.Spec.ProviderSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	machineConfig.MachineRef = moref
+	machine.Spec.ProviderSpec.Value.Raw, err = json.Marshal(machineConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func setSimulatorAntiAffinity(cluster *clusterv1.Cluster, config *vsphereconfigv1.AntiAffinityConfig) {
+	clusterConfig, err := vsphereutils.GetClusterProviderSpec(cluster.Spec.ProviderSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clusterConfig.AntiAffinity = config
+	cluster.Spec.ProviderSpec.Value.Raw, err = json.Marshal(clusterConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
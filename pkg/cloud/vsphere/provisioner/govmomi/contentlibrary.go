@@ -0,0 +1,189 @@
+package govmomi
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vapi/library"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/vcenter"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/constants"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	clustererror "sigs.k8s.io/cluster-api/pkg/controller/error"
+	apierrors "sigs.k8s.io/cluster-api/pkg/errors"
+)
+
+// contentLibraryTemplateName returns the name of the local template the
+// library item is imported to.
+func contentLibraryTemplateName(machineSpec *vsphereconfigv1.VsphereMachineSpec) string {
+	return fmt.Sprintf("%s-%s", machineSpec.ContentLibrary, machineSpec.LibraryItem)
+}
+
+// libraryImport is the import of a library item running in the background,
+// err is set once done is closed.
+type libraryImport struct {
+	done chan struct{}
+	err  error
+}
+
+// getContentLibraryTemplate returns the local template imported from the
+// content library item of the machine. The library item is deployed into the
+// template folder of the machine and marked as template on first use, the following
+// Machines are cloned from that cached template. The import runs in the
+// background, a RequeueAfterError being returned until it is done, and at most
+// one import runs per template.
+func (pv *Provisioner) getContentLibraryTemplate(ctx context.Context, s *SessionContext, cluster *clusterv1.Cluster, machine *clusterv1.Machine,
+	machineConfig *vsphereconfigv1.VsphereMachineProviderConfig) (*object.VirtualMachine, error) {
+	machineSpec := &machineConfig.MachineSpec
+	if machineSpec.ContentLibrary == "" || machineSpec.LibraryItem == "" {
+		return nil, pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"both contentLibrary and libraryItem must be set to deploy from a content library"), constants.CreateEventAction)
+	}
+	if machineSpec.VMTemplate != "" {
+		return nil, pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"template cannot be combined with contentLibrary and libraryItem"), constants.CreateEventAction)
+	}
+
+	folder, err := pv.getTemplateFolder(ctx, s, cluster, machineSpec)
+	if err != nil {
+		return nil, err
+	}
+	name := contentLibraryTemplateName(machineSpec)
+	templatePath := path.Join(folder.InventoryPath, name)
+
+	pv.libraryImportsMutex.Lock()
+	defer pv.libraryImportsMutex.Unlock()
+	if imp, ok := pv.libraryImports[templatePath]; ok {
+		select {
+		case <-imp.done:
+			delete(pv.libraryImports, templatePath)
+			if imp.err != nil {
+				return nil, fmt.Errorf("error importing the library item %s as template %s: %s", machineSpec.LibraryItem, name, imp.err)
+			}
+		default:
+			klog.V(4).Infof("Waiting for the import of the library item %s as template %s", machineSpec.LibraryItem, name)
+			return nil, &clustererror.RequeueAfterError{RequeueAfter: time.Second * 10}
+		}
+	}
+
+	template, err := s.finder.VirtualMachine(ctx, templatePath)
+	if err == nil {
+		if err := ensureTemplate(ctx, template); err != nil {
+			// The VM may still be deployed by another controller
+			klog.Warningf("Cached template %s of the library item %s is not usable yet: %s", name, machineSpec.LibraryItem, err)
+			return nil, &clustererror.RequeueAfterError{RequeueAfter: time.Second * 10}
+		}
+		klog.V(4).Infof("Using the cached template %s of the library item %s", name, machineSpec.LibraryItem)
+		return template, nil
+	}
+	if _, ok := err.(*find.NotFoundError); !ok {
+		return nil, err
+	}
+
+	klog.Infof("Importing the library item %s of the content library %s as template %s", machineSpec.LibraryItem, machineSpec.ContentLibrary, name)
+	if pv.eventRecorder != nil {
+		pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Importing", "Importing library item %s as template %s", machineSpec.LibraryItem, name)
+	}
+	pool, err := s.finder.ResourcePoolOrDefault(ctx, machineSpec.ResourcePool)
+	if err != nil {
+		return nil, err
+	}
+	deploy := vcenter.Deploy{
+		DeploymentSpec: vcenter.DeploymentSpec{
+			Name:          name,
+			AcceptAllEULA: true,
+		},
+		Target: vcenter.Target{
+			ResourcePoolID: pool.Reference().Value,
+			FolderID:       folder.Reference().Value,
+		},
+	}
+	if machineSpec.Datastore != "" {
+		ds, err := s.finder.Datastore(ctx, machineSpec.Datastore)
+		if err != nil {
+			return nil, err
+		}
+		deploy.DefaultDatastoreID = ds.Reference().Value
+	}
+
+	imp := &libraryImport{done: make(chan struct{})}
+	if pv.libraryImports == nil {
+		pv.libraryImports = make(map[string]*libraryImport)
+	}
+	pv.libraryImports[templatePath] = imp
+	libraryName, item := machineSpec.ContentLibrary, machineSpec.LibraryItem
+	go func() {
+		defer close(imp.done)
+		// The import outlives the reconcile of the machine
+		ctx := context.Background()
+		var vmref *types.ManagedObjectReference
+		err := pv.withRestClient(ctx, s, cluster, func(rc *rest.Client) error {
+			var err error
+			vmref, err = deployLibraryItem(ctx, rc, libraryName, item, deploy)
+			return err
+		})
+		if err != nil {
+			// A VM of the same name is deployed by another controller, which
+			// is then used as the cached template
+			if template, findErr := find.NewFinder(s.session.Client, false).VirtualMachine(ctx, templatePath); findErr == nil {
+				klog.Infof("Template %s of the library item %s already exists: %s", name, item, err)
+				imp.err = ensureTemplate(ctx, template)
+				return
+			}
+			imp.err = err
+			return
+		}
+		imp.err = ensureTemplate(ctx, object.NewVirtualMachine(s.session.Client, *vmref))
+	}()
+	return nil, &clustererror.RequeueAfterError{RequeueAfter: time.Second * 10}
+}
+
+// ensureTemplate marks the VM as template unless it already is one.
+func ensureTemplate(ctx context.Context, vm *object.VirtualMachine) error {
+	var vmProps mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"config.template"}, &vmProps); err != nil {
+		return err
+	}
+	if vmProps.Config != nil && vmProps.Config.Template {
+		return nil
+	}
+	if err := vm.MarkAsTemplate(ctx); err != nil {
+		return fmt.Errorf("error marking the VM %s as template: %s", vm.Reference().Value, err)
+	}
+	return nil
+}
+
+// deployLibraryItem deploys the OVF item of the content library and returns
+// the reference of the deployed VM. The deployment blocks until the VM is
+// created.
+func deployLibraryItem(ctx context.Context, rc *rest.Client, libraryName, itemName string, deploy vcenter.Deploy) (*types.ManagedObjectReference, error) {
+	m := library.NewManager(rc)
+	libraryIDs, err := m.FindLibrary(ctx, library.Find{Name: libraryName})
+	if err != nil {
+		return nil, err
+	}
+	if len(libraryIDs) != 1 {
+		return nil, fmt.Errorf("[FATAL] Found %d content libraries named %s", len(libraryIDs), libraryName)
+	}
+	itemIDs, err := m.FindLibraryItems(ctx, library.FindItem{LibraryID: libraryIDs[0], Name: itemName})
+	if err != nil {
+		return nil, err
+	}
+	if len(itemIDs) != 1 {
+		return nil, fmt.Errorf("[FATAL] Found %d library items named %s", len(itemIDs), itemName)
+	}
+	vmref, err := vcenter.NewManager(rc).DeployLibraryItem(ctx, itemIDs[0], deploy)
+	if err != nil {
+		return nil, fmt.Errorf("error deploying library item %s: %s", itemName, err)
+	}
+	return vmref, nil
+}
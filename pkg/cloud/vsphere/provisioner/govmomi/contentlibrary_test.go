@@ -0,0 +1,235 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package govmomi
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/library"
+	"github.com/vmware/govmomi/vapi/rest"
+	vapi "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/client-go/tools/record"
+	clustererror "sigs.k8s.io/cluster-api/pkg/controller/error"
+)
+
+func TestCreateFromContentLibrary(t *testing.T) {
+	model := simulator.VPX()
+	model.Host = 0 // ClusterHost only
+
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+	model.Service.Handle(vapi.New(s.URL, simulator.Map.OptionManager().Setting))
+
+	cluster := newSimulatorCluster(s)
+
+	c, err := govmomi.NewClient(context.Background(), s.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := simulator.Map.Any("Datastore").(*simulator.Datastore)
+	newSimulatorContentLibrary(t, s, c, ds, "images", "debian")
+
+	// The library item was imported as template by an earlier Machine
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	src := object.NewVirtualMachine(c.Client, vm.Reference())
+	folder := object.NewFolder(c.Client, *vm.Parent)
+	task, err := src.Clone(context.Background(), folder, "images-ubuntu", types.VirtualMachineCloneSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newSimulatorProvisioner()
+	p.eventRecorder = record.NewFakeRecorder(10)
+
+	machineSpec := newSimulatorMachineSpec(vm, nil)
+	machineSpec.Datastore = ds.Name
+	machineSpec.ContentLibrary = "images"
+	machineSpec.LibraryItem = "ubuntu"
+	if err = p.Create(context.Background(), cluster, newSimulatorMachine(machineSpec)); err == nil {
+		t.Error("expected a template combined with a content library to fail")
+	}
+
+	machineSpec.VMTemplate = ""
+	if err = p.Create(context.Background(), cluster, newSimulatorMachine(machineSpec)); err != nil {
+		t.Fatal(err)
+	}
+	if model.Machine+2 != model.Count().Machine {
+		t.Error("failed to clone vm from the cached template")
+	}
+
+	// The import runs in the background, the Machines are requeued meanwhile
+	machineSpec.LibraryItem = "debian"
+	err = p.Create(context.Background(), cluster, newSimulatorMachine(machineSpec))
+	if _, ok := err.(*clustererror.RequeueAfterError); !ok {
+		t.Fatalf("expected the Machine to be requeued during the import, got %v", err)
+	}
+	if len(p.libraryImports) != 1 {
+		t.Fatalf("expected one import, got %d", len(p.libraryImports))
+	}
+	var templatePath string
+	for templatePath = range p.libraryImports {
+	}
+	<-p.libraryImports[templatePath].done
+	if err = p.libraryImports[templatePath].err; err != nil {
+		t.Fatal(err)
+	}
+
+	// The Machines are cloned from the imported template
+	machine := newSimulatorMachine(machineSpec)
+	machine.Name = "machine2"
+	if err = p.Create(context.Background(), cluster, machine); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.libraryImports) != 0 {
+		t.Errorf("expected the import to be cleared, got %d", len(p.libraryImports))
+	}
+	template, err := object.NewSearchIndex(c.Client).FindByInventoryPath(context.Background(), templatePath)
+	if err != nil || template == nil {
+		t.Fatalf("expected the library item to be imported as %s: %v", templatePath, err)
+	}
+	var templateProps mo.VirtualMachine
+	if err = c.RetrieveOne(context.Background(), template.Reference(), []string{"config.template"}, &templateProps); err != nil {
+		t.Fatal(err)
+	}
+	if !templateProps.Config.Template {
+		t.Error("expected the imported library item to be marked as template")
+	}
+	if model.Machine+4 != model.Count().Machine {
+		t.Error("failed to clone vm from the imported template")
+	}
+
+	// The import of an unknown library item fails
+	machineSpec.LibraryItem = "centos"
+	err = p.Create(context.Background(), cluster, newSimulatorMachine(machineSpec))
+	if _, ok := err.(*clustererror.RequeueAfterError); !ok {
+		t.Fatalf("expected the Machine to be requeued during the import, got %v", err)
+	}
+	for templatePath = range p.libraryImports {
+	}
+	<-p.libraryImports[templatePath].done
+	if err = p.Create(context.Background(), cluster, newSimulatorMachine(machineSpec)); err == nil {
+		t.Error("expected the failed import to be reported")
+	}
+	if len(p.libraryImports) != 0 {
+		t.Errorf("expected the failed import to be cleared, got %d", len(p.libraryImports))
+	}
+
+	// The Machines wait for the running import of their template
+	p.libraryImports[templatePath] = &libraryImport{done: make(chan struct{})}
+	err = p.Create(context.Background(), cluster, newSimulatorMachine(machineSpec))
+	if _, ok := err.(*clustererror.RequeueAfterError); !ok {
+		t.Errorf("expected the Machine to wait for the running import, got %v", err)
+	}
+}
+
+// simulatorOVF is the OVF descriptor of the library items of the simulator,
+// which only needs the virtual hardware of the VM.
+const simulatorOVF = `<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData" xmlns:vssd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_VirtualSystemSettingData">
+  <VirtualSystem ovf:id="vm" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1">
+    <Info>A virtual machine</Info>
+    <VirtualHardwareSection>
+      <Info>Virtual hardware requirements</Info>
+      <System>
+        <vssd:ElementName>Virtual Hardware Family</vssd:ElementName>
+        <vssd:InstanceID>0</vssd:InstanceID>
+        <vssd:VirtualSystemType>vmx-13</vssd:VirtualSystemType>
+      </System>
+      <Item>
+        <rasd:ElementName>1 virtual CPU(s)</rasd:ElementName>
+        <rasd:InstanceID>1</rasd:InstanceID>
+        <rasd:ResourceType>3</rasd:ResourceType>
+        <rasd:VirtualQuantity>1</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:ElementName>1024MB of memory</rasd:ElementName>
+        <rasd:InstanceID>2</rasd:InstanceID>
+        <rasd:ResourceType>4</rasd:ResourceType>
+        <rasd:VirtualQuantity>1024</rasd:VirtualQuantity>
+      </Item>
+    </VirtualHardwareSection>
+  </VirtualSystem>
+</Envelope>
+`
+
+// newSimulatorContentLibrary creates the content library on the datastore,
+// with an OVF item of each of the given names.
+func newSimulatorContentLibrary(t *testing.T, s *simulator.Server, c *govmomi.Client, ds *simulator.Datastore, name string, items ...string) {
+	ctx := context.Background()
+	rc := rest.NewClient(c.Client)
+	if err := rc.Login(ctx, s.URL.User); err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Logout(ctx)
+
+	m := library.NewManager(rc)
+	libraryID, err := m.CreateLibrary(ctx, library.Library{
+		Name:    name,
+		Type:    "LOCAL",
+		Storage: []library.StorageBackings{{DatastoreID: ds.Reference().Value, Type: "DATASTORE"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		itemID, err := m.CreateLibraryItem(ctx, library.Item{Name: item, Type: "ovf", LibraryID: libraryID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionID, err := m.CreateLibraryItemUpdateSession(ctx, library.Session{LibraryItemID: itemID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := m.AddLibraryItemFile(ctx, sessionID, library.UpdateFile{Name: item + ".ovf", SourceType: "PUSH"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(file.UploadEndpoint.URI)
+		if err != nil {
+			t.Fatal(err)
+		}
+		param := soap.DefaultUpload
+		param.ContentLength = int64(len(simulatorOVF))
+		if err = rc.Upload(ctx, strings.NewReader(simulatorOVF), u, &param); err != nil {
+			t.Fatal(err)
+		}
+		if err = m.CompleteLibraryItemUpdateSession(ctx, sessionID); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
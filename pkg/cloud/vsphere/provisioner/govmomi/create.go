@@ -48,7 +48,7 @@ func (pv *Provisioner) Create(ctx context.Context, cluster *clusterv1.Cluster, m
 	task := vsphereutils.GetActiveTasks(machine)
 	if task != "" {
 		// In case an active task is going on, wait for its completion
-		return pv.verifyAndUpdateTask(s, machine, task)
+		return pv.verifyAndUpdateTask(s, cluster, machine, task)
 	}
 	// Before going for cloning, check if we can locate a VM with the InstanceUUID
 	// as this Machine. If found, that VM is the right match for this machine
@@ -58,6 +58,7 @@ func (pv *Provisioner) Create(ctx context.Context, cluster *clusterv1.Cluster, m
 	}
 	if vmRef != "" {
 		pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Created", "Created Machine %s(%s)", machine.Name, vmRef)
+		pv.setupVirtualMachine(ctx, s, cluster, machine, types.ManagedObjectReference{Type: "VirtualMachine", Value: vmRef})
 		// Update the Machine object with the VM Reference annotation
 		_, err := pv.updateVMReference(machine, vmRef)
 		if err != nil {
@@ -68,6 +69,14 @@ func (pv *Provisioner) Create(ctx context.Context, cluster *clusterv1.Cluster, m
 	return pv.cloneVirtualMachine(s, cluster, machine)
 }
 
+// setupVirtualMachine adds the VM of the machine to its DRS rule and group and
+// tags it, once the VM is cloned or found by the instance UUID of the machine.
+func (pv *Provisioner) setupVirtualMachine(ctx context.Context, s *SessionContext, cluster *clusterv1.Cluster, machine *clusterv1.Machine, vmref types.ManagedObjectReference) {
+	pv.addToAntiAffinityRule(ctx, s, cluster, machine, vmref)
+	pv.addToFailureDomainGroup(ctx, s, cluster, machine, vmref)
+	pv.tagVirtualMachine(ctx, s, cluster, machine, vmref)
+}
+
 func (pv *Provisioner) findVMByInstanceUUID(ctx context.Context, s *SessionContext, machine *clusterv1.Machine) (string, error) {
 	klog.V(4).Infof("Trying to check existence of the VM via InstanceUUID %s", machine.UID)
 	si := object.NewSearchIndex(s.session.Client)
@@ -82,7 +91,7 @@ func (pv *Provisioner) findVMByInstanceUUID(ctx context.Context, s *SessionConte
 	return "", nil
 }
 
-func (pv *Provisioner) verifyAndUpdateTask(s *SessionContext, machine *clusterv1.Machine, taskmoref string) error {
+func (pv *Provisioner) verifyAndUpdateTask(s *SessionContext, cluster *clusterv1.Cluster, machine *clusterv1.Machine, taskmoref string) error {
 	ctx, cancel := context.WithCancel(*s.context)
 	defer cancel()
 	// If a task does exist on the
@@ -103,9 +112,10 @@ func (pv *Provisioner) verifyAndUpdateTask(s *SessionContext, machine *clusterv1
 		return &clustererror.RequeueAfterError{RequeueAfter: time.Second * 5}
 	// Successful
 	case types.TaskInfoStateSuccess:
-		if taskmo.Info.DescriptionId == "VirtualMachine.clone" {
-			vmref := taskmo.Info.Result.(types.ManagedObjectReference)
+		if isCloneTask(taskmo.Info) {
+			vmref := clonedVMReference(taskmo.Info)
 			pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Created", "Created Machine %s(%s)", machine.Name, vmref.Value)
+			pv.setupVirtualMachine(ctx, s, cluster, machine, vmref)
 			// Update the Machine object with the VM Reference annotation
 			updatedmachine, err := pv.updateVMReference(machine, vmref.Value)
 			if err != nil {
@@ -115,16 +125,109 @@ func (pv *Provisioner) verifyAndUpdateTask(s *SessionContext, machine *clusterv1
 			// Note: We are not mutating the object retrieved from the informer ever. The updatedmachine is the updated resource generated using DeepCopy
 			// This would just update the reference to be the newer object so that the status update works
 			machine = updatedmachine
-			return pv.setTaskRef(machine, "")
-		} else if taskmo.Info.DescriptionId == "VirtualMachine.reconfigure" {
+			resources, err := getResourcesStatus(ctx, s, vmref)
+			if err != nil {
+				klog.Warningf("Error fetching the resources of Machine %s: %s", machine.Name, err)
+			}
+			macs, err := getMACAddresses(ctx, s, vmref)
+			if err != nil {
+				klog.Warningf("Error fetching the MAC addresses of Machine %s: %s", machine.Name, err)
+			}
+			return pv.updateProviderStatus(machine, func(status *vsphereconfigv1.VsphereMachineProviderStatus) {
+				status.TaskRef = ""
+				if resources != nil {
+					status.Resources = resources
+				}
+				for i := range status.Networks {
+					if i < len(macs) && macs[i] != "" {
+						status.Networks[i].MACAddress = macs[i]
+					}
+				}
+			})
+		} else if taskmo.Info.DescriptionId == reconfigureTask {
 			pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Reconfigured", "Reconfigured Machine %s", taskmo.Info.EntityName)
+			resources, err := getResourcesStatus(ctx, s, *taskmo.Info.Entity)
+			if err != nil {
+				klog.Warningf("Error fetching the resources of Machine %s: %s", machine.Name, err)
+			}
+			return pv.updateProviderStatus(machine, func(status *vsphereconfigv1.VsphereMachineProviderStatus) {
+				status.TaskRef = ""
+				if resources != nil {
+					status.Resources = resources
+				}
+			})
+		} else if taskmo.Info.DescriptionId == powerOnTask {
+			pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "PoweredOn", "Powered on Machine %s", machine.Name)
+			return pv.updateProviderStatus(machine, func(status *vsphereconfigv1.VsphereMachineProviderStatus) {
+				status.TaskRef = ""
+				status.PowerState = string(types.VirtualMachinePowerStatePoweredOn)
+			})
+		} else if taskmo.Info.DescriptionId == powerOffTask {
+			pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "PoweredOff", "Powered off Machine %s", machine.Name)
+			return pv.updateProviderStatus(machine, func(status *vsphereconfigv1.VsphereMachineProviderStatus) {
+				status.TaskRef = ""
+				status.PowerState = string(types.VirtualMachinePowerStatePoweredOff)
+			})
+		} else if taskmo.Info.DescriptionId == createSnapshotTask || isRemoveSnapshotTask(taskmo.Info) {
+			if taskmo.Info.DescriptionId == createSnapshotTask {
+				pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Snapshotted", "Took a snapshot of Machine %s", machine.Name)
+			} else {
+				pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "RemovedSnapshot", "Removed a snapshot of Machine %s", machine.Name)
+			}
+			snapshots, err := pv.getMachineSnapshotsStatus(ctx, s, machine)
+			if err != nil {
+				klog.Warningf("Error fetching the snapshots of Machine %s: %s", machine.Name, err)
+			}
+			return pv.updateProviderStatus(machine, func(status *vsphereconfigv1.VsphereMachineProviderStatus) {
+				status.TaskRef = ""
+				if err == nil {
+					status.Snapshots = snapshots
+				}
+			})
+		} else if isRevertSnapshotTask(taskmo.Info) {
+			pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "RolledBack", "Rolled back Machine %s", machine.Name)
+		} else if taskmo.Info.DescriptionId == destroyTask {
+			klog.Infof("Virtual Machine %v deleted successfully", taskmo.Info.EntityName)
+			pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Killed", "Machine %v deletion complete", machine.Name)
 		}
 		return pv.setTaskRef(machine, "")
 	case types.TaskInfoStateError:
-		if taskmo.Info.DescriptionId == "VirtualMachine.clone" {
+		if isCloneTask(taskmo.Info) {
 			pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Failed", "Creation failed for Machine %v", machine.Name)
 			// Clear the reference to the failed task so that the next reconcile loop can re-create it
 			return pv.setTaskRef(machine, "")
+		} else if taskmo.Info.DescriptionId == reconfigureTask {
+			pv.eventRecorder.Eventf(machine, corev1.EventTypeWarning, "FailedReconfigure", "Reconfiguration failed for Machine %v: %s", machine.Name, taskError(taskmo.Info))
+			// Clear the reference to the failed task so that the next reconcile loop can retry it
+			return pv.setTaskRef(machine, "")
+		} else if taskmo.Info.DescriptionId == powerOnTask {
+			pv.eventRecorder.Eventf(machine, corev1.EventTypeWarning, "FailedPowerOn", "Power on failed for Machine %v: %s", machine.Name, taskError(taskmo.Info))
+			// Clear the reference to the failed task so that the next reconcile loop can retry it
+			return pv.setTaskRef(machine, "")
+		} else if taskmo.Info.DescriptionId == powerOffTask {
+			pv.eventRecorder.Eventf(machine, corev1.EventTypeWarning, "FailedPowerOff", "Power off failed for Machine %v: %s", machine.Name, taskError(taskmo.Info))
+			// Clear the reference to the failed task so that the next reconcile loop can retry it
+			return pv.setTaskRef(machine, "")
+		} else if taskmo.Info.DescriptionId == createSnapshotTask {
+			pv.eventRecorder.Eventf(machine, corev1.EventTypeWarning, "FailedSnapshot", "Snapshot failed for Machine %v: %s", machine.Name, taskError(taskmo.Info))
+			// Clear the reference to the failed task, and the pending pre-update snapshot so that the next reconcile loop can retry it
+			return pv.updateProviderStatus(machine, func(status *vsphereconfigv1.VsphereMachineProviderStatus) {
+				status.TaskRef = ""
+				status.PreUpdateSnapshot = ""
+			})
+		} else if isRevertSnapshotTask(taskmo.Info) {
+			pv.eventRecorder.Eventf(machine, corev1.EventTypeWarning, "FailedRollback", "Rollback failed for Machine %v: %s", machine.Name, taskError(taskmo.Info))
+			// Clear the reference to the failed task, the rollback is only retried on request
+			return pv.setTaskRef(machine, "")
+		} else if isRemoveSnapshotTask(taskmo.Info) {
+			pv.eventRecorder.Eventf(machine, corev1.EventTypeWarning, "FailedSnapshotRemoval", "Snapshot removal failed for Machine %v: %s", machine.Name, taskError(taskmo.Info))
+			// Clear the reference to the failed task so that the next reconcile loop can retry it
+			return pv.setTaskRef(machine, "")
+		} else if taskmo.Info.DescriptionId == destroyTask {
+			klog.Errorf("VM Deletion failed on pv with following reason %v", taskError(taskmo.Info))
+			pv.eventRecorder.Eventf(machine, corev1.EventTypeWarning, "FailedDelete", "Deletion failed for Machine %v: %s", machine.Name, taskError(taskmo.Info))
+			// Clear the reference to the failed task so that the next reconcile loop can retry it
+			return pv.setTaskRef(machine, "")
 		}
 	default:
 		klog.Warningf("unknown state %s for task %s detected", taskmoref, taskmo.Info.State)
@@ -142,6 +245,18 @@ func (pv *Provisioner) cloneVirtualMachine(s *SessionContext, cluster *clusterv1
 	if err != nil {
 		return err
 	}
+	if err := validateExtraConfig(&machineConfig.MachineSpec); err != nil {
+		return pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"invalid extraConfig configuration: %v", err), constants.CreateEventAction)
+	}
+	if err := validateTags(&machineConfig.MachineSpec); err != nil {
+		return pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"invalid tags configuration: %v", err), constants.CreateEventAction)
+	}
+	if err := validateIgnitionNetworks(&machineConfig.MachineSpec); err != nil {
+		return pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"invalid networks configuration: %v", err), constants.CreateEventAction)
+	}
 
 	dc, err := s.finder.DatacenterOrDefault(ctx, machineConfig.MachineSpec.Datacenter)
 	if err != nil {
@@ -152,7 +267,12 @@ func (pv *Provisioner) cloneVirtualMachine(s *SessionContext, cluster *clusterv1
 	// Let's check to make sure we can find the template earlier on... Plus, we need
 	// the cluster/host info if we want to deploy direct to the cluster/host.
 	var src *object.VirtualMachine
-	if vsphereutils.IsValidUUID(machineConfig.MachineSpec.VMTemplate) {
+	if machineConfig.MachineSpec.ContentLibrary != "" || machineConfig.MachineSpec.LibraryItem != "" {
+		src, err = pv.getContentLibraryTemplate(ctx, s, cluster, machine, machineConfig)
+		if err != nil {
+			return err
+		}
+	} else if vsphereutils.IsValidUUID(machineConfig.MachineSpec.VMTemplate) {
 		// If the passed VMTemplate is a valid UUID, then first try to find it treating that as InstanceUUID
 		// In case if are not able to locate a matching VM then fall back to searching using the VMTemplate
 		// as a name
@@ -185,6 +305,25 @@ func (pv *Provisioner) cloneVirtualMachine(s *SessionContext, cluster *clusterv1
 	if err != nil {
 		return fmt.Errorf("error fetching host properties: %s", err)
 	}
+	candidateDatastores := hostProps.Datastore
+
+	domain, err := pv.getFailureDomain(cluster, machine, machineConfig)
+	if err != nil {
+		return err
+	}
+	var domainPlacement *failureDomainPlacement
+	if domain != nil {
+		domainPlacement, err = pv.getFailureDomainPlacement(ctx, s, machine, domain)
+		if err != nil {
+			return err
+		}
+		applyFailureDomain(machineConfig, domain)
+		candidateDatastores = domainPlacement.datastores
+	}
+	// The addresses from the IP pools are needed to render the network config
+	if err := pv.allocateIPAddresses(ctx, machine, machineConfig); err != nil {
+		return err
+	}
 
 	// Since it's assumed that the ResourcePool name has been provided in the config, if we
 	// want to deploy directly to the cluster/host, then we need to override the ResourcePool
@@ -193,36 +332,81 @@ func (pv *Provisioner) cloneVirtualMachine(s *SessionContext, cluster *clusterv1
 	// +--- getCloudProviderConfig()
 	resourcePoolPath := ""
 	if len(machineConfig.MachineSpec.ResourcePool) == 0 {
-
-		resourcePoolPath = fmt.Sprintf("/%s/host/%s/Resource", machineConfig.MachineSpec.Datacenter, hostProps.Name)
+		if domainPlacement != nil {
+			resourcePoolPath = domainPlacement.pool.InventoryPath
+		} else {
+			resourcePoolPath = fmt.Sprintf("/%s/host/%s/Resource", machineConfig.MachineSpec.Datacenter, hostProps.Name)
+		}
 		klog.Infof("Attempting to deploy directly to cluster/host RP: %s", resourcePoolPath)
 	}
 
 	// Fetch the user-data for the cloud-init first, so that we can fail fast before even trying to connect to pv
-	userData, err := pv.getCloudInitUserData(cluster, machine, resourcePoolPath)
-	if err != nil {
-		// err returned by the getCloudInitUserData would be of type RequeueAfterError in case kubeadm is not ready yet
-		return err
-	}
-	metaData, err := pv.getCloudInitMetaData(cluster, machine)
-	if err != nil {
-		// err returned by the getCloudInitMetaData would be of type RequeueAfterError in case kubeadm is not ready yet
-		return err
+	var userData, metaData string
+	var startupGuestInfo []types.BaseOptionValue
+	if machineConfig.MachineSpec.Customization != nil {
+		if machineConfig.MachineSpec.BootstrapFormat == vsphereconfigv1.IgnitionBootstrapFormat {
+			return pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+				"invalid customization configuration: VMs bootstrapped by Ignition cannot be customized by vSphere"), constants.CreateEventAction)
+		}
+		// VMs customized by vSphere get the startup script via guestinfo instead of cloud-init
+		startupGuestInfo, err = pv.getStartupGuestInfo(cluster, machine, machineConfig, resourcePoolPath, domain)
+		if err != nil {
+			return err
+		}
+	} else {
+		userData, err = pv.getCloudInitUserData(cluster, machine, machineConfig, resourcePoolPath, domain)
+		if err != nil {
+			// err returned by the getCloudInitUserData would be of type RequeueAfterError in case kubeadm is not ready yet
+			return err
+		}
+		metaData, err = pv.getCloudInitMetaData(cluster, machine, machineConfig)
+		if err != nil {
+			// err returned by the getCloudInitMetaData would be of type RequeueAfterError in case kubeadm is not ready yet
+			return err
+		}
 	}
 
 	var spec types.VirtualMachineCloneSpec
 	klog.V(4).Infof("[cloneVirtualMachine]: Preparing clone spec for VM %s", machine.Name)
 	klog.V(4).Infof("clone VM to folder %s", machineConfig.MachineSpec.VMFolder)
-	vmFolder, err := s.finder.FolderOrDefault(ctx, machineConfig.MachineSpec.VMFolder)
+	vmFolder, err := pv.getVMFolder(ctx, s, cluster, &machineConfig.MachineSpec)
 	if err != nil {
 		return err
 	}
 
-	ds, err := s.finder.DatastoreOrDefault(ctx, machineConfig.MachineSpec.Datastore)
-	if err != nil {
-		return err
+	placement := diskPlacement{
+		storagePolicyName: machineConfig.MachineSpec.StoragePolicyName,
+		placer:            newStoragePolicyPlacer(s, candidateDatastores),
+	}
+	var pod *object.StoragePod
+	switch {
+	case machineConfig.MachineSpec.DatastoreCluster != "":
+		if machineConfig.MachineSpec.Datastore != "" || placement.storagePolicyName != "" {
+			return pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+				"datastoreCluster cannot be combined with datastore or storagePolicyName"), constants.CreateEventAction)
+		}
+		// The datastore is picked by Storage DRS, see cloneOnDatastoreCluster
+		pod, err = s.finder.DatastoreCluster(ctx, machineConfig.MachineSpec.DatastoreCluster)
+		if err != nil {
+			return err
+		}
+	case placement.storagePolicyName != "":
+		// The VM home is placed on a datastore compatible with the storage policy
+		placement.profile, placement.datastore, err = placement.placer.place(ctx, placement.storagePolicyName, machineConfig.MachineSpec.Datastore)
+		if err != nil {
+			return err
+		}
+		spec.Location.Profile = placement.profile
+	default:
+		placement.datastore, err = s.finder.DatastoreOrDefault(ctx, machineConfig.MachineSpec.Datastore)
+		if err != nil {
+			return err
+		}
+	}
+	ds := placement.datastore
+	if ds != nil {
+		spec.Location.Datastore = types.NewReference(ds.Reference())
 	}
-	spec.Location.Datastore = types.NewReference(ds.Reference())
 
 	spec.Config = &types.VirtualMachineConfigSpec{}
 	// Use the object UID as the instanceUUID for the VM
@@ -237,7 +421,11 @@ func (pv *Provisioner) cloneVirtualMachine(s *SessionContext, cluster *clusterv1
 	if machineConfig.MachineSpec.MemoryMB > 0 {
 		spec.Config.MemoryMB = machineConfig.MachineSpec.MemoryMB
 	}
-	spec.Config.Annotation = fmt.Sprintf("Virtual Machine is part of the cluster %s managed by cluster-api", cluster.Name)
+	if err := applyResourceConfig(spec.Config, &machineConfig.MachineSpec); err != nil {
+		return pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"invalid resource configuration: %v", err), constants.CreateEventAction)
+	}
+	spec.Config.Annotation = vmAnnotation(cluster)
 	spec.Location.DiskMoveType = string(types.VirtualMachineRelocateDiskMoveOptionsMoveAllDiskBackingsAndConsolidate)
 
 	vmProps, err := PropertiesVM(src)
@@ -245,6 +433,21 @@ func (pv *Provisioner) cloneVirtualMachine(s *SessionContext, cluster *clusterv1
 		return fmt.Errorf("error fetching vm/template properties: %s", err)
 	}
 
+	switch machineConfig.MachineSpec.CloneMode {
+	case "", vsphereconfigv1.FullClone:
+	case vsphereconfigv1.LinkedClone:
+		snapshot, err := pv.getLinkedCloneSnapshot(ctx, machine, machineConfig, src, vmProps)
+		if err != nil {
+			return err
+		}
+		klog.V(4).Infof("[cloneVirtualMachine] Linked clone from snapshot %s of the template %s", snapshot.Value, machineConfig.MachineSpec.VMTemplate)
+		spec.Snapshot = snapshot
+		spec.Location.DiskMoveType = string(types.VirtualMachineRelocateDiskMoveOptionsCreateNewChildDiskBacking)
+	default:
+		return pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"invalid cloneMode %q, must be one of %q or %q", machineConfig.MachineSpec.CloneMode, vsphereconfigv1.FullClone, vsphereconfigv1.LinkedClone), constants.CreateEventAction)
+	}
+
 	if len(machineConfig.MachineSpec.ResourcePool) > 0 {
 		pool, err := s.finder.ResourcePoolOrDefault(ctx, machineConfig.MachineSpec.ResourcePool)
 
@@ -266,6 +469,9 @@ func (pv *Provisioner) cloneVirtualMachine(s *SessionContext, cluster *clusterv1
 		}
 
 		spec.Location.Pool = types.NewReference(pool.Reference())
+	} else if domainPlacement != nil {
+		klog.Infof("Attempting to use the ResourcePool of failure domain %s", domain.Name)
+		spec.Location.Pool = types.NewReference(domainPlacement.pool.Reference())
 	} else {
 		klog.Infof("Attempting to use Host ResourcePool")
 		pool, err := host.ResourcePool(ctx)
@@ -277,9 +483,30 @@ func (pv *Provisioner) cloneVirtualMachine(s *SessionContext, cluster *clusterv1
 
 		spec.Location.Pool = types.NewReference(pool.Reference())
 	}
+	if domainPlacement != nil && domainPlacement.host != nil {
+		spec.Location.Host = types.NewReference(domainPlacement.host.Reference())
+	}
 	spec.PowerOn = true
 
-	if machineConfig.MachineSpec.VsphereCloudInit {
+	vAppProperties, err := getVAppPropertySpecs(vmProps.Config.VAppConfig, machineConfig.MachineSpec.VAppProperties)
+	if err != nil {
+		return pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"invalid vAppProperties configuration: %v", err), constants.CreateEventAction)
+	}
+	if machineConfig.MachineSpec.Customization != nil {
+		spec.Customization, err = pv.getCustomizationSpec(ctx, s, machine, &machineConfig.MachineSpec)
+		if err != nil {
+			return pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+				"invalid customization configuration: %v", err), constants.CreateEventAction)
+		}
+		spec.Config.ExtraConfig = startupGuestInfo
+	} else if machineConfig.MachineSpec.BootstrapFormat == vsphereconfigv1.IgnitionBootstrapFormat {
+		// Ignition reads its config from guestinfo on vSphere
+		spec.Config.ExtraConfig = []types.BaseOptionValue{
+			&types.OptionValue{Key: "guestinfo.ignition.config.data", Value: userData},
+			&types.OptionValue{Key: "guestinfo.ignition.config.data.encoding", Value: "base64"},
+		}
+	} else if machineConfig.MachineSpec.VsphereCloudInit {
 		// In case of vsphere cloud-init datasource present, set the appropriate extraconfig options
 		var extraconfigs []types.BaseOptionValue
 		extraconfigs = append(extraconfigs, &types.OptionValue{Key: "guestinfo.metadata", Value: metaData})
@@ -300,19 +527,12 @@ func (pv *Provisioner) cloneVirtualMachine(s *SessionContext, cluster *clusterv1
 		var props []types.VAppPropertySpec
 		for _, p := range allProperties {
 			defaultValue := " "
-			if p.DefaultValue != "" {
+			if value, ok := machineConfig.MachineSpec.VAppProperties[p.Id]; ok {
+				defaultValue = value
+			} else if p.DefaultValue != "" {
 				defaultValue = p.DefaultValue
 			}
-			prop := types.VAppPropertySpec{
-				ArrayUpdateSpec: types.ArrayUpdateSpec{
-					Operation: types.ArrayUpdateOperationEdit,
-				},
-				Info: &types.VAppPropertyInfo{
-					Key:   p.Key,
-					Id:    p.Id,
-					Value: defaultValue,
-				},
-			}
+			prop := newVAppPropertySpec(p, defaultValue)
 			if p.Id == "user-data" {
 				prop.Info.Value = userData
 			}
@@ -331,30 +551,45 @@ func (pv *Provisioner) cloneVirtualMachine(s *SessionContext, cluster *clusterv1
 			Property: props,
 		}
 	}
+	spec.Config.ExtraConfig = mergeExtraConfig(spec.Config.ExtraConfig, machineConfig.MachineSpec.ExtraConfig)
+	if spec.Config.VAppConfig == nil && len(vAppProperties) > 0 {
+		spec.Config.VAppConfig = &types.VmConfigSpec{
+			Property: vAppProperties,
+		}
+	}
 
 	l := object.VirtualDeviceList(vmProps.Config.Hardware.Device)
 	deviceSpecs := []types.BaseVirtualDeviceConfigSpec{}
 	disks := l.SelectByType((*types.VirtualDisk)(nil))
-	// For the disks listed under the MachineSpec.Disks property, they are used
-	// only for resizing a maching disk on the template. Currently, no new disk
-	// is added. Only the matched disks via the DiskLabel are resized. If the
-	// MachineSpec.Disks is specified but none of the disks matched to the disks
-	// present in the VM Template then error is returned. This is to avoid the
-	// case when the user did want to resize but accidentally passed a wrong
-	// disk label. A 100% matching of disks in not enforced as the user might be
-	// interested in resizing only a subset of disks and thus we don't want to
-	// force the user to list all the disk and sizes if they don't want to change
-	// all.
+	// The disks listed under the MachineSpec.Disks property with a DiskLabel
+	// are used for resizing a matching disk on the template. If such disks are
+	// specified but none of them matched to the disks present in the VM
+	// Template then error is returned. This is to avoid the case when the user
+	// did want to resize but accidentally passed a wrong disk label. A 100%
+	// matching of disks in not enforced as the user might be interested in
+	// resizing only a subset of disks and thus we don't want to force the user
+	// to list all the disk and sizes if they don't want to change all.
+	// The disks without a DiskLabel are added as new disks further below.
 	diskMap := func(diskSpecs []vsphereconfigv1.DiskSpec) map[string]int64 {
 		diskMap := make(map[string]int64)
 		for _, s := range diskSpecs {
-			diskMap[s.DiskLabel] = s.DiskSizeGB
+			if s.DiskLabel != "" {
+				diskMap[s.DiskLabel] = s.DiskSizeGB
+			}
 		}
 		return diskMap
 	}(machineConfig.MachineSpec.Disks)
 	diskChange := false
 	for _, dev := range disks {
 		disk := dev.(*types.VirtualDisk)
+		if placement.profile != nil {
+			// Apply the storage policy of the VM to the disks of the template
+			spec.Location.Disk = append(spec.Location.Disk, types.VirtualMachineRelocateSpecDiskLocator{
+				DiskId:    disk.Key,
+				Datastore: ds.Reference(),
+				Profile:   placement.profile,
+			})
+		}
 		if newSize, ok := diskMap[disk.DeviceInfo.GetDescription().Label]; ok {
 			if disk.CapacityInBytes > vsphereutils.GiBToByte(newSize) {
 				return errors.New("[FATAL] Disk size provided should be more than actual disk size of the template. Please correct the machineSpec to proceed")
@@ -368,49 +603,72 @@ func (pv *Provisioner) cloneVirtualMachine(s *SessionContext, cluster *clusterv1
 			deviceSpecs = append(deviceSpecs, diskspec)
 		}
 	}
-	if !diskChange && len(machineConfig.MachineSpec.Disks) > 0 {
+	if !diskChange && len(diskMap) > 0 {
 		klog.V(4).Info("[cloneVirtualMachine] No disks were resized while cloning from template")
 		return fmt.Errorf("[FATAL] None of the disks specified in the MachineSpec matched with the disks on the template %s", machineConfig.MachineSpec.VMTemplate)
 	}
-
-	nics := l.SelectByType((*types.VirtualEthernetCard)(nil))
-	// Remove any existing nics on the source vm
-	for _, dev := range nics {
-		nic := dev.(types.BaseVirtualEthernetCard).GetVirtualEthernetCard()
-		nicspec := &types.VirtualDeviceConfigSpec{}
-		nicspec.Operation = types.VirtualDeviceConfigSpecOperationRemove
-		nicspec.Device = nic
-		deviceSpecs = append(deviceSpecs, nicspec)
+	newDiskSpecs, err := pv.getNewDiskSpecs(ctx, s, l, placement, machineConfig.MachineSpec.Disks)
+	if err != nil {
+		return err
 	}
-	// Add new nics based on the user info
-	nicid := int32(-100)
-	for _, network := range machineConfig.MachineSpec.Networks {
-		netRef, err := s.finder.Network(ctx, network.NetworkName)
-		if err != nil {
-			return err
-		}
-		nic := types.VirtualVmxnet3{}
-		nic.Key = nicid
-		nic.Backing, err = netRef.EthernetCardBackingInfo(ctx)
-		if err != nil {
-			return err
-		}
-		nicspec := &types.VirtualDeviceConfigSpec{}
-		nicspec.Operation = types.VirtualDeviceConfigSpecOperationAdd
-		nicspec.Device = &nic
-		deviceSpecs = append(deviceSpecs, nicspec)
-		nicid--
+	deviceSpecs = append(deviceSpecs, newDiskSpecs...)
+
+	nicSpecs, networks, err := getNICSpecs(ctx, s, l, machineConfig.MachineSpec.Networks)
+	if err != nil {
+		return pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"invalid network configuration: %v", err), constants.CreateEventAction)
 	}
+	deviceSpecs = append(deviceSpecs, nicSpecs...)
 	spec.Config.DeviceChange = deviceSpecs
 	if pv.eventRecorder != nil { // TODO: currently supporting nil for testing
 		pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Creating", "Creating Machine %v", machine.Name)
 	}
-	task, err := src.Clone(ctx, vmFolder, machine.Name, spec)
+	var task *object.Task
+	var datastoreName string
+	if pod != nil {
+		task, datastoreName, err = pv.cloneOnDatastoreCluster(ctx, s, machine, pod, src, vmFolder, spec)
+	} else {
+		task, err = src.Clone(ctx, vmFolder, machine.Name, spec)
+		datastoreName = ds.Name()
+	}
 	klog.V(6).Infof("clone VM with spec %v", spec)
 	if err != nil {
 		return err
 	}
-	return pv.setTaskRef(machine, task.Reference().Value)
+	return pv.updateProviderStatus(machine, func(status *vsphereconfigv1.VsphereMachineProviderStatus) {
+		status.TaskRef = task.Reference().Value
+		status.Datastore = datastoreName
+		status.Networks = networks
+		if domain != nil {
+			status.FailureDomain = domain.Name
+		}
+	})
+}
+
+// getLinkedCloneSnapshot returns the snapshot of the template to create the
+// linked clone from. The linked clone shares the disks of the snapshot, thus
+// the disks of the template cannot be resized.
+func (pv *Provisioner) getLinkedCloneSnapshot(ctx context.Context, machine *clusterv1.Machine, machineConfig *vsphereconfigv1.VsphereMachineProviderConfig,
+	src *object.VirtualMachine, vmProps *mo.VirtualMachine) (*types.ManagedObjectReference, error) {
+	for _, disk := range machineConfig.MachineSpec.Disks {
+		if disk.DiskLabel != "" {
+			return nil, pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+				"invalid linkedClone configuration: disk %q of the template cannot be resized since linked clones share the disks of the template snapshot", disk.DiskLabel), constants.CreateEventAction)
+		}
+	}
+	if machineConfig.MachineSpec.Snapshot != "" {
+		snapshot, err := src.FindSnapshot(ctx, machineConfig.MachineSpec.Snapshot)
+		if err != nil {
+			return nil, pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+				"invalid linkedClone configuration: snapshot %q not found on the template %s: %v", machineConfig.MachineSpec.Snapshot, machineConfig.MachineSpec.VMTemplate, err), constants.CreateEventAction)
+		}
+		return snapshot, nil
+	}
+	if vmProps.Snapshot == nil || vmProps.Snapshot.CurrentSnapshot == nil {
+		return nil, pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"invalid linkedClone configuration: the template %s has no current snapshot", machineConfig.MachineSpec.VMTemplate), constants.CreateEventAction)
+	}
+	return vmProps.Snapshot.CurrentSnapshot, nil
 }
 
 // PropertiesVM is a convenience method that wraps fetching the
@@ -468,21 +726,29 @@ func (vc *Provisioner) updateVMReference(machine *clusterv1.Machine, vmref strin
 }
 
 func (pv *Provisioner) setTaskRef(machine *clusterv1.Machine, taskref string) error {
+	return pv.updateProviderStatus(machine, func(status *vsphereconfigv1.VsphereMachineProviderStatus) {
+		status.TaskRef = taskref
+	})
+}
+
+// updateProviderStatus applies the passed changes to the provider status of the
+// machine and updates the machine status in case anything changed.
+func (pv *Provisioner) updateProviderStatus(machine *clusterv1.Machine, update func(*vsphereconfigv1.VsphereMachineProviderStatus)) error {
 	oldProviderStatus, err := vsphereutils.GetMachineProviderStatus(machine)
 	if err != nil {
 		return err
 	}
 
-	if oldProviderStatus != nil && oldProviderStatus.TaskRef == taskref {
-		// Nothing to update
-		return nil
-	}
 	newProviderStatus := &vsphereconfigv1.VsphereMachineProviderStatus{}
 	// create a copy of the old status so that any other fields except the ones we want to change can be retained
 	if oldProviderStatus != nil {
 		newProviderStatus = oldProviderStatus.DeepCopy()
 	}
-	newProviderStatus.TaskRef = taskref
+	update(newProviderStatus)
+	if oldProviderStatus != nil && reflect.DeepEqual(oldProviderStatus, newProviderStatus) {
+		// Nothing to update
+		return nil
+	}
 	newProviderStatus.LastUpdated = time.Now().UTC().String()
 	out, err := json.Marshal(newProviderStatus)
 	newMachine := machine.DeepCopy()
@@ -498,12 +764,11 @@ func (pv *Provisioner) setTaskRef(machine *clusterv1.Machine, taskref string) er
 	return nil
 }
 
-func (pv *Provisioner) getCloudInitMetaData(cluster *clusterv1.Cluster, machine *clusterv1.Machine) (string, error) {
-	machineconfig, err := vsphereutils.GetMachineProviderSpec(machine.Spec.ProviderSpec)
-	if err != nil {
-		return "", err
-	}
-	metadata, err := vpshereprovisionercommon.GetCloudInitMetaData(machine.Name, machineconfig)
+// getCloudInitMetaData renders the network config from the machine config,
+// which has the addresses allocated from the IP pools set, and the IP families
+// of the cluster.
+func (pv *Provisioner) getCloudInitMetaData(cluster *clusterv1.Cluster, machine *clusterv1.Machine, machineConfig *vsphereconfigv1.VsphereMachineProviderConfig) (string, error) {
+	metadata, err := vpshereprovisionercommon.GetCloudInitMetaData(machine.Name, cluster, machineConfig)
 	if err != nil {
 		return "", err
 	}
@@ -511,13 +776,35 @@ func (pv *Provisioner) getCloudInitMetaData(cluster *clusterv1.Cluster, machine
 	return metadata, nil
 }
 
+// validateIgnitionNetworks returns an error when a machine bootstrapped by
+// Ignition sets a network config, which is only delivered with the metadata of
+// cloud-init. The networks of such machines must use DHCP.
+func validateIgnitionNetworks(machineSpec *vsphereconfigv1.VsphereMachineSpec) error {
+	if machineSpec.BootstrapFormat != vsphereconfigv1.IgnitionBootstrapFormat {
+		return nil
+	}
+	if len(machineSpec.Bonds) > 0 {
+		return fmt.Errorf("[FATAL] Bonds are not supported with the %s bootstrapFormat", vsphereconfigv1.IgnitionBootstrapFormat)
+	}
+	for i, network := range machineSpec.Networks {
+		ipConfig := network.IPConfig
+		if network.IPPool != "" || (ipConfig.NetworkType != "" && ipConfig.NetworkType != vsphereconfigv1.DHCP) || len(network.VLANs) > 0 {
+			return fmt.Errorf("[FATAL] Network %d in the machineSpec must use DHCP without vlans with the %s bootstrapFormat", i, vsphereconfigv1.IgnitionBootstrapFormat)
+		}
+	}
+	return nil
+}
+
+// getCloudInitUserData returns the user data bootstrapping the VM. The passed
+// machine config has the datastore and the networks of the failure domain of
+// the machine applied, which are used by the cloud provider config.
 func (pv *Provisioner) getCloudInitUserData(cluster *clusterv1.Cluster, machine *clusterv1.Machine,
-	resourcePoolPath string) (string, error) {
-	script, err := pv.getStartupScript(cluster, machine)
+	machineconfig *vsphereconfigv1.VsphereMachineProviderConfig, resourcePoolPath string, domain *vsphereconfigv1.FailureDomain) (string, error) {
+	script, err := pv.getStartupScript(cluster, machine, domain)
 	if err != nil {
 		return "", err
 	}
-	config, err := pv.getCloudProviderConfig(cluster, machine, resourcePoolPath)
+	config, err := pv.getCloudProviderConfig(cluster, machineconfig, resourcePoolPath)
 	if err != nil {
 		return "", err
 	}
@@ -525,20 +812,30 @@ func (pv *Provisioner) getCloudInitUserData(cluster *clusterv1.Cluster, machine
 	if err != nil {
 		return "", err
 	}
-	machineconfig, err := vsphereutils.GetMachineProviderSpec(machine.Spec.ProviderSpec)
-	if err != nil {
-		return "", err
+	params := vpshereprovisionercommon.CloudInitTemplate{
+		Script:              script,
+		IsMaster:            util.IsControlPlaneMachine(machine),
+		CloudProviderConfig: config,
+		SSHPublicKey:        publicKey,
+		TrustedCerts:        machineconfig.MachineSpec.TrustedCerts,
+		NTPServers:          machineconfig.MachineSpec.NTPServers,
+	}
+	var userdata string
+	switch machineconfig.MachineSpec.BootstrapFormat {
+	case "", vsphereconfigv1.CloudConfigBootstrapFormat:
+		userdata, err = vpshereprovisionercommon.GetCloudInitUserData(params)
+	case vsphereconfigv1.IgnitionBootstrapFormat:
+		userdata, err = vpshereprovisionercommon.GetIgnitionConfig(
+			vpshereprovisionercommon.IgnitionTemplate{
+				CloudInitTemplate: params,
+				Hostname:          machine.Name,
+			},
+		)
+	default:
+		return "", pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"invalid bootstrapFormat %q, expected %q or %q", machineconfig.MachineSpec.BootstrapFormat,
+			vsphereconfigv1.CloudConfigBootstrapFormat, vsphereconfigv1.IgnitionBootstrapFormat), constants.CreateEventAction)
 	}
-	userdata, err := vpshereprovisionercommon.GetCloudInitUserData(
-		vpshereprovisionercommon.CloudInitTemplate{
-			Script:              script,
-			IsMaster:            util.IsControlPlaneMachine(machine),
-			CloudProviderConfig: config,
-			SSHPublicKey:        publicKey,
-			TrustedCerts:        machineconfig.MachineSpec.TrustedCerts,
-			NTPServers:          machineconfig.MachineSpec.NTPServers,
-		},
-	)
 	if err != nil {
 		return "", err
 	}
@@ -546,16 +843,12 @@ func (pv *Provisioner) getCloudInitUserData(cluster *clusterv1.Cluster, machine
 	return userdata, nil
 }
 
-func (pv *Provisioner) getCloudProviderConfig(cluster *clusterv1.Cluster, machine *clusterv1.Machine,
+func (pv *Provisioner) getCloudProviderConfig(cluster *clusterv1.Cluster, machineconfig *vsphereconfigv1.VsphereMachineProviderConfig,
 	resourcePoolPath string) (string, error) {
 	clusterConfig, err := vsphereutils.GetClusterProviderSpec(cluster.Spec.ProviderSpec)
 	if err != nil {
 		return "", err
 	}
-	machineconfig, err := vsphereutils.GetMachineProviderSpec(machine.Spec.ProviderSpec)
-	if err != nil {
-		return "", err
-	}
 
 	// cloud provider requires bare IP:port, so if it is parseable as a url with a scheme, then
 	// strip the scheme and path.  Otherwise continue.  TODO replace with better input validation.
@@ -597,13 +890,19 @@ func (pv *Provisioner) getCloudProviderConfig(cluster *clusterv1.Cluster, machin
 
 // Builds and returns the startup script for the passed machine and cluster.
 // Returns the full path of the saved startup script and possible error.
-func (pv *Provisioner) getStartupScript(cluster *clusterv1.Cluster, machine *clusterv1.Machine) (string, error) {
+// The zone and region labels of the failure domain, if any, are added to the
+// Node labels.
+func (pv *Provisioner) getStartupScript(cluster *clusterv1.Cluster, machine *clusterv1.Machine, domain *vsphereconfigv1.FailureDomain) (string, error) {
 	machineconfig, err := vsphereutils.GetMachineProviderSpec(machine.Spec.ProviderSpec)
 	if err != nil {
 		return "", pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
 			"Cannot unmarshal providerSpec field: %v", err), constants.CreateEventAction)
 	}
 	preloaded := machineconfig.MachineSpec.Preloaded
+	var zone, region string
+	if domain != nil {
+		zone, region = domain.Name, domain.Region
+	}
 	var startupScript string
 	if util.IsControlPlaneMachine(machine) {
 		if machine.Spec.Versions.ControlPlane == "" {
@@ -621,6 +920,8 @@ func (pv *Provisioner) getStartupScript(cluster *clusterv1.Cluster, machine *clu
 				Cluster:           cluster,
 				Machine:           machine,
 				Preloaded:         preloaded,
+				Zone:              zone,
+				Region:            region,
 			},
 		)
 		if err != nil {
@@ -654,6 +955,8 @@ func (pv *Provisioner) getStartupScript(cluster *clusterv1.Cluster, machine *clu
 				Cluster:           cluster,
 				Machine:           machine,
 				Preloaded:         preloaded,
+				Zone:              zone,
+				Region:            region,
 			},
 		)
 		if err != nil {
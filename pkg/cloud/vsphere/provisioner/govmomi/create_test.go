@@ -21,15 +21,18 @@ import (
 	"crypto/tls"
 	"log"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/simulator"
 	"github.com/vmware/govmomi/vim25/types"
 	yaml "gopkg.in/yaml.v2"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
 	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/constants"
 	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
@@ -50,6 +53,303 @@ func TestCreate(t *testing.T) {
 	s := model.Service.NewServer()
 	defer s.Close()
 
+	cluster := newSimulatorCluster(s)
+
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	disk := object.VirtualDeviceList(vm.Config.Hardware.Device).SelectByType((*types.VirtualDisk)(nil))[0].(*types.VirtualDisk)
+	disk.CapacityInKB = 20 * 1024 * 1024 // bump since default disk size is < 1GB
+
+	machine := newSimulatorMachine(newSimulatorMachineSpec(vm, []vsphereconfigv1.DiskSpec{
+		{
+			DiskSizeGB: disk.CapacityInKB / 1024 / 1024,
+			DiskLabel:  disk.DeviceInfo.GetDescription().Label,
+		},
+	}))
+
+	p := newSimulatorProvisioner()
+
+	err = p.Create(context.Background(), cluster, machine)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if model.Machine+1 != model.Count().Machine {
+		t.Error("failed to clone vm")
+	}
+}
+
+func TestCreateRecoversVM(t *testing.T) {
+	model := simulator.VPX()
+	model.Host = 0 // ClusterHost only
+
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	cluster := newSimulatorCluster(s)
+
+	// The VM of the machine was cloned, but its reference was never recorded
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	machine := newSimulatorMachine(newSimulatorMachineSpec(vm, nil))
+	machine.Namespace = "default"
+	machine.UID = "5f1a0e2c-3b1d-4c8e-9a0b-7d6e5f4a3b2c"
+	vm.Config.InstanceUuid = string(machine.UID)
+
+	p := newSimulatorProvisioner()
+	p.eventRecorder = record.NewFakeRecorder(10)
+	p.clusterV1alpha1 = newSimulatorMachineClient(machine)
+	if err = p.Create(context.Background(), cluster, machine); err != nil {
+		t.Fatal(err)
+	}
+
+	// The recovered VM gets the custom attributes of a cloned VM
+	values := make(map[string]bool)
+	for _, value := range vm.CustomValue {
+		values[value.(*types.CustomFieldStringValue).Value] = true
+	}
+	if !values["machine1"] || !values["default"] {
+		t.Errorf("expected the custom attributes of the machine to be set on the recovered VM, got %v", values)
+	}
+}
+
+func TestCreateWithNewDisks(t *testing.T) {
+	model := simulator.VPX()
+	model.Host = 0 // ClusterHost only
+
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	cluster := newSimulatorCluster(s)
+
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	templateDisks := object.VirtualDeviceList(vm.Config.Hardware.Device).SelectByType((*types.VirtualDisk)(nil))
+
+	unitNumber := int32(5)
+	machine := newSimulatorMachine(newSimulatorMachineSpec(vm, []vsphereconfigv1.DiskSpec{
+		{
+			DiskSizeGB:       10,
+			ProvisioningType: vsphereconfigv1.EagerZeroedThickProvisioned,
+		},
+		{
+			DiskSizeGB: 20,
+			UnitNumber: &unitNumber,
+			DiskMode:   string(types.VirtualDiskModeIndependent_persistent),
+		},
+		{
+			DiskSizeGB: 1,
+			Datastore:  "LocalDS_0",
+		},
+		{
+			DiskSizeGB: 1,
+			Datastore:  "LocalDS_0",
+		},
+	}))
+
+	p := newSimulatorProvisioner()
+
+	err = p.Create(context.Background(), cluster, machine)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clone := findSimulatorVM(machine.Name)
+	if clone == nil {
+		t.Fatal("failed to clone vm")
+	}
+
+	disks := object.VirtualDeviceList(clone.Config.Hardware.Device).SelectByType((*types.VirtualDisk)(nil))
+	if len(disks) != len(templateDisks)+4 {
+		t.Fatalf("expected %d disks on the clone, found %d", len(templateDisks)+4, len(disks))
+	}
+
+	eagerZeroed := disks[len(templateDisks)].(*types.VirtualDisk)
+	if eagerZeroed.CapacityInKB != 10*1024*1024 {
+		t.Errorf("expected the first new disk to have 10GB, found %dKB", eagerZeroed.CapacityInKB)
+	}
+	backing := eagerZeroed.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+	if backing.ThinProvisioned == nil || *backing.ThinProvisioned || backing.EagerlyScrub == nil || !*backing.EagerlyScrub {
+		t.Errorf("expected the first new disk to be eager zeroed thick provisioned")
+	}
+
+	independent := disks[len(templateDisks)+1].(*types.VirtualDisk)
+	if independent.UnitNumber == nil || *independent.UnitNumber != unitNumber {
+		t.Errorf("expected the second new disk to be placed at unit %d", unitNumber)
+	}
+	backing = independent.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+	if backing.DiskMode != string(types.VirtualDiskModeIndependent_persistent) {
+		t.Errorf("expected the second new disk to be in %s mode, found %s", types.VirtualDiskModeIndependent_persistent, backing.DiskMode)
+	}
+
+	// The disks on a datastore of their own are named apart
+	first := disks[len(templateDisks)+2].(*types.VirtualDisk).Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+	second := disks[len(templateDisks)+3].(*types.VirtualDisk).Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+	for _, backing := range []*types.VirtualDiskFlatVer2BackingInfo{first, second} {
+		if !strings.HasPrefix(backing.FileName, "[LocalDS_0] ") || !strings.HasSuffix(backing.FileName, ".vmdk") {
+			t.Errorf("expected a disk file on LocalDS_0, found %q", backing.FileName)
+		}
+	}
+	if first.FileName == second.FileName {
+		t.Errorf("expected the disks on LocalDS_0 to have different files, found %q", first.FileName)
+	}
+}
+
+func TestCreateLinkedClone(t *testing.T) {
+	model := simulator.VPX()
+	model.Host = 0 // ClusterHost only
+
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	cluster := newSimulatorCluster(s)
+
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	c, err := govmomi.NewClient(context.Background(), s.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task, err := object.NewVirtualMachine(c.Client, vm.Reference()).CreateSnapshot(context.Background(), "base", "", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newSimulatorProvisioner()
+	p.eventRecorder = record.NewFakeRecorder(10)
+
+	// Resizing a template disk is not possible with linked clones
+	disk := object.VirtualDeviceList(vm.Config.Hardware.Device).SelectByType((*types.VirtualDisk)(nil))[0].(*types.VirtualDisk)
+	machineSpec := newSimulatorMachineSpec(vm, []vsphereconfigv1.DiskSpec{
+		{
+			DiskSizeGB: 20,
+			DiskLabel:  disk.DeviceInfo.GetDescription().Label,
+		},
+	})
+	machineSpec.CloneMode = vsphereconfigv1.LinkedClone
+	machineSpec.Snapshot = "base"
+	if err = p.Create(context.Background(), cluster, newSimulatorMachine(machineSpec)); err == nil {
+		t.Error("expected linked clone with a resized template disk to fail")
+	}
+
+	machineSpec.Disks = nil
+	machineSpec.Snapshot = "missing"
+	if err = p.Create(context.Background(), cluster, newSimulatorMachine(machineSpec)); err == nil {
+		t.Error("expected linked clone from a missing snapshot to fail")
+	}
+
+	machineSpec.Snapshot = "base"
+	if err = p.Create(context.Background(), cluster, newSimulatorMachine(machineSpec)); err != nil {
+		t.Fatal(err)
+	}
+
+	if model.Machine+1 != model.Count().Machine {
+		t.Error("failed to clone vm")
+	}
+}
+
+func TestCreateOnDatastoreCluster(t *testing.T) {
+	model := simulator.VPX()
+	model.Host = 0 // ClusterHost only
+	model.Pod = 1
+
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	cluster := newSimulatorCluster(s)
+
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	pod := simulator.Map.Any("StoragePod").(*simulator.StoragePod)
+
+	p := newSimulatorProvisioner()
+	p.eventRecorder = record.NewFakeRecorder(10)
+
+	machineSpec := newSimulatorMachineSpec(vm, nil)
+	machineSpec.DatastoreCluster = pod.Name
+	machineSpec.Datastore = "LocalDS_0"
+	if err = p.Create(context.Background(), cluster, newSimulatorMachine(machineSpec)); err == nil {
+		t.Error("expected a datastore cluster combined with a datastore to fail")
+	}
+
+	c, err := govmomi.NewClient(context.Background(), s.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := simulator.Map.Any("Datastore").(*simulator.Datastore)
+	task, err := object.NewStoragePod(c.Client, pod.Reference()).MoveInto(context.Background(), []types.ManagedObjectReference{ds.Reference()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// vcsim recommends the datastore of the datastore cluster but does not
+	// implement applying Storage DRS recommendations
+	machineSpec.Datastore = ""
+	err = p.Create(context.Background(), cluster, newSimulatorMachine(machineSpec))
+	if err == nil || !strings.Contains(err.Error(), "error applying Storage DRS recommendation") {
+		t.Errorf("expected the Storage DRS recommendation to be applied, got %v", err)
+	}
+
+	enabled := false
+	task, err = object.NewStorageResourceManager(c.Client).ConfigureStorageDrsForPod(context.Background(),
+		object.NewStoragePod(c.Client, pod.Reference()), types.StorageDrsConfigSpec{
+			PodConfigSpec: &types.StorageDrsPodConfigSpec{Enabled: &enabled},
+		}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	err = p.Create(context.Background(), cluster, newSimulatorMachine(machineSpec))
+	if err == nil || !strings.Contains(err.Error(), "Storage DRS is disabled") {
+		t.Errorf("expected Storage DRS disabled error, got %v", err)
+	}
+
+	if model.Machine != model.Count().Machine {
+		t.Error("expected no vm to be cloned")
+	}
+}
+
+func findSimulatorVM(name string) *simulator.VirtualMachine {
+	for _, e := range simulator.Map.All("VirtualMachine") {
+		if vm := e.(*simulator.VirtualMachine); vm.Name == name {
+			return vm
+		}
+	}
+	return nil
+}
+
+func newSimulatorCluster(s *simulator.Server) *clusterv1.Cluster {
 	pass, _ := s.URL.User.Password()
 	clusterConfig := vsphereconfigv1.VsphereClusterProviderConfig{
 		TypeMeta: metav1.TypeMeta{
@@ -66,7 +366,7 @@ func TestCreate(t *testing.T) {
 		log.Fatal(err)
 	}
 
-	cluster := &clusterv1.Cluster{
+	return &clusterv1.Cluster{
 		ObjectMeta: metav1.ObjectMeta{
 			Annotations: map[string]string{
 				constants.KubeadmToken:           "__TODO__", // see govmomi.Provisioner.GetKubeadmToken
@@ -92,49 +392,46 @@ func TestCreate(t *testing.T) {
 			},
 		},
 	}
+}
 
-	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
-	disk := object.VirtualDeviceList(vm.Config.Hardware.Device).SelectByType((*types.VirtualDisk)(nil))[0].(*types.VirtualDisk)
-	disk.CapacityInKB = 20 * 1024 * 1024 // bump since default disk size is < 1GB
+func newSimulatorMachineSpec(vm *simulator.VirtualMachine, disks []vsphereconfigv1.DiskSpec) vsphereconfigv1.VsphereMachineSpec {
+	return vsphereconfigv1.VsphereMachineSpec{
+		Datacenter:   "",
+		Datastore:    "",
+		ResourcePool: "",
+		VMFolder:     "",
+		Networks: []vsphereconfigv1.NetworkSpec{
+			{
+				NetworkName: "VM Network",
+				IPConfig: vsphereconfigv1.IPConfig{
+					NetworkType: vsphereconfigv1.DHCP,
+				},
+			},
+		},
+		NumCPUs:          2,
+		MemoryMB:         2048,
+		VMTemplate:       vm.Name,
+		Disks:            disks,
+		Preloaded:        false,
+		VsphereCloudInit: true,
+	}
+}
 
+func newSimulatorMachine(machineSpec vsphereconfigv1.VsphereMachineSpec) *clusterv1.Machine {
 	machineConfig := vsphereconfigv1.VsphereMachineProviderConfig{
 		TypeMeta: metav1.TypeMeta{
 			APIVersion: "vsphereproviderconfig/v1alpha1",
 		},
-		MachineSpec: vsphereconfigv1.VsphereMachineSpec{
-			Datacenter:   "",
-			Datastore:    "",
-			ResourcePool: "",
-			VMFolder:     "",
-			Networks: []vsphereconfigv1.NetworkSpec{
-				{
-					NetworkName: "VM Network",
-					IPConfig: vsphereconfigv1.IPConfig{
-						NetworkType: vsphereconfigv1.DHCP,
-					},
-				},
-			},
-			NumCPUs:    2,
-			MemoryMB:   2048,
-			VMTemplate: vm.Name,
-			Disks: []vsphereconfigv1.DiskSpec{
-				{
-					DiskSizeGB: disk.CapacityInKB / 1024 / 1024,
-					DiskLabel:  disk.DeviceInfo.GetDescription().Label,
-				},
-			},
-			Preloaded:        false,
-			VsphereCloudInit: true,
-		},
+		MachineSpec: machineSpec,
 	}
 	machineConfig.TypeMeta.Kind = reflect.TypeOf(machineConfig).Name()
 
-	raw, err = yaml.Marshal(machineConfig)
+	raw, err := yaml.Marshal(machineConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	machine := &clusterv1.Machine{
+	return &clusterv1.Machine{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: "machine1",
 		},
@@ -150,23 +447,72 @@ func TestCreate(t *testing.T) {
 			},
 		},
 	}
+}
+
+func newSimulatorProvisioner() *Provisioner {
+	DefaultSSHPublicKeyFile = "create_test.go" // any file will avoid the k8s client path in GetSSHPublicKey()
 
-	p := &Provisioner{
+	return &Provisioner{
 		clusterV1alpha1: nil,
 		lister:          nil,
 		eventRecorder:   nil,
 		sessioncache:    make(map[string]interface{}),
 		k8sClient:       nil,
 	}
+}
 
-	DefaultSSHPublicKeyFile = "create_test.go" // any file will avoid the k8s client path in GetSSHPublicKey()
-
-	err = p.Create(context.Background(), cluster, machine)
-	if err != nil {
-		log.Fatal(err)
+func TestValidateIgnitionNetworks(t *testing.T) {
+	tests := []struct {
+		name        string
+		machineSpec vsphereconfigv1.VsphereMachineSpec
+		valid       bool
+	}{
+		{
+			name: "dhcp",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{
+				BootstrapFormat: vsphereconfigv1.IgnitionBootstrapFormat,
+				Networks:        []vsphereconfigv1.NetworkSpec{{NetworkName: "VM Network", IPConfig: vsphereconfigv1.IPConfig{NetworkType: vsphereconfigv1.DHCP}}},
+			},
+			valid: true,
+		},
+		{
+			name: "static with cloud-config",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{
+				Networks: []vsphereconfigv1.NetworkSpec{{NetworkName: "VM Network", IPConfig: vsphereconfigv1.IPConfig{NetworkType: vsphereconfigv1.Static}}},
+			},
+			valid: true,
+		},
+		{
+			name: "static",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{
+				BootstrapFormat: vsphereconfigv1.IgnitionBootstrapFormat,
+				Networks:        []vsphereconfigv1.NetworkSpec{{NetworkName: "VM Network", IPConfig: vsphereconfigv1.IPConfig{NetworkType: vsphereconfigv1.Static}}},
+			},
+		},
+		{
+			name: "ip pool",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{
+				BootstrapFormat: vsphereconfigv1.IgnitionBootstrapFormat,
+				Networks:        []vsphereconfigv1.NetworkSpec{{NetworkName: "VM Network", IPPool: "pool1"}},
+			},
+		},
+		{
+			name: "bond",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{
+				BootstrapFormat: vsphereconfigv1.IgnitionBootstrapFormat,
+				Networks:        []vsphereconfigv1.NetworkSpec{{NetworkName: "VM Network", Bond: "bond0"}},
+				Bonds:           []vsphereconfigv1.BondSpec{{Name: "bond0"}},
+			},
+		},
 	}
-
-	if model.Machine+1 != model.Count().Machine {
-		t.Error("failed to clone vm")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateIgnitionNetworks(&test.machineSpec)
+			if test.valid && err != nil {
+				t.Errorf("unexpected error %v", err)
+			} else if !test.valid && (err == nil || !strings.HasPrefix(err.Error(), "[FATAL]")) {
+				t.Errorf("expected a fatal error, got %v", err)
+			}
+		})
 	}
 }
@@ -0,0 +1,181 @@
+package govmomi
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"sigs.k8s.io/cluster-api/pkg/util"
+)
+
+const defaultCustomizationDomain = "localdomain"
+
+// getCustomizationSpec returns the guest customization of the VM. The named
+// spec of the customization spec manager is used when set, otherwise a Linux
+// customization is built from the machine spec.
+func (pv *Provisioner) getCustomizationSpec(ctx context.Context, s *SessionContext, machine *clusterv1.Machine,
+	machineSpec *vsphereconfigv1.VsphereMachineSpec) (*types.CustomizationSpec, error) {
+	name := machineSpec.Customization.SpecName
+	if name == "" {
+		return newLinuxCustomizationSpec(machine.Name, machineSpec)
+	}
+	if s.session.Client.ServiceContent.CustomizationSpecManager == nil {
+		return nil, fmt.Errorf("[FATAL] Customization spec %s cannot be used, %s has no customization spec manager", name, s.session.Client.URL().Host)
+	}
+	item, err := object.NewCustomizationSpecManager(s.session.Client).GetCustomizationSpec(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching the customization spec %s: %s", name, err)
+	}
+	// vSphere requires a NIC setting per NIC of the VM
+	if len(item.Spec.NicSettingMap) != len(machineSpec.Networks) {
+		return nil, fmt.Errorf("[FATAL] Customization spec %s has %d NIC settings for %d networks in the machineSpec", name, len(item.Spec.NicSettingMap), len(machineSpec.Networks))
+	}
+	return &item.Spec, nil
+}
+
+// newLinuxCustomizationSpec builds the Linux customization of the VM, setting
+// its hostname, the IP settings of its NICs and its DNS settings. Linux guests
+// only support global DNS servers and search domains, thus those of the
+// networks are used when none are set in the customization. Bonds, VLANs,
+// routes and MTUs cannot be customized by vSphere.
+func newLinuxCustomizationSpec(hostname string, machineSpec *vsphereconfigv1.VsphereMachineSpec) (*types.CustomizationSpec, error) {
+	customization := machineSpec.Customization
+	if len(machineSpec.Bonds) > 0 {
+		return nil, fmt.Errorf("[FATAL] Bonds in the machineSpec are not supported by the guest customization")
+	}
+	domain := customization.Domain
+	if domain == "" {
+		domain = defaultCustomizationDomain
+	}
+	spec := &types.CustomizationSpec{
+		Identity: &types.CustomizationLinuxPrep{
+			HostName:   &types.CustomizationFixedName{Name: hostname},
+			Domain:     domain,
+			TimeZone:   customization.TimeZone,
+			HwClockUTC: customization.HwClockUTC,
+		},
+		GlobalIPSettings: types.CustomizationGlobalIPSettings{
+			DnsSuffixList: customization.DNSSuffixList,
+			DnsServerList: customization.DNSServers,
+		},
+	}
+	collectDNS := len(customization.DNSServers) == 0
+	collectSearchDomains := len(customization.DNSSuffixList) == 0
+	for i, network := range machineSpec.Networks {
+		if len(network.VLANs) > 0 || len(network.IPConfig.Routes) > 0 || network.MTU != 0 {
+			return nil, fmt.Errorf("[FATAL] Network %d in the machineSpec: vlans, routes and mtu are not supported by the guest customization", i)
+		}
+		adapter := types.CustomizationIPSettings{}
+		switch network.IPConfig.NetworkType {
+		case vsphereconfigv1.Static:
+			if err := setStaticIPSettings(&adapter, network.IPConfig); err != nil {
+				return nil, fmt.Errorf("[FATAL] Network %d in the machineSpec: %v", i, err)
+			}
+		case "", vsphereconfigv1.DHCP:
+			adapter.Ip = &types.CustomizationDhcpIpGenerator{}
+		default:
+			return nil, fmt.Errorf("[FATAL] Unknown networkType %q for network %d in the machineSpec", network.IPConfig.NetworkType, i)
+		}
+		if collectDNS {
+			for _, server := range network.IPConfig.Dns {
+				if !containsString(spec.GlobalIPSettings.DnsServerList, server) {
+					spec.GlobalIPSettings.DnsServerList = append(spec.GlobalIPSettings.DnsServerList, server)
+				}
+			}
+		}
+		if collectSearchDomains {
+			for _, domain := range network.IPConfig.SearchDomains {
+				if !containsString(spec.GlobalIPSettings.DnsSuffixList, domain) {
+					spec.GlobalIPSettings.DnsSuffixList = append(spec.GlobalIPSettings.DnsSuffixList, domain)
+				}
+			}
+		}
+		spec.NicSettingMap = append(spec.NicSettingMap, types.CustomizationAdapterMapping{Adapter: adapter})
+	}
+	return spec, nil
+}
+
+// setStaticIPSettings sets the static addresses of the IPConfig on the
+// adapter. vSphere customizes a single IPv4 address per NIC, along with any
+// number of IPv6 addresses.
+func setStaticIPSettings(adapter *types.CustomizationIPSettings, ipConfig vsphereconfigv1.IPConfig) error {
+	addresses, err := vsphereutils.GetIPAddresses(ipConfig)
+	if err != nil {
+		return err
+	}
+	gateway4, gateway6 := vsphereutils.GetGateways(ipConfig)
+	for _, address := range addresses {
+		if address.IsIPv6() {
+			if adapter.IpV6Spec == nil {
+				adapter.IpV6Spec = &types.CustomizationIPSettingsIpV6AddressSpec{}
+			}
+			adapter.IpV6Spec.Ip = append(adapter.IpV6Spec.Ip, &types.CustomizationFixedIpV6{
+				IpAddress:  address.IP.String(),
+				SubnetMask: int32(address.Prefix),
+			})
+			continue
+		}
+		if adapter.Ip != nil {
+			return fmt.Errorf("only one IPv4 address can be customized, got %s", address.IP)
+		}
+		if address.Netmask == "" && address.Prefix == 0 {
+			return fmt.Errorf("no netmask for the address %s", address.IP)
+		}
+		adapter.Ip = &types.CustomizationFixedIp{IpAddress: address.IP.String()}
+		adapter.SubnetMask = net.IP(net.CIDRMask(address.Prefix, 32)).String()
+	}
+	if adapter.Ip == nil && adapter.IpV6Spec == nil {
+		return fmt.Errorf("static network config has neither an ip nor ips")
+	}
+	if adapter.Ip == nil {
+		// The IPv4 settings are mandatory, they are left unset for IPv6-only NICs
+		adapter.Ip = &types.CustomizationUnknownIpGenerator{}
+	}
+	if gateway4 != "" {
+		adapter.Gateway = []string{gateway4}
+	}
+	if gateway6 != "" && adapter.IpV6Spec != nil {
+		adapter.IpV6Spec.Gateway = []string{gateway6}
+	}
+	return nil
+}
+
+// getStartupGuestInfo returns the guestinfo properties passing the startup
+// script, and for the control plane the cloud provider config, to VMs which
+// are customized by vSphere instead of cloud-init. All values are base64
+// encoded.
+func (pv *Provisioner) getStartupGuestInfo(cluster *clusterv1.Cluster, machine *clusterv1.Machine,
+	machineConfig *vsphereconfigv1.VsphereMachineProviderConfig, resourcePoolPath string, domain *vsphereconfigv1.FailureDomain) ([]types.BaseOptionValue, error) {
+	script, err := pv.getStartupScript(cluster, machine, domain)
+	if err != nil {
+		return nil, err
+	}
+	guestinfo := []types.BaseOptionValue{
+		&types.OptionValue{Key: "guestinfo.startup-script", Value: script},
+		&types.OptionValue{Key: "guestinfo.startup-script.encoding", Value: "base64"},
+	}
+	if util.IsControlPlaneMachine(machine) {
+		config, err := pv.getCloudProviderConfig(cluster, machineConfig, resourcePoolPath)
+		if err != nil {
+			return nil, err
+		}
+		guestinfo = append(guestinfo,
+			&types.OptionValue{Key: "guestinfo.cloud-provider-config", Value: config},
+			&types.OptionValue{Key: "guestinfo.cloud-provider-config.encoding", Value: "base64"})
+	}
+	return guestinfo, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
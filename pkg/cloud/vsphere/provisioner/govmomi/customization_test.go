@@ -0,0 +1,144 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package govmomi
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"reflect"
+	"testing"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/client-go/tools/record"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+)
+
+func TestNewLinuxCustomizationSpec(t *testing.T) {
+	machineSpec := &vsphereconfigv1.VsphereMachineSpec{
+		Networks: []vsphereconfigv1.NetworkSpec{
+			{
+				NetworkName: "VM Network",
+				IPConfig: vsphereconfigv1.IPConfig{
+					NetworkType: vsphereconfigv1.Static,
+					IP:          "10.0.0.10",
+					Netmask:     "255.255.255.0",
+					Gateway:     "10.0.0.1",
+					Dns:         []string{"10.0.0.2", "10.0.0.3"},
+				},
+			},
+			{
+				NetworkName: "DC0_DVPG0",
+				IPConfig: vsphereconfigv1.IPConfig{
+					NetworkType: vsphereconfigv1.DHCP,
+					Dns:         []string{"10.0.0.3", "10.0.1.2"},
+				},
+			},
+		},
+		Customization: &vsphereconfigv1.CustomizationSpec{
+			TimeZone:      "Europe/Berlin",
+			DNSSuffixList: []string{"example.com"},
+		},
+	}
+	spec, err := newLinuxCustomizationSpec("machine1", machineSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := spec.Identity.(*types.CustomizationLinuxPrep)
+	if identity.HostName.(*types.CustomizationFixedName).Name != "machine1" || identity.Domain != defaultCustomizationDomain || identity.TimeZone != "Europe/Berlin" {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+	if dns := spec.GlobalIPSettings.DnsServerList; !reflect.DeepEqual(dns, []string{"10.0.0.2", "10.0.0.3", "10.0.1.2"}) {
+		t.Errorf("unexpected DNS servers %v", dns)
+	}
+	if len(spec.NicSettingMap) != 2 {
+		t.Fatalf("expected 2 NIC settings, got %d", len(spec.NicSettingMap))
+	}
+	static := spec.NicSettingMap[0].Adapter
+	if ip, ok := static.Ip.(*types.CustomizationFixedIp); !ok || ip.IpAddress != "10.0.0.10" || static.SubnetMask != "255.255.255.0" ||
+		!reflect.DeepEqual(static.Gateway, []string{"10.0.0.1"}) {
+		t.Errorf("unexpected static NIC setting %+v", static)
+	}
+	if _, ok := spec.NicSettingMap[1].Adapter.Ip.(*types.CustomizationDhcpIpGenerator); !ok {
+		t.Errorf("expected a DHCP NIC setting, got %+v", spec.NicSettingMap[1].Adapter)
+	}
+
+	// The DNS servers of the customization take precedence
+	machineSpec.Customization.DNSServers = []string{"8.8.8.8"}
+	if spec, err = newLinuxCustomizationSpec("machine1", machineSpec); err != nil {
+		t.Fatal(err)
+	}
+	if dns := spec.GlobalIPSettings.DnsServerList; !reflect.DeepEqual(dns, []string{"8.8.8.8"}) {
+		t.Errorf("unexpected DNS servers %v", dns)
+	}
+
+	// The search domains of the networks are used without DNS suffixes
+	machineSpec.Customization.DNSSuffixList = nil
+	machineSpec.Networks[1].IPConfig.SearchDomains = []string{"example.org"}
+	if spec, err = newLinuxCustomizationSpec("machine1", machineSpec); err != nil {
+		t.Fatal(err)
+	}
+	if suffixes := spec.GlobalIPSettings.DnsSuffixList; !reflect.DeepEqual(suffixes, []string{"example.org"}) {
+		t.Errorf("unexpected DNS suffixes %v", suffixes)
+	}
+
+	machineSpec.Networks[1].IPConfig.Routes = []vsphereconfigv1.RouteSpec{{To: "10.1.0.0/16", Via: "10.0.0.1"}}
+	if _, err = newLinuxCustomizationSpec("machine1", machineSpec); err == nil {
+		t.Error("expected a network with routes to fail")
+	}
+	machineSpec.Networks[1].IPConfig.Routes = nil
+
+	machineSpec.Networks[0].IPConfig.Netmask = ""
+	if _, err = newLinuxCustomizationSpec("machine1", machineSpec); err == nil {
+		t.Error("expected a static network without netmask to fail")
+	}
+}
+
+func TestCreateWithCustomization(t *testing.T) {
+	model := simulator.VPX()
+	model.Host = 0 // ClusterHost only
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	cluster := newSimulatorCluster(s)
+	p := newSimulatorProvisioner()
+	p.eventRecorder = record.NewFakeRecorder(10)
+
+	machineSpec := newSimulatorMachineSpec(vm, nil)
+	machineSpec.VsphereCloudInit = false
+	machineSpec.Customization = &vsphereconfigv1.CustomizationSpec{SpecName: "linux"}
+	if err = p.Create(context.Background(), cluster, newSimulatorMachine(machineSpec)); err == nil {
+		t.Error("expected a named customization spec to fail without customization spec manager")
+	}
+
+	machineSpec.Customization = &vsphereconfigv1.CustomizationSpec{TimeZone: "UTC"}
+	if err = p.Create(context.Background(), cluster, newSimulatorMachine(machineSpec)); err != nil {
+		t.Fatal(err)
+	}
+	if model.Machine+1 != model.Count().Machine {
+		t.Error("failed to clone vm")
+	}
+}
@@ -0,0 +1,94 @@
+package govmomi
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/klog"
+	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/constants"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	apierrors "sigs.k8s.io/cluster-api/pkg/errors"
+)
+
+// applyStorageRecommendationTask is the description ID of the task applying
+// Storage DRS recommendations, which clones the VM when applying a clone
+// placement recommendation.
+const applyStorageRecommendationTask = "StorageResourceManager.applyRecommendation"
+
+// isCloneTask returns true if the task clones the VM, either directly or by
+// applying a Storage DRS placement recommendation.
+func isCloneTask(info types.TaskInfo) bool {
+	return info.DescriptionId == "VirtualMachine.clone" || info.DescriptionId == applyStorageRecommendationTask
+}
+
+// clonedVMReference returns the reference of the VM cloned by the task.
+func clonedVMReference(info types.TaskInfo) types.ManagedObjectReference {
+	if result, ok := info.Result.(types.ApplyStorageRecommendationResult); ok && result.Vm != nil {
+		return *result.Vm
+	}
+	return info.Result.(types.ManagedObjectReference)
+}
+
+// cloneOnDatastoreCluster asks Storage DRS for the placement of the clone on
+// the datastore cluster and applies the top recommendation, which starts the
+// clone of the VM. The task applying the recommendation and the name of the
+// recommended datastore are returned.
+func (pv *Provisioner) cloneOnDatastoreCluster(ctx context.Context, s *SessionContext, machine *clusterv1.Machine, pod *object.StoragePod,
+	src *object.VirtualMachine, folder *object.Folder, spec types.VirtualMachineCloneSpec) (*object.Task, string, error) {
+	var podProps mo.StoragePod
+	if err := pod.Properties(ctx, pod.Reference(), []string{"podStorageDrsEntry"}, &podProps); err != nil {
+		return nil, "", fmt.Errorf("error fetching datastore cluster properties: %s", err)
+	}
+	if podProps.PodStorageDrsEntry == nil || !podProps.PodStorageDrsEntry.StorageDrsConfig.PodConfig.Enabled {
+		return nil, "", pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"Storage DRS is disabled on the datastore cluster %s, enable Storage DRS or set a datastore instead", pod.Name()), constants.CreateEventAction)
+	}
+
+	podRef := pod.Reference()
+	srcRef := src.Reference()
+	folderRef := folder.Reference()
+	placementSpec := types.StoragePlacementSpec{
+		Type:      string(types.StoragePlacementSpecPlacementTypeClone),
+		CloneName: machine.Name,
+		CloneSpec: &spec,
+		Vm:        &srcRef,
+		Folder:    &folderRef,
+		PodSelectionSpec: types.StorageDrsPodSelectionSpec{
+			StoragePod: &podRef,
+			InitialVmConfig: []types.VmPodConfigForPlacement{
+				{StoragePod: podRef},
+			},
+		},
+		ResourcePool: spec.Location.Pool,
+	}
+	srm := object.NewStorageResourceManager(s.session.Client)
+	result, err := srm.RecommendDatastores(ctx, placementSpec)
+	if err != nil {
+		return nil, "", fmt.Errorf("error querying Storage DRS recommendations for the datastore cluster %s: %s", pod.Name(), err)
+	}
+	if len(result.Recommendations) == 0 {
+		return nil, "", fmt.Errorf("[FATAL] Storage DRS did not recommend any datastore of the datastore cluster %s", pod.Name())
+	}
+
+	// The recommendations are sorted by rating, thus the first one is applied
+	recommendation := result.Recommendations[0]
+	datastoreName := ""
+	for _, action := range recommendation.Action {
+		if placement, ok := action.(*types.StoragePlacementAction); ok {
+			datastoreName, err = object.NewDatastore(s.session.Client, placement.Destination).ObjectName(ctx)
+			if err != nil {
+				return nil, "", err
+			}
+			break
+		}
+	}
+	klog.V(4).Infof("[cloneVirtualMachine] Applying Storage DRS recommendation %s to place the VM on datastore %s", recommendation.Key, datastoreName)
+	task, err := srm.ApplyStorageDrsRecommendation(ctx, []string{recommendation.Key})
+	if err != nil {
+		return nil, "", fmt.Errorf("error applying Storage DRS recommendation %s: %s", recommendation.Key, err)
+	}
+	return task, datastoreName, nil
+}
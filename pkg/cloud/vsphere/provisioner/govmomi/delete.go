@@ -3,19 +3,32 @@ package govmomi
 import (
 	"context"
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/vmware/govmomi/object"
 
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
 	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/constants"
 	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
 	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	clustererror "sigs.k8s.io/cluster-api/pkg/controller/error"
+	apierrors "sigs.k8s.io/cluster-api/pkg/errors"
 )
 
-// Delete the machine
+const (
+	powerOffTask = "VirtualMachine.powerOff"
+	destroyTask  = "VirtualMachine.destroy"
+)
+
+// Delete the machine. The power off and the destroy of the VM are tracked via
+// the task reference of the Machine, a RequeueAfterError being returned until
+// the VM is gone.
 func (pv *Provisioner) Delete(ctx context.Context, cluster *clusterv1.Cluster, machine *clusterv1.Machine) error {
 	if cluster == nil {
 		return errors.New(constants.ClusterIsNullErr)
@@ -27,6 +40,18 @@ func (pv *Provisioner) Delete(ctx context.Context, cluster *clusterv1.Cluster, m
 	}
 	deletectx, cancel := context.WithCancel(*s.context)
 	defer cancel()
+	machineConfig, err := vsphereutils.GetMachineProviderSpec(machine.Spec.ProviderSpec)
+	if err != nil {
+		return err
+	}
+	if task := vsphereutils.GetActiveTasks(machine); task != "" {
+		// In case an active task is going on, wait for its completion. A clone
+		// completing meanwhile sets the reference of the VM to delete.
+		if err := pv.verifyAndUpdateTask(s, cluster, machine, task); err != nil {
+			return err
+		}
+		return &clustererror.RequeueAfterError{RequeueAfter: time.Second * 5}
+	}
 
 	if exists, _ := pv.Exists(ctx, cluster, machine); exists {
 		moref, err := vsphereutils.GetMachineRef(machine)
@@ -38,34 +63,107 @@ func (pv *Provisioner) Delete(ctx context.Context, cluster *clusterv1.Cluster, m
 			Type:  "VirtualMachine",
 			Value: moref,
 		}
-		err = s.session.RetrieveOne(deletectx, vmref, []string{"name", "runtime.powerState"}, &vm)
+		err = s.session.RetrieveOne(deletectx, vmref, append([]string{"name", "runtime.powerState", "guest.toolsRunningStatus"}, ownershipProperties...), &vm)
 		if err != nil {
 			return err
 		}
+		// A stale or edited machine ref must not destroy a VM of another
+		// Machine or cluster
+		if err := verifyOwnership(cluster, machine, &vm); err != nil {
+			pv.eventRecorder.Eventf(machine, corev1.EventTypeWarning, "OwnershipMismatch", "Refusing to delete the VM %s: %s", moref, err)
+			return pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+				"refusing to delete the VM %s: %v", moref, err), "")
+		}
+		if err := pv.shutdownVirtualMachine(deletectx, s, machine, &machineConfig.MachineSpec, &vm); err != nil {
+			return err
+		}
 		pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Killing", "Killing machine %v", machine.Name)
+		pv.removeFromAntiAffinityRule(deletectx, s, cluster, machine, vmref)
+		pv.untagVirtualMachine(deletectx, s, cluster, machine, vmref)
 		vmo := object.NewVirtualMachine(s.session.Client, vmref)
-		if vm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn {
-			task, err := vmo.PowerOff(deletectx)
-			if err != nil {
-				klog.Infof("Error trigerring power off operation on the Virtual Machine %s", vm.Name)
-				return err
-			}
-			err = task.Wait(deletectx)
-			if err != nil {
-				klog.Infof("Error powering off the Virtual Machine %s", vm.Name)
+		task, err := vmo.Destroy(deletectx)
+		if err != nil {
+			klog.Errorf("Error triggering the destroy of the Virtual Machine %s: %s", vm.Name, err)
+			return err
+		}
+		if err := pv.updateProviderStatus(machine, func(status *vsphereconfigv1.VsphereMachineProviderStatus) {
+			status.TaskRef = task.Reference().Value
+			status.ShutdownStarted = nil
+		}); err != nil {
+			return err
+		}
+		return &clustererror.RequeueAfterError{RequeueAfter: time.Second * 5}
+	}
+	// The addresses are released once the VM is gone, which is also the case
+	// when the VM was never created
+	return pv.releaseIPAddresses(ctx, machine, machineConfig)
+}
+
+// shutdownVirtualMachine powers off the VM of the machine before it is
+// destroyed. The guest OS is shut down gracefully when VMware Tools is running,
+// and the VM is only powered off once the shutdown timeout of the machine spec
+// expired. The start of the guest shutdown is tracked in the provider status of
+// the Machine, a RequeueAfterError being returned until the guest is down, as
+// well as while the VM is being powered off.
+func (pv *Provisioner) shutdownVirtualMachine(ctx context.Context, s *SessionContext, machine *clusterv1.Machine,
+	machineSpec *vsphereconfigv1.VsphereMachineSpec, vm *mo.VirtualMachine) error {
+	status, err := vsphereutils.GetMachineProviderStatus(machine)
+	if err != nil {
+		return err
+	}
+	var started *metav1.Time
+	if status != nil {
+		started = status.ShutdownStarted
+	}
+	if vm.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOn {
+		if started != nil {
+			pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "ShutDown", "Guest of Machine %s shut down", machine.Name)
+		}
+		return nil
+	}
+	timeout := constants.DefaultGuestShutdownTimeout
+	if machineSpec.GuestShutdownTimeout != nil {
+		timeout = machineSpec.GuestShutdownTimeout.Duration
+	}
+	vmo := object.NewVirtualMachine(s.session.Client, vm.Reference())
+	var reason string
+	switch {
+	case started != nil && time.Since(started.Time) < timeout:
+		klog.V(4).Infof("Waiting for the guest shutdown of Machine %s", machine.Name)
+		return &clustererror.RequeueAfterError{RequeueAfter: time.Second * 5}
+	case started != nil:
+		reason = fmt.Sprintf("the guest did not shut down within %s", timeout)
+	case timeout <= 0:
+		reason = "the guest shutdown is disabled"
+	case vm.Guest == nil || vm.Guest.ToolsRunningStatus != string(types.VirtualMachineToolsRunningStatusGuestToolsRunning):
+		reason = "VMware Tools is not running"
+	default:
+		err := vmo.ShutdownGuest(ctx)
+		if err == nil {
+			pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "ShuttingDown", "Shutting down the guest of Machine %s", machine.Name)
+			if err := pv.updateProviderStatus(machine, func(status *vsphereconfigv1.VsphereMachineProviderStatus) {
+				now := metav1.Now()
+				status.ShutdownStarted = &now
+			}); err != nil {
 				return err
 			}
+			return &clustererror.RequeueAfterError{RequeueAfter: time.Second * 5}
 		}
-		task, err := vmo.Destroy(deletectx)
-		taskinfo, err := task.WaitForResult(deletectx, nil)
-		if taskinfo.State == types.TaskInfoStateSuccess {
-			klog.Infof("Virtual Machine %v deleted successfully", vm.Name)
-			pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Killed", "Machine %v deletion complete", machine.Name)
-			return nil
-		}
-		pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Killed", "Machine %v deletion complete", machine.Name)
-		klog.Errorf("VM Deletion failed on pv with following reason %v", taskinfo.Reason)
-		return errors.New("VM Deletion failed")
+		klog.Warningf("Error shutting down the guest of Machine %s: %s", machine.Name, err)
+		reason = fmt.Sprintf("the guest shutdown failed: %s", err)
+	}
+	pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "PoweringOff", "Powering off Machine %s as %s", machine.Name, reason)
+	task, err := vmo.PowerOff(ctx)
+	if err != nil {
+		klog.Infof("Error trigerring power off operation on the Virtual Machine %s", vm.Name)
+		return err
+	}
+	// The guest is not shut down once powered off
+	if err := pv.updateProviderStatus(machine, func(status *vsphereconfigv1.VsphereMachineProviderStatus) {
+		status.TaskRef = task.Reference().Value
+		status.ShutdownStarted = nil
+	}); err != nil {
+		return err
 	}
-	return nil
+	return &clustererror.RequeueAfterError{RequeueAfter: time.Second * 5}
 }
@@ -0,0 +1,378 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package govmomi
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	clustererror "sigs.k8s.io/cluster-api/pkg/controller/error"
+	apierrors "sigs.k8s.io/cluster-api/pkg/errors"
+)
+
+// newSimulatorOwnedMachine returns a machine of the cluster owning the VM.
+func newSimulatorOwnedMachine(cluster *clusterv1.Cluster, vm *simulator.VirtualMachine) *clusterv1.Machine {
+	machine := newSimulatorMachine(newSimulatorMachineSpec(vm, nil))
+	machine.Namespace = "default"
+	machine.UID = k8stypes.UID(vm.Config.InstanceUuid)
+	vm.Config.Annotation = vmAnnotation(cluster)
+	setSimulatorMachineRef(machine, vm.Reference().Value)
+	return machine
+}
+
+// deleteSimulatorMachine calls Delete until the machine is deleted, with the
+// latest Machine as the controller would, and returns the events recorded.
+func deleteSimulatorMachine(p *Provisioner, cluster *clusterv1.Cluster, machine *clusterv1.Machine, recorder *record.FakeRecorder) ([]string, error) {
+	var events []string
+	for i := 0; i < 10; i++ {
+		err := p.Delete(context.Background(), cluster, machine)
+		for len(recorder.Events) > 0 {
+			events = append(events, <-recorder.Events)
+		}
+		if _, ok := err.(*clustererror.RequeueAfterError); !ok {
+			return events, err
+		}
+		if machine, err = p.clusterV1alpha1.Machines(machine.Namespace).Get(machine.Name, metav1.GetOptions{}); err != nil {
+			return events, err
+		}
+	}
+	return events, fmt.Errorf("machine %s is still being deleted", machine.Name)
+}
+
+func TestDeleteGuestShutdown(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	cluster := newSimulatorCluster(s)
+	vms := simulator.Map.All("VirtualMachine")
+	t.Run("guest shutdown", func(t *testing.T) {
+		vm := vms[0].(*simulator.VirtualMachine)
+		vm.Guest.ToolsRunningStatus = string(types.VirtualMachineToolsRunningStatusGuestToolsRunning)
+		machine := newSimulatorOwnedMachine(cluster, vm)
+		client := newSimulatorMachineClient(machine)
+		recorder := record.NewFakeRecorder(10)
+		p := newSimulatorProvisioner()
+		p.eventRecorder = recorder
+		p.clusterV1alpha1 = client
+
+		err := p.Delete(context.Background(), cluster, machine)
+		if _, ok := err.(*clustererror.RequeueAfterError); !ok {
+			t.Fatalf("expected a requeue while the guest shuts down, got %v", err)
+		}
+		if event := <-recorder.Events; event != "Normal ShuttingDown Shutting down the guest of Machine machine1" {
+			t.Errorf("unexpected event %q", event)
+		}
+		if machine, err = client.Machines(machine.Namespace).Get(machine.Name, metav1.GetOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if status, err := vsphereutils.GetMachineProviderStatus(machine); err != nil || status == nil || status.ShutdownStarted == nil {
+			t.Fatalf("expected the guest shutdown in the provider status, got %+v", status)
+		}
+
+		events, err := deleteSimulatorMachine(p, cluster, machine, recorder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{
+			"Normal ShutDown Guest of Machine machine1 shut down",
+			"Normal Killing Killing machine machine1",
+			"Normal Killed Machine machine1 deletion complete",
+		}
+		if !reflect.DeepEqual(events, expected) {
+			t.Errorf("expected the events %q, got %q", expected, events)
+		}
+		if simulator.Map.Get(vm.Reference()) != nil {
+			t.Error("expected the VM to be destroyed")
+		}
+	})
+
+	t.Run("tools not running", func(t *testing.T) {
+		vm := vms[1].(*simulator.VirtualMachine)
+		machine := newSimulatorOwnedMachine(cluster, vm)
+		recorder := record.NewFakeRecorder(10)
+		p := newSimulatorProvisioner()
+		p.eventRecorder = recorder
+		p.clusterV1alpha1 = newSimulatorMachineClient(machine)
+
+		events, err := deleteSimulatorMachine(p, cluster, machine, recorder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{
+			"Normal PoweringOff Powering off Machine machine1 as VMware Tools is not running",
+			"Normal PoweredOff Powered off Machine machine1",
+			"Normal Killing Killing machine machine1",
+			"Normal Killed Machine machine1 deletion complete",
+		}
+		if !reflect.DeepEqual(events, expected) {
+			t.Errorf("expected the events %q, got %q", expected, events)
+		}
+		if simulator.Map.Get(vm.Reference()) != nil {
+			t.Error("expected the VM to be destroyed")
+		}
+	})
+
+	t.Run("shutdown timeout", func(t *testing.T) {
+		vm := vms[2].(*simulator.VirtualMachine)
+		vm.Guest.ToolsRunningStatus = string(types.VirtualMachineToolsRunningStatusGuestToolsRunning)
+		machine := newSimulatorOwnedMachine(cluster, vm)
+		started := metav1.NewTime(time.Now().Add(-time.Minute))
+		raw, err := json.Marshal(&vsphereconfigv1.VsphereMachineProviderStatus{ShutdownStarted: &started})
+		if err != nil {
+			t.Fatal(err)
+		}
+		machine.Status.ProviderStatus = &runtime.RawExtension{Raw: raw}
+		machineConfig, err := vsphereutils.GetMachineProviderSpec(machine.Spec.ProviderSpec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		machineConfig.MachineSpec.GuestShutdownTimeout = &metav1.Duration{Duration: 30 * time.Second}
+		if machine.Spec.ProviderSpec.Value.Raw, err = json.Marshal(machineConfig); err != nil {
+			t.Fatal(err)
+		}
+		recorder := record.NewFakeRecorder(10)
+		p := newSimulatorProvisioner()
+		p.eventRecorder = recorder
+		p.clusterV1alpha1 = newSimulatorMachineClient(machine)
+
+		events, err := deleteSimulatorMachine(p, cluster, machine, recorder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) == 0 || events[0] != "Normal PoweringOff Powering off Machine machine1 as the guest did not shut down within 30s" {
+			t.Errorf("unexpected events %q", events)
+		}
+		if simulator.Map.Get(vm.Reference()) != nil {
+			t.Error("expected the VM to be destroyed")
+		}
+	})
+}
+
+func TestDeleteTaskErrors(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	c, err := govmomi.NewClient(context.Background(), s.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster := newSimulatorCluster(s)
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	vmo := object.NewVirtualMachine(c.Client, vm.Reference())
+
+	tests := []struct {
+		name  string
+		start func() (*object.Task, error)
+		event string
+	}{
+		{
+			name: "power off",
+			// The VM is powered off already
+			start: func() (*object.Task, error) {
+				if _, err := vmo.PowerOff(context.Background()); err != nil {
+					return nil, err
+				}
+				return vmo.PowerOff(context.Background())
+			},
+			event: "Warning FailedPowerOff Power off failed for Machine machine1: ",
+		},
+		{
+			name: "destroy",
+			// The VM is powered on
+			start: func() (*object.Task, error) {
+				if _, err := vmo.PowerOn(context.Background()); err != nil {
+					return nil, err
+				}
+				return vmo.Destroy(context.Background())
+			},
+			event: "Warning FailedDelete Deletion failed for Machine machine1: ",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			task, err := test.start()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := task.Wait(context.Background()); err == nil {
+				t.Fatal("expected the task to fail")
+			}
+			machine := newSimulatorOwnedMachine(cluster, vm)
+			raw, err := json.Marshal(&vsphereconfigv1.VsphereMachineProviderStatus{TaskRef: task.Reference().Value})
+			if err != nil {
+				t.Fatal(err)
+			}
+			machine.Status.ProviderStatus = &runtime.RawExtension{Raw: raw}
+			client := newSimulatorMachineClient(machine)
+			recorder := record.NewFakeRecorder(10)
+			p := newSimulatorProvisioner()
+			p.eventRecorder = recorder
+			p.clusterV1alpha1 = client
+
+			err = p.Delete(context.Background(), cluster, machine)
+			if _, ok := err.(*clustererror.RequeueAfterError); !ok {
+				t.Fatalf("expected a requeue to retry the deletion, got %v", err)
+			}
+			if event := <-recorder.Events; !strings.HasPrefix(event, test.event) {
+				t.Errorf("unexpected event %q", event)
+			}
+			if machine, err = client.Machines(machine.Namespace).Get(machine.Name, metav1.GetOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if vsphereutils.GetActiveTasks(machine) != "" {
+				t.Error("expected the failed task to be cleared")
+			}
+			if simulator.Map.Get(vm.Reference()) == nil {
+				t.Error("expected the VM to be kept")
+			}
+		})
+	}
+}
+
+func TestDeleteOwnership(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	c, err := govmomi.NewClient(context.Background(), s.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	session := &SessionContext{session: c, context: &ctx}
+
+	cluster := newSimulatorCluster(s)
+	cluster.Namespace, cluster.Name = "default", "cluster1"
+	vms := simulator.Map.All("VirtualMachine")
+
+	t.Run("instance uuid mismatch", func(t *testing.T) {
+		vm := vms[0].(*simulator.VirtualMachine)
+		machine := newSimulatorOwnedMachine(cluster, vm)
+		machine.UID = "4c4c4544-0000-0000-0000-000000000000"
+		client := newSimulatorMachineClient(machine)
+		recorder := record.NewFakeRecorder(10)
+		p := newSimulatorProvisioner()
+		p.eventRecorder = recorder
+		p.clusterV1alpha1 = client
+
+		err := p.Delete(context.Background(), cluster, machine)
+		if _, ok := err.(*apierrors.MachineError); !ok {
+			t.Fatalf("expected a machine error, got %v", err)
+		}
+		expected := fmt.Sprintf("Warning OwnershipMismatch Refusing to delete the VM %s: the instance UUID %s of the VM %s is not the UID %s of the Machine",
+			vm.Reference().Value, vm.Config.InstanceUuid, vm.Name, machine.UID)
+		if event := <-recorder.Events; event != expected {
+			t.Errorf("unexpected event %q", event)
+		}
+		if machine, err = client.Machines(machine.Namespace).Get(machine.Name, metav1.GetOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if machine.Status.ErrorReason == nil {
+			t.Error("expected the Machine error to be set")
+		}
+		if simulator.Map.Get(vm.Reference()) == nil || vm.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOn {
+			t.Error("expected the VM to be left untouched")
+		}
+	})
+
+	t.Run("cluster mismatch", func(t *testing.T) {
+		vm := vms[1].(*simulator.VirtualMachine)
+		machine := newSimulatorOwnedMachine(cluster, vm)
+		other := cluster.DeepCopy()
+		other.Name = "cluster2"
+		if err := setCustomAttributes(ctx, session, vm.Reference(), machineCustomAttributes(other, machine)); err != nil {
+			t.Fatal(err)
+		}
+		recorder := record.NewFakeRecorder(10)
+		p := newSimulatorProvisioner()
+		p.eventRecorder = recorder
+
+		err := p.Delete(context.Background(), cluster, machine)
+		if _, ok := err.(*apierrors.MachineError); !ok {
+			t.Fatalf("expected a machine error, got %v", err)
+		}
+		expected := fmt.Sprintf("Warning OwnershipMismatch Refusing to delete the VM %s: the VM %s belongs to the cluster default/cluster2", vm.Reference().Value, vm.Name)
+		if event := <-recorder.Events; event != expected {
+			t.Errorf("unexpected event %q", event)
+		}
+		if simulator.Map.Get(vm.Reference()) == nil {
+			t.Error("expected the VM not to be destroyed")
+		}
+	})
+
+	t.Run("owned by the machine", func(t *testing.T) {
+		vm := vms[2].(*simulator.VirtualMachine)
+		machine := newSimulatorOwnedMachine(cluster, vm)
+		// The custom attributes take precedence over the annotation
+		vm.Config.Annotation = ""
+		if err := setCustomAttributes(ctx, session, vm.Reference(), machineCustomAttributes(cluster, machine)); err != nil {
+			t.Fatal(err)
+		}
+		recorder := record.NewFakeRecorder(10)
+		p := newSimulatorProvisioner()
+		p.eventRecorder = recorder
+		p.clusterV1alpha1 = newSimulatorMachineClient(machine)
+
+		if _, err := deleteSimulatorMachine(p, cluster, machine, recorder); err != nil {
+			t.Fatal(err)
+		}
+		if simulator.Map.Get(vm.Reference()) != nil {
+			t.Error("expected the VM to be destroyed")
+		}
+	})
+}
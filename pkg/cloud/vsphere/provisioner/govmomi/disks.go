@@ -0,0 +1,161 @@
+package govmomi
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/klog"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+)
+
+// diskPlacement is the placement of the VM used for its disks by default. The
+// datastore is nil when the VM is placed on a datastore cluster by Storage DRS.
+type diskPlacement struct {
+	datastore         *object.Datastore
+	storagePolicyName string
+	profile           []types.BaseVirtualMachineProfileSpec
+	placer            *storagePolicyPlacer
+}
+
+// getNewDiskSpecs returns the device changes for the disks listed under the
+// MachineSpec.Disks property which do not reference a disk on the template
+// via the DiskLabel. Such disks are created on the cloned VM. The placement of
+// the VM is used for the disks that specify neither a datastore nor a storage
+// policy.
+func (pv *Provisioner) getNewDiskSpecs(ctx context.Context, s *SessionContext, devices object.VirtualDeviceList,
+	placement diskPlacement, diskSpecs []vsphereconfigv1.DiskSpec) ([]types.BaseVirtualDeviceConfigSpec, error) {
+	deviceSpecs := []types.BaseVirtualDeviceConfigSpec{}
+	diskid := int32(-200)
+	for i, diskSpec := range diskSpecs {
+		if diskSpec.DiskLabel != "" {
+			continue
+		}
+		if diskSpec.DiskSizeGB <= 0 {
+			return nil, fmt.Errorf("[FATAL] Disk %d in the machineSpec has no diskLabel and no diskSizeGB. Please correct the machineSpec to proceed", i)
+		}
+		controller, err := findSCSIController(devices, diskSpec.ControllerNumber)
+		if err != nil {
+			return nil, err
+		}
+		ds, profile, fileName := placement.datastore, placement.profile, ""
+		if diskSpec.Datastore != "" || diskSpec.StoragePolicyName != "" {
+			policyName := diskSpec.StoragePolicyName
+			if policyName == "" {
+				policyName = placement.storagePolicyName
+			}
+			if policyName != "" {
+				profile, ds, err = placement.placer.place(ctx, policyName, diskSpec.Datastore)
+			} else {
+				ds, err = s.finder.Datastore(ctx, diskSpec.Datastore)
+			}
+			if err != nil {
+				return nil, err
+			}
+			// Only the datastore is set in the file name, the disk file is
+			// named by vSphere next to the VM files on that datastore
+			fileName = ds.Path("")
+		}
+		var disk *types.VirtualDisk
+		if ds != nil {
+			disk = devices.CreateDisk(controller, ds.Reference(), "")
+			// Set after CreateDisk, which would append .vmdk to the bare
+			// datastore, naming all the disks alike
+			disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo).FileName = fileName
+		} else {
+			// The VM is placed by Storage DRS, which places the disk as well
+			disk = devices.CreateDisk(controller, types.ManagedObjectReference{}, "")
+			disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo).Datastore = nil
+		}
+		disk.Key = diskid
+		disk.CapacityInKB = diskSpec.DiskSizeGB * 1024 * 1024
+		disk.CapacityInBytes = vsphereutils.GiBToByte(diskSpec.DiskSizeGB)
+		if diskSpec.UnitNumber != nil {
+			if err := validateUnitNumber(devices, controller, *diskSpec.UnitNumber); err != nil {
+				return nil, err
+			}
+			unitNumber := *diskSpec.UnitNumber
+			disk.UnitNumber = &unitNumber
+		}
+		backing := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+		switch diskSpec.ProvisioningType {
+		case "", vsphereconfigv1.ThinProvisioned:
+			backing.ThinProvisioned = types.NewBool(true)
+		case vsphereconfigv1.ThickProvisioned:
+			backing.ThinProvisioned = types.NewBool(false)
+			backing.EagerlyScrub = types.NewBool(false)
+		case vsphereconfigv1.EagerZeroedThickProvisioned:
+			backing.ThinProvisioned = types.NewBool(false)
+			backing.EagerlyScrub = types.NewBool(true)
+		default:
+			return nil, fmt.Errorf("[FATAL] Unknown provisioningType %q for disk %d in the machineSpec", diskSpec.ProvisioningType, i)
+		}
+		if diskSpec.DiskMode != "" {
+			if !isValidDiskMode(diskSpec.DiskMode) {
+				return nil, fmt.Errorf("[FATAL] Unknown diskMode %q for disk %d in the machineSpec", diskSpec.DiskMode, i)
+			}
+			backing.DiskMode = diskSpec.DiskMode
+		}
+		klog.V(4).Infof("[cloneVirtualMachine] Adding a new disk of size \"%d\" on controller %d unit %d", diskSpec.DiskSizeGB, disk.ControllerKey, *disk.UnitNumber)
+		// Track the new disk so that the unit numbers of the following disks
+		// are picked accordingly
+		devices = append(devices, disk)
+		deviceSpecs = append(deviceSpecs, &types.VirtualDeviceConfigSpec{
+			Operation:     types.VirtualDeviceConfigSpecOperationAdd,
+			FileOperation: types.VirtualDeviceConfigSpecFileOperationCreate,
+			Device:        disk,
+			Profile:       profile,
+		})
+		diskid--
+	}
+	return deviceSpecs, nil
+}
+
+// findSCSIController returns the SCSI controller with the given bus number,
+// or the first SCSI controller present if no bus number is given.
+func findSCSIController(devices object.VirtualDeviceList, busNumber *int32) (types.BaseVirtualController, error) {
+	if busNumber == nil {
+		controller, err := devices.FindSCSIController("")
+		if err != nil {
+			return nil, fmt.Errorf("[FATAL] No SCSI controller found on the template to attach the new disks to: %s", err)
+		}
+		return controller, nil
+	}
+	for _, dev := range devices.SelectByType((*types.VirtualSCSIController)(nil)) {
+		controller := dev.(types.BaseVirtualSCSIController).GetVirtualSCSIController()
+		if controller.BusNumber == *busNumber {
+			return dev.(types.BaseVirtualController), nil
+		}
+	}
+	return nil, fmt.Errorf("[FATAL] No SCSI controller with bus number %d found on the template", *busNumber)
+}
+
+// validateUnitNumber checks that the unit number is free on the controller.
+func validateUnitNumber(devices object.VirtualDeviceList, controller types.BaseVirtualController, unitNumber int32) error {
+	scsi := controller.(types.BaseVirtualSCSIController).GetVirtualSCSIController()
+	if unitNumber < 0 || unitNumber > 15 || unitNumber == scsi.ScsiCtlrUnitNumber {
+		return fmt.Errorf("[FATAL] Unit number %d is not usable on SCSI controller %d", unitNumber, scsi.BusNumber)
+	}
+	for _, dev := range devices {
+		d := dev.GetVirtualDevice()
+		if d.ControllerKey == scsi.Key && d.UnitNumber != nil && *d.UnitNumber == unitNumber {
+			return fmt.Errorf("[FATAL] Unit number %d is already in use on SCSI controller %d", unitNumber, scsi.BusNumber)
+		}
+	}
+	return nil
+}
+
+func isValidDiskMode(mode string) bool {
+	switch types.VirtualDiskMode(mode) {
+	case types.VirtualDiskModePersistent,
+		types.VirtualDiskModeNonpersistent,
+		types.VirtualDiskModeUndoable,
+		types.VirtualDiskModeIndependent_persistent,
+		types.VirtualDiskModeIndependent_nonpersistent,
+		types.VirtualDiskModeAppend:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package govmomi
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/vmware/govmomi/vim25/types"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+)
+
+// reservedExtraConfigKeys are the extraConfig keys set by the provider to
+// bootstrap the VM, whichever the bootstrap of the Machine.
+var reservedExtraConfigKeys = []string{
+	"guestinfo.metadata",
+	"guestinfo.metadata.encoding",
+	"guestinfo.userdata",
+	"guestinfo.userdata.encoding",
+	"guestinfo.ignition.config.data",
+	"guestinfo.ignition.config.data.encoding",
+	"guestinfo.startup-script",
+	"guestinfo.startup-script.encoding",
+	"guestinfo.cloud-provider-config",
+	"guestinfo.cloud-provider-config.encoding",
+}
+
+// reservedVAppPropertyIDs are the vApp properties set by the provider for the
+// templates using the OVF datasource of cloud-init.
+var reservedVAppPropertyIDs = []string{"user-data", "public-keys", "hostname"}
+
+// validateExtraConfig returns an error when the extraConfig or vAppProperties
+// of the machine spec set a key reserved by the provider.
+func validateExtraConfig(machineSpec *vsphereconfigv1.VsphereMachineSpec) error {
+	for key := range machineSpec.ExtraConfig {
+		if key == "" {
+			return fmt.Errorf("extraConfig has an empty key")
+		}
+		if containsString(reservedExtraConfigKeys, key) {
+			return fmt.Errorf("extraConfig key %s is reserved by the provider", key)
+		}
+	}
+	for id := range machineSpec.VAppProperties {
+		if id == "" {
+			return fmt.Errorf("vAppProperties has an empty id")
+		}
+		if containsString(reservedVAppPropertyIDs, id) {
+			return fmt.Errorf("vApp property %s is reserved by the provider", id)
+		}
+	}
+	return nil
+}
+
+// mergeExtraConfig appends the extraConfig of the machine spec to the options
+// set by the provider, sorted by key so that the clone spec is stable.
+func mergeExtraConfig(options []types.BaseOptionValue, extraConfig map[string]string) []types.BaseOptionValue {
+	keys := make([]string, 0, len(extraConfig))
+	for key := range extraConfig {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		options = append(options, &types.OptionValue{Key: key, Value: extraConfig[key]})
+	}
+	return options
+}
+
+// getVAppPropertySpecs returns the edits of the vApp properties of the template
+// set in vAppProperties. vApp properties cannot be added to a VM, thus every
+// property must be defined by the template.
+func getVAppPropertySpecs(vAppConfig types.BaseVmConfigInfo, vAppProperties map[string]string) ([]types.VAppPropertySpec, error) {
+	if len(vAppProperties) == 0 {
+		return nil, nil
+	}
+	if vAppConfig == nil {
+		return nil, fmt.Errorf("the template lacks a vApp configuration and cannot have vApp properties set on it")
+	}
+	var props []types.VAppPropertySpec
+	found := make(map[string]bool)
+	for _, p := range vAppConfig.GetVmConfigInfo().Property {
+		if value, ok := vAppProperties[p.Id]; ok {
+			props = append(props, newVAppPropertySpec(p, value))
+			found[p.Id] = true
+		}
+	}
+	for id := range vAppProperties {
+		if !found[id] {
+			return nil, fmt.Errorf("vApp property %s is not defined by the template", id)
+		}
+	}
+	return props, nil
+}
+
+func newVAppPropertySpec(p types.VAppPropertyInfo, value string) types.VAppPropertySpec {
+	return types.VAppPropertySpec{
+		ArrayUpdateSpec: types.ArrayUpdateSpec{
+			Operation: types.ArrayUpdateOperationEdit,
+		},
+		Info: &types.VAppPropertyInfo{
+			Key:   p.Key,
+			Id:    p.Id,
+			Value: value,
+		},
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package govmomi
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"reflect"
+	"testing"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/client-go/tools/record"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+)
+
+func TestValidateExtraConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		machineSpec vsphereconfigv1.VsphereMachineSpec
+		valid       bool
+	}{
+		{
+			name: "valid",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{
+				ExtraConfig:    map[string]string{"disk.EnableUUID": "TRUE", "guestinfo.agent.token": "secret"},
+				VAppProperties: map[string]string{"vendor.license": "key"},
+			},
+			valid: true,
+		},
+		{
+			name:        "reserved extraConfig key",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{ExtraConfig: map[string]string{"guestinfo.userdata": ""}},
+		},
+		{
+			name:        "empty extraConfig key",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{ExtraConfig: map[string]string{"": "value"}},
+		},
+		{
+			name:        "reserved vApp property",
+			machineSpec: vsphereconfigv1.VsphereMachineSpec{VAppProperties: map[string]string{"hostname": "node"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateExtraConfig(&test.machineSpec)
+			if test.valid && err != nil {
+				t.Errorf("unexpected error %v", err)
+			} else if !test.valid && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestMergeExtraConfig(t *testing.T) {
+	options := []types.BaseOptionValue{&types.OptionValue{Key: "guestinfo.userdata", Value: "data"}}
+	options = mergeExtraConfig(options, map[string]string{"guestinfo.agent.token": "secret", "disk.EnableUUID": "TRUE"})
+	expected := []types.BaseOptionValue{
+		&types.OptionValue{Key: "guestinfo.userdata", Value: "data"},
+		&types.OptionValue{Key: "disk.EnableUUID", Value: "TRUE"},
+		&types.OptionValue{Key: "guestinfo.agent.token", Value: "secret"},
+	}
+	if !reflect.DeepEqual(options, expected) {
+		t.Errorf("unexpected extraConfig %+v", options)
+	}
+}
+
+func TestGetVAppPropertySpecs(t *testing.T) {
+	vAppConfig := &types.VmConfigInfo{
+		Property: []types.VAppPropertyInfo{
+			{Key: 0, Id: "hostname"},
+			{Key: 1, Id: "vendor.license", DefaultValue: "trial"},
+		},
+	}
+	props, err := getVAppPropertySpecs(vAppConfig, map[string]string{"vendor.license": "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(props) != 1 || props[0].Info.Key != 1 || props[0].Info.Value != "key" || props[0].Operation != types.ArrayUpdateOperationEdit {
+		t.Errorf("unexpected vApp properties %+v", props)
+	}
+	if _, err = getVAppPropertySpecs(vAppConfig, map[string]string{"vendor.unknown": "value"}); err == nil {
+		t.Error("expected an unknown vApp property to fail")
+	}
+	if _, err = getVAppPropertySpecs(nil, map[string]string{"vendor.license": "key"}); err == nil {
+		t.Error("expected a template without vApp configuration to fail")
+	}
+}
+
+func TestCreateWithExtraConfig(t *testing.T) {
+	model := simulator.VPX()
+	model.Host = 0 // ClusterHost only
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	cluster := newSimulatorCluster(s)
+	p := newSimulatorProvisioner()
+	p.eventRecorder = record.NewFakeRecorder(10)
+
+	machineSpec := newSimulatorMachineSpec(vm, nil)
+	machineSpec.ExtraConfig = map[string]string{"guestinfo.metadata": "{}"}
+	if err = p.Create(context.Background(), cluster, newSimulatorMachine(machineSpec)); err == nil {
+		t.Error("expected a reserved extraConfig key to fail")
+	}
+
+	machineSpec.ExtraConfig = map[string]string{"disk.EnableUUID": "TRUE"}
+	if err = p.Create(context.Background(), cluster, newSimulatorMachine(machineSpec)); err != nil {
+		t.Fatal(err)
+	}
+	if model.Machine+1 != model.Count().Machine {
+		t.Error("failed to clone vm")
+	}
+}
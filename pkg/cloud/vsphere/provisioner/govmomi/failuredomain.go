@@ -0,0 +1,314 @@
+package govmomi
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/constants"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	apierrors "sigs.k8s.io/cluster-api/pkg/errors"
+)
+
+// failureDomainPlacement is the placement of a VM in its failure domain
+type failureDomainPlacement struct {
+	domain *vsphereconfigv1.FailureDomain
+	pool   *object.ResourcePool
+	// host is the initial host of the VM, only set when the failure domain is
+	// a host group. DRS then keeps the VM on the hosts of the group.
+	host       *object.HostSystem
+	datastores []types.ManagedObjectReference
+}
+
+// getFailureDomain returns the failure domain of the machine. Machines which
+// do not pick a failure domain are spread across the failure domains of the
+// cluster. Nil is returned when the cluster has no failure domains.
+func (pv *Provisioner) getFailureDomain(cluster *clusterv1.Cluster, machine *clusterv1.Machine, machineConfig *vsphereconfigv1.VsphereMachineProviderConfig) (*vsphereconfigv1.FailureDomain, error) {
+	clusterConfig, err := vsphereutils.GetClusterProviderSpec(cluster.Spec.ProviderSpec)
+	if err != nil {
+		return nil, err
+	}
+	name := machineConfig.MachineSpec.FailureDomain
+	if name == "" {
+		if status, err := vsphereutils.GetMachineProviderStatus(machine); err == nil && status != nil {
+			// Keep the failure domain picked earlier for the machine
+			name = status.FailureDomain
+		}
+	}
+	if name == "" {
+		if len(clusterConfig.FailureDomains) == 0 {
+			return nil, nil
+		}
+		var machines []*clusterv1.Machine
+		if pv.lister != nil {
+			machines, err = vsphereutils.GetMachinesForCluster(cluster, pv.lister)
+			if err != nil {
+				return nil, err
+			}
+		}
+		domain := spreadFailureDomain(clusterConfig.FailureDomains, machine, machines)
+		klog.V(4).Infof("Picked failure domain %s for Machine %s", domain.Name, machine.Name)
+		return domain, nil
+	}
+	for i := range clusterConfig.FailureDomains {
+		if clusterConfig.FailureDomains[i].Name == name {
+			return &clusterConfig.FailureDomains[i], nil
+		}
+	}
+	return nil, pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+		"failure domain %q is not defined by the cluster", name), constants.CreateEventAction)
+}
+
+// spreadFailureDomain returns the failure domain with the least machines of
+// the same role as the passed machine. Ties are broken by the order of the
+// failure domains.
+func spreadFailureDomain(domains []vsphereconfigv1.FailureDomain, machine *clusterv1.Machine, machines []*clusterv1.Machine) *vsphereconfigv1.FailureDomain {
+	counts := make(map[string]int)
+	for _, m := range machines {
+		if m.Name == machine.Name || machineRole(m) != machineRole(machine) {
+			continue
+		}
+		counts[machineFailureDomain(m)]++
+	}
+	best := &domains[0]
+	for i := range domains {
+		if counts[domains[i].Name] < counts[best.Name] {
+			best = &domains[i]
+		}
+	}
+	return best
+}
+
+// machineFailureDomain returns the failure domain the machine picked or was
+// placed in.
+func machineFailureDomain(machine *clusterv1.Machine) string {
+	if machineConfig, err := vsphereutils.GetMachineProviderSpec(machine.Spec.ProviderSpec); err == nil && machineConfig.MachineSpec.FailureDomain != "" {
+		return machineConfig.MachineSpec.FailureDomain
+	}
+	if status, err := vsphereutils.GetMachineProviderStatus(machine); err == nil && status != nil {
+		return status.FailureDomain
+	}
+	return ""
+}
+
+// applyFailureDomain sets the datastore and the networks of the failure domain
+// on the machine config where the machine does not set them.
+func applyFailureDomain(machineConfig *vsphereconfigv1.VsphereMachineProviderConfig, domain *vsphereconfigv1.FailureDomain) {
+	machineSpec := &machineConfig.MachineSpec
+	if machineSpec.Datastore == "" && machineSpec.DatastoreCluster == "" {
+		machineSpec.Datastore = domain.Datastore
+	}
+	for i := range machineSpec.Networks {
+		if machineSpec.Networks[i].NetworkName == "" {
+			machineSpec.Networks[i].NetworkName = domain.Network
+		}
+	}
+}
+
+// getFailureDomainPlacement resolves the compute cluster of the failure
+// domain. When the failure domain is a host group, the VM is initially placed
+// on the available host of the group running the least VMs, so that the VMs
+// are spread across the hosts of the group.
+func (pv *Provisioner) getFailureDomainPlacement(ctx context.Context, s *SessionContext, machine *clusterv1.Machine, domain *vsphereconfigv1.FailureDomain) (*failureDomainPlacement, error) {
+	if domain.ComputeCluster == "" {
+		return nil, pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"failure domain %q does not set a computeCluster", domain.Name), constants.CreateEventAction)
+	}
+	ccr, err := s.finder.ClusterComputeResource(ctx, domain.ComputeCluster)
+	if err != nil {
+		return nil, err
+	}
+	var ccrProps mo.ClusterComputeResource
+	if err := ccr.Properties(ctx, ccr.Reference(), []string{"resourcePool", "datastore"}, &ccrProps); err != nil {
+		return nil, fmt.Errorf("error fetching compute cluster properties: %s", err)
+	}
+	placement := &failureDomainPlacement{
+		domain:     domain,
+		pool:       object.NewResourcePool(s.session.Client, *ccrProps.ResourcePool),
+		datastores: ccrProps.Datastore,
+	}
+	placement.pool.InventoryPath = ccr.InventoryPath + "/Resources"
+	if domain.HostGroup == "" {
+		return placement, nil
+	}
+
+	clusterConfig, err := ccr.Configuration(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []types.ManagedObjectReference
+	found := false
+	for _, group := range clusterConfig.Group {
+		if hostGroup, ok := group.(*types.ClusterHostGroup); ok && hostGroup.Name == domain.HostGroup {
+			hosts = hostGroup.Host
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"host group %q of failure domain %q not found in the compute cluster %s", domain.HostGroup, domain.Name, domain.ComputeCluster), constants.CreateEventAction)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("[FATAL] Host group %s of failure domain %s has no hosts", domain.HostGroup, domain.Name)
+	}
+	var hostProps []mo.HostSystem
+	pc := property.DefaultCollector(s.session.Client)
+	if err := pc.Retrieve(ctx, hosts, []string{"name", "runtime", "vm"}, &hostProps); err != nil {
+		return nil, fmt.Errorf("error fetching host properties: %s", err)
+	}
+	var best *mo.HostSystem
+	for i, h := range hostProps {
+		if h.Runtime.ConnectionState != types.HostSystemConnectionStateConnected || h.Runtime.InMaintenanceMode {
+			continue
+		}
+		if best == nil || len(h.Vm) < len(best.Vm) {
+			best = &hostProps[i]
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("[FATAL] None of the hosts of the host group %s of failure domain %s is available", domain.HostGroup, domain.Name)
+	}
+	klog.V(4).Infof("Placing Machine %s on host %s of the host group %s", machine.Name, best.Name, domain.HostGroup)
+	placement.host = object.NewHostSystem(s.session.Client, best.Reference())
+	return placement, nil
+}
+
+// failureDomainGroupName returns the name of the DRS VM group of the VMs of the
+// cluster in the failure domain, which is also the name of the VM/Host rule
+// binding the VM group to the host group of the failure domain.
+func failureDomainGroupName(cluster *clusterv1.Cluster, domain *vsphereconfigv1.FailureDomain) string {
+	return fmt.Sprintf("cluster-api-%s-%s-%s-vms", cluster.Namespace, cluster.Name, domain.Name)
+}
+
+// addToFailureDomainGroup adds the VM of the machine to the DRS VM group of its
+// failure domain when the failure domain is a host group. Failures are only
+// reported as the VM was initially placed on a host of the group anyway.
+func (pv *Provisioner) addToFailureDomainGroup(ctx context.Context, s *SessionContext, cluster *clusterv1.Cluster, machine *clusterv1.Machine, vmref types.ManagedObjectReference) {
+	machineConfig, err := vsphereutils.GetMachineProviderSpec(machine.Spec.ProviderSpec)
+	if err != nil {
+		return
+	}
+	domain, err := pv.getFailureDomain(cluster, machine, machineConfig)
+	if err != nil || domain == nil || domain.HostGroup == "" {
+		return
+	}
+	if err := updateFailureDomainGroup(ctx, s, cluster, domain, vmref); err != nil {
+		klog.Warningf("Error adding Machine %s to the VM group of failure domain %s: %s", machine.Name, domain.Name, err)
+		if pv.eventRecorder != nil {
+			pv.eventRecorder.Eventf(machine, corev1.EventTypeWarning, "FailureDomainGroupFailed", "Error adding the VM to the VM group of failure domain %s: %s", domain.Name, err)
+		}
+	}
+}
+
+// updateFailureDomainGroup adds the VM to the DRS VM group of the failure
+// domain, and binds the VM group to the host group of the failure domain with
+// a "should run on" VM/Host rule, so that DRS keeps the VM on the hosts of the
+// group while vSphere HA may still restart it elsewhere. The VM group and the
+// rule are created when missing.
+func updateFailureDomainGroup(ctx context.Context, s *SessionContext, cluster *clusterv1.Cluster, domain *vsphereconfigv1.FailureDomain, vmref types.ManagedObjectReference) error {
+	ccr, err := s.finder.ClusterComputeResource(ctx, domain.ComputeCluster)
+	if err != nil {
+		return err
+	}
+	clusterConfig, err := ccr.Configuration(ctx)
+	if err != nil {
+		return err
+	}
+	name := failureDomainGroupName(cluster, domain)
+	spec := &types.ClusterConfigSpecEx{}
+
+	var group *types.ClusterVmGroup
+	for _, g := range clusterConfig.Group {
+		if g.GetClusterGroupInfo().Name == name {
+			vmGroup, ok := g.(*types.ClusterVmGroup)
+			if !ok {
+				return fmt.Errorf("[FATAL] DRS group %s exists but is not a VM group", name)
+			}
+			group = vmGroup
+			break
+		}
+	}
+	switch {
+	case group == nil:
+		klog.V(4).Infof("Creating VM group %s", name)
+		spec.GroupSpec = append(spec.GroupSpec, types.ClusterGroupSpec{
+			ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: types.ArrayUpdateOperationAdd},
+			Info: &types.ClusterVmGroup{
+				ClusterGroupInfo: types.ClusterGroupInfo{Name: name},
+				Vm:               []types.ManagedObjectReference{vmref},
+			},
+		})
+	case !containsVM(group.Vm, vmref):
+		klog.V(4).Infof("Adding VM %s to the VM group %s", vmref.Value, name)
+		vms := append([]types.ManagedObjectReference{}, group.Vm...)
+		spec.GroupSpec = append(spec.GroupSpec, types.ClusterGroupSpec{
+			ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: types.ArrayUpdateOperationEdit},
+			Info: &types.ClusterVmGroup{
+				ClusterGroupInfo: types.ClusterGroupInfo{Name: name},
+				Vm:               append(vms, vmref),
+			},
+		})
+	}
+
+	var rule *types.ClusterVmHostRuleInfo
+	for _, r := range clusterConfig.Rule {
+		if r.GetClusterRuleInfo().Name == name {
+			vmHost, ok := r.(*types.ClusterVmHostRuleInfo)
+			if !ok {
+				return fmt.Errorf("[FATAL] DRS rule %s exists but is not a VM/Host rule", name)
+			}
+			rule = vmHost
+			break
+		}
+	}
+	info := &types.ClusterVmHostRuleInfo{
+		ClusterRuleInfo: types.ClusterRuleInfo{
+			Name:      name,
+			Enabled:   types.NewBool(true),
+			Mandatory: types.NewBool(false),
+		},
+		VmGroupName:         name,
+		AffineHostGroupName: domain.HostGroup,
+	}
+	switch {
+	case rule == nil:
+		klog.V(4).Infof("Creating VM/Host rule %s for the host group %s", name, domain.HostGroup)
+		spec.RulesSpec = append(spec.RulesSpec, types.ClusterRuleSpec{
+			ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: types.ArrayUpdateOperationAdd},
+			Info:            info,
+		})
+	case rule.AffineHostGroupName != domain.HostGroup || !isTrue(rule.Enabled):
+		klog.V(4).Infof("Updating VM/Host rule %s for the host group %s", name, domain.HostGroup)
+		info.Key = rule.Key
+		spec.RulesSpec = append(spec.RulesSpec, types.ClusterRuleSpec{
+			ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: types.ArrayUpdateOperationEdit},
+			Info:            info,
+		})
+	}
+
+	if len(spec.GroupSpec) == 0 && len(spec.RulesSpec) == 0 {
+		return nil
+	}
+	task, err := ccr.Reconfigure(ctx, spec, true)
+	if err != nil {
+		return err
+	}
+	return task.Wait(ctx)
+}
+
+func containsVM(vms []types.ManagedObjectReference, vmref types.ManagedObjectReference) bool {
+	for _, vm := range vms {
+		if vm == vmref {
+			return true
+		}
+	}
+	return false
+}
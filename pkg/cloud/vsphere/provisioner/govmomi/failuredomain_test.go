@@ -0,0 +1,228 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package govmomi
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/client-go/tools/record"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+func TestSpreadFailureDomain(t *testing.T) {
+	domains := []vsphereconfigv1.FailureDomain{{Name: "zone-a"}, {Name: "zone-b"}, {Name: "zone-c"}}
+	newMachine := func(name, domain string, controlPlane bool) *clusterv1.Machine {
+		machine := newSimulatorMachine(vsphereconfigv1.VsphereMachineSpec{FailureDomain: domain})
+		machine.Name = name
+		if !controlPlane {
+			machine.Spec.Versions.ControlPlane = ""
+		}
+		return machine
+	}
+	machine := newMachine("machine", "", true)
+
+	if domain := spreadFailureDomain(domains, machine, nil); domain.Name != "zone-a" {
+		t.Errorf("expected the first failure domain without other machines, got %s", domain.Name)
+	}
+	machines := []*clusterv1.Machine{
+		machine,
+		newMachine("cp-a", "zone-a", true),
+		newMachine("cp-b", "zone-b", true),
+		newMachine("worker-c", "zone-c", false),
+	}
+	if domain := spreadFailureDomain(domains, machine, machines); domain.Name != "zone-c" {
+		t.Errorf("expected the failure domain without control-plane machines, got %s", domain.Name)
+	}
+}
+
+func TestCreateInFailureDomain(t *testing.T) {
+	model := simulator.VPX()
+	model.Host = 0 // ClusterHost only
+
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	ccr := simulator.Map.Any("ClusterComputeResource").(*simulator.ClusterComputeResource)
+	c, err := govmomi.NewClient(context.Background(), s.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task, err := object.NewClusterComputeResource(c.Client, ccr.Reference()).Reconfigure(context.Background(), &types.ClusterConfigSpecEx{
+		GroupSpec: []types.ClusterGroupSpec{
+			{
+				ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: types.ArrayUpdateOperationAdd},
+				Info: &types.ClusterHostGroup{
+					ClusterGroupInfo: types.ClusterGroupInfo{Name: "rack-1"},
+					Host:             ccr.Host[:2],
+				},
+			},
+		},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	cluster := newSimulatorCluster(s)
+	domain := vsphereconfigv1.FailureDomain{
+		Name:           "zone-a",
+		Region:         "region-1",
+		ComputeCluster: ccr.Name,
+		HostGroup:      "rack-1",
+		Network:        "VM Network",
+	}
+	clusterConfig, err := vsphereutils.GetClusterProviderSpec(cluster.Spec.ProviderSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterConfig.FailureDomains = []vsphereconfigv1.FailureDomain{domain}
+	cluster.Spec.ProviderSpec.Value.Raw, err = json.Marshal(clusterConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	p := newSimulatorProvisioner()
+	p.eventRecorder = record.NewFakeRecorder(10)
+
+	machineSpec := newSimulatorMachineSpec(vm, nil)
+	machineSpec.FailureDomain = "zone-b"
+	if err = p.Create(context.Background(), cluster, newSimulatorMachine(machineSpec)); err == nil {
+		t.Error("expected an unknown failure domain to fail")
+	}
+
+	// The network of the failure domain is used
+	machineSpec.FailureDomain = "zone-a"
+	machineSpec.Networks[0].NetworkName = ""
+	machine := newSimulatorMachine(machineSpec)
+	if err = p.Create(context.Background(), cluster, machine); err != nil {
+		t.Fatal(err)
+	}
+	if model.Machine+1 != model.Count().Machine {
+		t.Error("failed to clone vm")
+	}
+
+	script, err := p.getStartupScript(cluster, machine, &domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := "--node-labels=topology.kubernetes.io/region=region-1,topology.kubernetes.io/zone=zone-a"
+	if !strings.Contains(string(decoded), labels) {
+		t.Errorf("expected the startup script to set the node labels %s", labels)
+	}
+
+	// The cloud provider config has the network of the failure domain
+	machineConfig, err := vsphereutils.GetMachineProviderSpec(machine.Spec.ProviderSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain.Datastore = "LocalDS_1"
+	applyFailureDomain(machineConfig, &domain)
+	config, err := p.getCloudProviderConfig(cluster, machineConfig, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err = base64.StdEncoding.DecodeString(config); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`public-network = "VM Network"`, `default-datastore = "LocalDS_1"`} {
+		if !strings.Contains(string(decoded), expected) {
+			t.Errorf("expected the cloud provider config to contain %s, got %s", expected, decoded)
+		}
+	}
+
+	session, err := p.sessionFromProviderConfig(cluster, machine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// The VMs are spread across the hosts of the host group
+	hosts := []*simulator.HostSystem{
+		simulator.Map.Get(ccr.Host[0]).(*simulator.HostSystem),
+		simulator.Map.Get(ccr.Host[1]).(*simulator.HostSystem),
+	}
+	for i := 0; i < 2; i++ {
+		placement, err := p.getFailureDomainPlacement(ctx, session, machine, &domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		least, other := hosts[0], hosts[1]
+		if len(other.Vm) < len(least.Vm) {
+			least, other = other, least
+		}
+		if placement.host == nil || placement.host.Reference() != least.Reference() {
+			t.Errorf("expected the host with the least VMs %s, got %v", least.Name, placement.host)
+		}
+		// The next VM goes to the other host once this one runs more VMs
+		for len(least.Vm) <= len(other.Vm) {
+			least.Vm = append(least.Vm, types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-placeholder"})
+		}
+	}
+
+	// The VMs are kept on the host group by a VM/Host rule
+	vms := simulator.Map.All("VirtualMachine")
+	for _, vmref := range []types.ManagedObjectReference{vms[0].Reference(), vms[1].Reference(), vms[1].Reference()} {
+		if err = updateFailureDomainGroup(ctx, session, cluster, &domain, vmref); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := failureDomainGroupName(cluster, &domain)
+	var group *types.ClusterVmGroup
+	for _, g := range ccr.ConfigurationEx.(*types.ClusterConfigInfoEx).Group {
+		if g.GetClusterGroupInfo().Name == name {
+			group = g.(*types.ClusterVmGroup)
+		}
+	}
+	if group == nil || len(group.Vm) != 2 {
+		t.Errorf("expected a VM group %s with 2 VMs, got %+v", name, group)
+	}
+	var rule *types.ClusterVmHostRuleInfo
+	for _, r := range ccr.ConfigurationEx.(*types.ClusterConfigInfoEx).Rule {
+		if r.GetClusterRuleInfo().Name == name {
+			rule = r.(*types.ClusterVmHostRuleInfo)
+		}
+	}
+	if rule == nil || rule.VmGroupName != name || rule.AffineHostGroupName != "rack-1" || isTrue(rule.Mandatory) {
+		t.Errorf("expected a should run on rule for the host group rack-1, got %+v", rule)
+	}
+}
@@ -0,0 +1,191 @@
+package govmomi
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+// baseFolderPath returns the path of the base folder of the layout, relative
+// to the datacenter unless absolute.
+func baseFolderPath(layout *vsphereconfigv1.VMFolderLayout) string {
+	if layout.BaseFolder == "" {
+		return "vm"
+	}
+	return layout.BaseFolder
+}
+
+// clusterFolderPath returns the path of the folder of the cluster in the
+// layout, relative to the datacenter unless absolute.
+func clusterFolderPath(cluster *clusterv1.Cluster, layout *vsphereconfigv1.VMFolderLayout) string {
+	return path.Join(baseFolderPath(layout), cluster.Namespace, cluster.Name)
+}
+
+// getLayoutDatacenter returns the datacenter of the folder layout, which the
+// folders of the layout are created in and removed from.
+func getLayoutDatacenter(ctx context.Context, finder *find.Finder, layout *vsphereconfigv1.VMFolderLayout) (*object.Datacenter, error) {
+	return finder.DatacenterOrDefault(ctx, layout.Datacenter)
+}
+
+// getVMFolder returns the folder of the VM of the machine, created when
+// missing. The Machines without vmFolder are placed in the folder of their
+// cluster when the cluster sets a folder layout, in the VM folder of the
+// datacenter otherwise.
+func (pv *Provisioner) getVMFolder(ctx context.Context, s *SessionContext, cluster *clusterv1.Cluster, machineSpec *vsphereconfigv1.VsphereMachineSpec) (*object.Folder, error) {
+	return pv.getLayoutFolder(ctx, s, cluster, machineSpec, clusterFolderPath)
+}
+
+// getTemplateFolder returns the folder the templates imported for the machine
+// are cached in, created when missing. The templates are cached in the base
+// folder of the folder layout, if any, so that they are shared by the clusters
+// and kept out of the folder of the cluster, which is removed once empty.
+func (pv *Provisioner) getTemplateFolder(ctx context.Context, s *SessionContext, cluster *clusterv1.Cluster, machineSpec *vsphereconfigv1.VsphereMachineSpec) (*object.Folder, error) {
+	return pv.getLayoutFolder(ctx, s, cluster, machineSpec, func(_ *clusterv1.Cluster, layout *vsphereconfigv1.VMFolderLayout) string {
+		return baseFolderPath(layout)
+	})
+}
+
+// getLayoutFolder returns the vmFolder of the machine if set, the folder of
+// the layout of the cluster at the path returned by layoutPath otherwise, or
+// the VM folder of the datacenter when the cluster sets no folder layout. The
+// folders of the layout are in the datacenter of the layout, which must be the
+// datacenter of the machine.
+func (pv *Provisioner) getLayoutFolder(ctx context.Context, s *SessionContext, cluster *clusterv1.Cluster, machineSpec *vsphereconfigv1.VsphereMachineSpec,
+	layoutPath func(*clusterv1.Cluster, *vsphereconfigv1.VMFolderLayout) string) (*object.Folder, error) {
+	dc, err := s.finder.DatacenterOrDefault(ctx, machineSpec.Datacenter)
+	if err != nil {
+		return nil, err
+	}
+	if machineSpec.VMFolder != "" {
+		return getOrCreateFolder(ctx, s.finder, dc, machineSpec.VMFolder)
+	}
+	clusterConfig, err := vsphereutils.GetClusterProviderSpec(cluster.Spec.ProviderSpec)
+	if err != nil {
+		return nil, err
+	}
+	if clusterConfig.VMFolderLayout == nil {
+		return s.finder.DefaultFolder(ctx)
+	}
+	layoutDC, err := getLayoutDatacenter(ctx, find.NewFinder(s.session.Client, false), clusterConfig.VMFolderLayout)
+	if err != nil {
+		return nil, err
+	}
+	if layoutDC.Reference() != dc.Reference() {
+		return nil, fmt.Errorf("[FATAL] The datacenter %s of the machine is not the datacenter %s of the folder layout of the cluster", dc.InventoryPath, layoutDC.InventoryPath)
+	}
+	return getOrCreateFolder(ctx, s.finder, dc, layoutFolderPath(dc, layoutPath(cluster, clusterConfig.VMFolderLayout)))
+}
+
+// layoutFolderPath returns the absolute path of a folder of the layout, whose
+// path is relative to the datacenter unless absolute.
+func layoutFolderPath(dc *object.Datacenter, folderPath string) string {
+	if path.IsAbs(folderPath) {
+		return folderPath
+	}
+	return path.Join(dc.InventoryPath, folderPath)
+}
+
+// getOrCreateFolder returns the folder the finder finds at the path, creating
+// the missing folders of the path when not found. The folders to create are
+// resolved relative to the VM folder of the datacenter unless absolute, and
+// only created within it.
+func getOrCreateFolder(ctx context.Context, finder *find.Finder, dc *object.Datacenter, folderPath string) (*object.Folder, error) {
+	folder, err := finder.Folder(ctx, folderPath)
+	if err == nil {
+		return folder, nil
+	}
+	if _, ok := err.(*find.NotFoundError); !ok {
+		return nil, err
+	}
+	vmFolderPath := path.Join(dc.InventoryPath, "vm")
+	if !path.IsAbs(folderPath) {
+		folderPath = path.Join(vmFolderPath, folderPath)
+	}
+	parentPath := path.Dir(folderPath)
+	if parentPath != vmFolderPath && !strings.HasPrefix(parentPath, vmFolderPath+"/") {
+		return nil, fmt.Errorf("[FATAL] Folder %s cannot be created out of the VM folder %s", folderPath, vmFolderPath)
+	}
+	parent, err := getOrCreateFolder(ctx, finder, dc, parentPath)
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("Creating the folder %s", folderPath)
+	folder, err = parent.CreateFolder(ctx, path.Base(folderPath))
+	if err != nil {
+		if soap.IsSoapFault(err) {
+			if _, ok := soap.ToSoapFault(err).VimFault().(types.DuplicateName); ok {
+				// The folder was created by a concurrent reconcile
+				return finder.Folder(ctx, folderPath)
+			}
+		}
+		return nil, fmt.Errorf("error creating the folder %s: %s", folderPath, err)
+	}
+	folder.InventoryPath = folderPath
+	return folder, nil
+}
+
+// DeleteClusterFolder removes the folder of the cluster in the folder layout,
+// if any, when empty. The folder is kept when it still has children, e.g. VMs
+// which are not managed by the cluster.
+func (pv *Provisioner) DeleteClusterFolder(cluster *clusterv1.Cluster) error {
+	clusterConfig, err := vsphereutils.GetClusterProviderSpec(cluster.Spec.ProviderSpec)
+	if err != nil {
+		return err
+	}
+	if clusterConfig.VMFolderLayout == nil {
+		return nil
+	}
+	s, err := pv.sessionFromProviderConfig(cluster, nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(*s.context)
+	defer cancel()
+
+	// The finder of the session is shared with the machines, thus not reused
+	finder := find.NewFinder(s.session.Client, false)
+	dc, err := getLayoutDatacenter(ctx, finder, clusterConfig.VMFolderLayout)
+	if err != nil {
+		return err
+	}
+	finder.SetDatacenter(dc)
+	folderPath := layoutFolderPath(dc, clusterFolderPath(cluster, clusterConfig.VMFolderLayout))
+	folder, err := finder.Folder(ctx, folderPath)
+	if err != nil {
+		if _, ok := err.(*find.NotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	children, err := folder.Children(ctx)
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 {
+		klog.Warningf("Keeping the folder %s of cluster %s which is not empty", folderPath, cluster.Name)
+		if pv.eventRecorder != nil {
+			pv.eventRecorder.Eventf(cluster, corev1.EventTypeWarning, "FolderNotEmpty", "Keeping the folder %s which is not empty", folderPath)
+		}
+		return nil
+	}
+	klog.Infof("Deleting the folder %s of cluster %s", folderPath, cluster.Name)
+	task, err := folder.Destroy(ctx)
+	if err != nil {
+		return err
+	}
+	if err := task.Wait(ctx); err != nil {
+		return fmt.Errorf("error deleting the folder %s: %s", folderPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package govmomi
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"k8s.io/client-go/tools/record"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+func TestGetOrCreateFolder(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	c, err := govmomi.NewClient(context.Background(), s.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	finder := find.NewFinder(c.Client, false)
+	dc, err := finder.DefaultDatacenter(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finder.SetDatacenter(dc)
+
+	folder, err := getOrCreateFolder(ctx, finder, dc, "k8s/default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder.InventoryPath != "/DC0/vm/k8s/default" {
+		t.Errorf("unexpected folder %s", folder.InventoryPath)
+	}
+	// The folder is found afterwards, with an absolute path or a bare name as well
+	for _, folderPath := range []string{"/DC0/vm/k8s/default", "default"} {
+		existing, err := getOrCreateFolder(ctx, finder, dc, folderPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if existing.Reference() != folder.Reference() {
+			t.Errorf("expected the folder %v for %s, got %v", folder.Reference(), folderPath, existing.Reference())
+		}
+	}
+	// A bare folder name is created in the VM folder
+	folder, err = getOrCreateFolder(ctx, finder, dc, "clusterapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder.InventoryPath != "/DC0/vm/clusterapi" {
+		t.Errorf("unexpected folder %s", folder.InventoryPath)
+	}
+	if _, err = getOrCreateFolder(ctx, finder, dc, "/DC0/host/k8s"); err == nil {
+		t.Error("expected a folder out of the VM folder to fail")
+	}
+}
+
+func TestVMFolderLayout(t *testing.T) {
+	model := simulator.VPX()
+	model.Host = 0 // ClusterHost only
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	cluster := newSimulatorCluster(s)
+	cluster.Namespace, cluster.Name = "default", "cluster1"
+	setSimulatorVMFolderLayout(cluster, &vsphereconfigv1.VMFolderLayout{BaseFolder: "vm/k8s"})
+	p := newSimulatorProvisioner()
+	p.eventRecorder = record.NewFakeRecorder(10)
+
+	// An empty folder is removed with the cluster
+	ctx := context.Background()
+	session, err := p.sessionFromProviderConfig(cluster, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, err := session.finder.DefaultDatacenter(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = getOrCreateFolder(ctx, find.NewFinder(session.session.Client, false), dc, "/DC0/vm/k8s/default/cluster1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.DeleteClusterFolder(cluster); err != nil {
+		t.Fatal(err)
+	}
+	if findSimulatorFolder("cluster1") != nil {
+		t.Error("expected the empty folder of the cluster to be deleted")
+	}
+
+	machine := newSimulatorMachine(newSimulatorMachineSpec(vm, nil))
+	if err = p.Create(ctx, cluster, machine); err != nil {
+		t.Fatal(err)
+	}
+	folder := findSimulatorFolder("cluster1")
+	if folder == nil {
+		t.Fatal("expected the folder of the cluster to be created")
+	}
+	if clone := findSimulatorVM(machine.Name); clone == nil || clone.Parent == nil || *clone.Parent != folder.Reference() {
+		t.Error("expected the VM in the folder of the cluster")
+	}
+	// A folder with VMs is kept
+	if err = p.DeleteClusterFolder(cluster); err != nil {
+		t.Fatal(err)
+	}
+	if findSimulatorFolder("cluster1") == nil {
+		t.Error("expected the folder of the cluster to be kept")
+	}
+
+	// The templates are cached in the base folder
+	machineSpec := newSimulatorMachineSpec(vm, nil)
+	machineSpec.Datacenter = "DC0"
+	folder1, err := p.getTemplateFolder(ctx, session, cluster, &machineSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder1.InventoryPath != "/DC0/vm/k8s" {
+		t.Errorf("expected the templates in the base folder, got %s", folder1.InventoryPath)
+	}
+
+	// The vmFolder of the Machine is found by its bare name
+	machineSpec.VMFolder = "k8s"
+	folder2, err := p.getVMFolder(ctx, session, cluster, &machineSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder2.Reference() != folder1.Reference() {
+		t.Errorf("expected the vmFolder %v, got %v", folder1.Reference(), folder2.Reference())
+	}
+	machineSpec.VMFolder = ""
+
+	// The Machines are in the datacenter of the layout
+	if _, err = object.NewRootFolder(session.session.Client).CreateDatacenter(ctx, "DC1"); err != nil {
+		t.Fatal(err)
+	}
+	setSimulatorVMFolderLayout(cluster, &vsphereconfigv1.VMFolderLayout{Datacenter: "DC1", BaseFolder: "vm/k8s"})
+	if _, err = p.getVMFolder(ctx, session, cluster, &machineSpec); err == nil {
+		t.Error("expected a Machine out of the datacenter of the layout to fail")
+	}
+}
+
+func findSimulatorFolder(name string) *simulator.Folder {
+	for _, e := range simulator.Map.All("Folder") {
+		if folder := e.(*simulator.Folder); folder.Name == name {
+			return folder
+		}
+	}
+	return nil
+}
+
+func setSimulatorVMFolderLayout(cluster *clusterv1.Cluster, layout *vsphereconfigv1.VMFolderLayout) {
+	clusterConfig, err := vsphereutils.GetClusterProviderSpec(cluster.Spec.ProviderSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clusterConfig.VMFolderLayout = layout
+	cluster.Spec.ProviderSpec.Value.Raw, err = json.Marshal(clusterConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,275 @@
+package govmomi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// allocateIPAddresses sets the static IPConfig of the networks referencing a
+// VsphereIPPool from the addresses allocated to the Machine. The allocation
+// is recorded in the status of the pool, keyed by the UID of the Machine, so
+// that the Machine gets the same address back on the next reconcile.
+func (pv *Provisioner) allocateIPAddresses(ctx context.Context, machine *clusterv1.Machine, machineConfig *vsphereconfigv1.VsphereMachineProviderConfig) error {
+	for i := range machineConfig.MachineSpec.Networks {
+		network := &machineConfig.MachineSpec.Networks[i]
+		if network.IPPool == "" {
+			continue
+		}
+		switch {
+		case network.IPConfig.NetworkType == vsphereconfigv1.DHCP:
+			return fmt.Errorf("[FATAL] Network %d references the IP pool %s but uses DHCP", i, network.IPPool)
+		case network.IPConfig.IP != "" || len(network.IPConfig.IPs) > 0:
+			return fmt.Errorf("[FATAL] Network %d references the IP pool %s but sets its addresses", i, network.IPPool)
+		case pv.controllerClient == nil:
+			return fmt.Errorf("no client available to allocate an address from the IP pool %s", network.IPPool)
+		}
+		pool, ip, err := pv.allocateIPAddress(ctx, machine, network.IPPool, i)
+		if err != nil {
+			return err
+		}
+		ipnet, err := findCIDR(pool, ip)
+		if err != nil {
+			return err
+		}
+		network.IPConfig.NetworkType = vsphereconfigv1.Static
+		if ip.To4() != nil {
+			network.IPConfig.IP = ip.String()
+			if network.IPConfig.Netmask == "" {
+				network.IPConfig.Netmask = net.IP(ipnet.Mask).String()
+			}
+			if network.IPConfig.Gateway == "" {
+				network.IPConfig.Gateway = pool.Spec.Gateway
+			}
+		} else {
+			prefix, _ := ipnet.Mask.Size()
+			network.IPConfig.IPs = []string{fmt.Sprintf("%s/%d", ip, prefix)}
+			if network.IPConfig.Gateway6 == "" {
+				network.IPConfig.Gateway6 = pool.Spec.Gateway
+			}
+		}
+		if len(network.IPConfig.Dns) == 0 {
+			network.IPConfig.Dns = pool.Spec.Dns
+		}
+	}
+	return nil
+}
+
+// allocateIPAddress returns the address allocated to the NIC of the Machine
+// from the pool, allocating a free address if there is none yet. The pool is
+// updated with the resource version it was read at, thus an allocation made
+// concurrently by another controller results in a conflict and a retry.
+func (pv *Provisioner) allocateIPAddress(ctx context.Context, machine *clusterv1.Machine, poolName string, networkIndex int) (*vsphereconfigv1.VsphereIPPool, net.IP, error) {
+	pv.ipPoolMutex.Lock()
+	defer pv.ipPoolMutex.Unlock()
+
+	var pool *vsphereconfigv1.VsphereIPPool
+	var ip net.IP
+	err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		pool = &vsphereconfigv1.VsphereIPPool{}
+		key := client.ObjectKey{Namespace: machine.Namespace, Name: poolName}
+		if err := pv.controllerClient.Get(ctx, key, pool); err != nil {
+			return err
+		}
+		var claimed bool
+		var err error
+		ip, claimed, err = claimIPAddress(pool, machine, networkIndex)
+		if err != nil || !claimed {
+			return err
+		}
+		return pv.controllerClient.Update(ctx, pool)
+	})
+	if err != nil {
+		if pv.eventRecorder != nil {
+			pv.eventRecorder.Eventf(machine, corev1.EventTypeWarning, "FailedIPAllocation", "Failed to allocate an address from the IP pool %s: %v", poolName, err)
+		}
+		return nil, nil, fmt.Errorf("error allocating an address from the IP pool %s: %v", poolName, err)
+	}
+	klog.V(4).Infof("Allocated address %s from the IP pool %s to network %d of machine %s", ip, poolName, networkIndex, machine.Name)
+	return pool, ip, nil
+}
+
+// releaseIPAddresses removes the allocations of the Machine from the pools
+// referenced by its networks. Pools which no longer exist are ignored.
+func (pv *Provisioner) releaseIPAddresses(ctx context.Context, machine *clusterv1.Machine, machineConfig *vsphereconfigv1.VsphereMachineProviderConfig) error {
+	released := make(map[string]bool)
+	for _, network := range machineConfig.MachineSpec.Networks {
+		if network.IPPool == "" || released[network.IPPool] || pv.controllerClient == nil {
+			continue
+		}
+		released[network.IPPool] = true
+		if err := pv.releaseIPAddress(ctx, machine, network.IPPool); err != nil {
+			return fmt.Errorf("error releasing the addresses of the IP pool %s: %v", network.IPPool, err)
+		}
+	}
+	return nil
+}
+
+func (pv *Provisioner) releaseIPAddress(ctx context.Context, machine *clusterv1.Machine, poolName string) error {
+	pv.ipPoolMutex.Lock()
+	defer pv.ipPoolMutex.Unlock()
+
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		pool := &vsphereconfigv1.VsphereIPPool{}
+		key := client.ObjectKey{Namespace: machine.Namespace, Name: poolName}
+		if err := pv.controllerClient.Get(ctx, key, pool); err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		var released []string
+		for ip, allocation := range pool.Status.Allocations {
+			if allocation.MachineUID == string(machine.UID) {
+				delete(pool.Status.Allocations, ip)
+				released = append(released, ip)
+			}
+		}
+		if len(released) == 0 {
+			return nil
+		}
+		klog.V(4).Infof("Releasing addresses %s of machine %s to the IP pool %s", strings.Join(released, ", "), machine.Name, poolName)
+		return pv.controllerClient.Update(ctx, pool)
+	})
+}
+
+// maxIPPoolScan caps the addresses of the pool looked at for a free address,
+// as the cidrs of IPv6 pools are far too large to be walked.
+const maxIPPoolScan = 1 << 16
+
+// claimIPAddress returns the address allocated to the NIC of the Machine. If
+// the NIC has no address yet, the first free address of the pool is recorded
+// in the allocations of the pool and claimed is true. The excluded ranges are
+// skipped at once, and the scan gives up after maxIPPoolScan addresses.
+func claimIPAddress(pool *vsphereconfigv1.VsphereIPPool, machine *clusterv1.Machine, networkIndex int) (ip net.IP, claimed bool, err error) {
+	for addr, allocation := range pool.Status.Allocations {
+		if allocation.MachineUID == string(machine.UID) && allocation.NetworkIndex == networkIndex {
+			return net.ParseIP(addr), false, nil
+		}
+	}
+	excluded, err := parseExclusions(pool)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(pool.Spec.CIDRs) == 0 {
+		return nil, false, fmt.Errorf("[FATAL] IP pool %s has no cidrs", pool.Name)
+	}
+	gateway := net.ParseIP(pool.Spec.Gateway)
+	scanned := 0
+	for _, cidr := range pool.Spec.CIDRs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, false, fmt.Errorf("[FATAL] Invalid cidr %q in the IP pool %s: %v", cidr, pool.Name, err)
+		}
+		first, last := ipnet.IP, lastIP(ipnet)
+		ones, bits := ipnet.Mask.Size()
+		for addr := first; ipnet.Contains(addr); addr = nextIP(addr) {
+			if scanned++; scanned > maxIPPoolScan {
+				return nil, false, fmt.Errorf("IP pool %s has no free address within the first %d addresses", pool.Name, maxIPPoolScan)
+			}
+			// The network and broadcast addresses are not usable, except
+			// in point-to-point networks. IPv6 has no broadcast address but
+			// the first address is the subnet-router anycast address.
+			if bits-ones > 1 && (addr.Equal(first) || (bits == 32 && addr.Equal(last))) {
+				continue
+			}
+			if exclusion := findExclusion(addr, excluded); exclusion != nil {
+				// Resume after the last address of the exclusion
+				addr = lastIP(exclusion)
+				continue
+			}
+			if addr.Equal(gateway) {
+				continue
+			}
+			if _, ok := pool.Status.Allocations[addr.String()]; ok {
+				continue
+			}
+			if pool.Status.Allocations == nil {
+				pool.Status.Allocations = make(map[string]vsphereconfigv1.IPAllocation)
+			}
+			pool.Status.Allocations[addr.String()] = vsphereconfigv1.IPAllocation{
+				Machine:      fmt.Sprintf("%s/%s", machine.Namespace, machine.Name),
+				MachineUID:   string(machine.UID),
+				NetworkIndex: networkIndex,
+			}
+			return addr, true, nil
+		}
+	}
+	return nil, false, fmt.Errorf("IP pool %s has no free address", pool.Name)
+}
+
+// parseExclusions returns the excluded addresses of the pool as networks,
+// single addresses being networks of one address.
+func parseExclusions(pool *vsphereconfigv1.VsphereIPPool) ([]*net.IPNet, error) {
+	excluded := make([]*net.IPNet, 0, len(pool.Spec.Exclusions))
+	for _, exclusion := range pool.Spec.Exclusions {
+		if strings.Contains(exclusion, "/") {
+			_, ipnet, err := net.ParseCIDR(exclusion)
+			if err != nil {
+				return nil, fmt.Errorf("[FATAL] Invalid exclusion %q in the IP pool %s: %v", exclusion, pool.Name, err)
+			}
+			excluded = append(excluded, ipnet)
+			continue
+		}
+		ip := net.ParseIP(exclusion)
+		if ip == nil {
+			return nil, fmt.Errorf("[FATAL] Invalid exclusion %q in the IP pool %s", exclusion, pool.Name)
+		}
+		if ip.To4() != nil {
+			ip = ip.To4()
+		}
+		excluded = append(excluded, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+	}
+	return excluded, nil
+}
+
+// findExclusion returns the excluded network containing the address, if any.
+func findExclusion(ip net.IP, excluded []*net.IPNet) *net.IPNet {
+	for _, ipnet := range excluded {
+		if ipnet.Contains(ip) {
+			return ipnet
+		}
+	}
+	return nil
+}
+
+// findCIDR returns the network of the pool the address was allocated from.
+func findCIDR(pool *vsphereconfigv1.VsphereIPPool, ip net.IP) (*net.IPNet, error) {
+	for _, cidr := range pool.Spec.CIDRs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err == nil && ipnet.Contains(ip) {
+			return ipnet, nil
+		}
+	}
+	return nil, fmt.Errorf("[FATAL] Address %s allocated from the IP pool %s is not part of its cidrs", ip, pool.Name)
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func lastIP(ipnet *net.IPNet) net.IP {
+	ip := ipnet.IP
+	last := make(net.IP, len(ip))
+	for i := range ip {
+		last[i] = ip[i] | ^ipnet.Mask[i]
+	}
+	return last
+}
@@ -0,0 +1,329 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package govmomi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ipPoolClient is a controller-runtime client holding VsphereIPPools in
+// memory. Updates are rejected with a conflict unless made at the current
+// resource version, like the API server does.
+type ipPoolClient struct {
+	client.Client
+	mutex sync.Mutex
+	pools map[client.ObjectKey]*vsphereconfigv1.VsphereIPPool
+	// beforeUpdate is called with the stored pool before an update
+	beforeUpdate func(pool *vsphereconfigv1.VsphereIPPool)
+}
+
+func newIPPoolClient(pools ...*vsphereconfigv1.VsphereIPPool) *ipPoolClient {
+	c := &ipPoolClient{pools: make(map[client.ObjectKey]*vsphereconfigv1.VsphereIPPool)}
+	for _, pool := range pools {
+		pool.ResourceVersion = "1"
+		c.pools[client.ObjectKey{Namespace: pool.Namespace, Name: pool.Name}] = pool
+	}
+	return c
+}
+
+func (c *ipPoolClient) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	pool, ok := c.pools[key]
+	if !ok {
+		return apierrors.NewNotFound(schema.GroupResource{Resource: "vsphereippools"}, key.Name)
+	}
+	pool.DeepCopyInto(obj.(*vsphereconfigv1.VsphereIPPool))
+	return nil
+}
+
+func (c *ipPoolClient) Update(ctx context.Context, obj runtime.Object) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	pool := obj.(*vsphereconfigv1.VsphereIPPool)
+	key := client.ObjectKey{Namespace: pool.Namespace, Name: pool.Name}
+	stored, ok := c.pools[key]
+	if !ok {
+		return apierrors.NewNotFound(schema.GroupResource{Resource: "vsphereippools"}, pool.Name)
+	}
+	if c.beforeUpdate != nil {
+		c.beforeUpdate(stored)
+		c.beforeUpdate = nil
+	}
+	if pool.ResourceVersion != stored.ResourceVersion {
+		return apierrors.NewConflict(schema.GroupResource{Resource: "vsphereippools"}, pool.Name, fmt.Errorf("the object has been modified"))
+	}
+	version, _ := strconv.Atoi(stored.ResourceVersion)
+	pool.ResourceVersion = strconv.Itoa(version + 1)
+	c.pools[key] = pool.DeepCopy()
+	return nil
+}
+
+func newTestIPPool() *vsphereconfigv1.VsphereIPPool {
+	return &vsphereconfigv1.VsphereIPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool1", Namespace: "default"},
+		Spec: vsphereconfigv1.VsphereIPPoolSpec{
+			CIDRs:      []string{"10.0.0.0/29", "10.0.1.0/30"},
+			Gateway:    "10.0.0.1",
+			Dns:        []string{"10.0.0.53"},
+			Exclusions: []string{"10.0.0.2", "10.0.0.4/31"},
+		},
+	}
+}
+
+func newTestIPPoolMachine(name string) *clusterv1.Machine {
+	return &clusterv1.Machine{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(name + "-uid")},
+	}
+}
+
+func TestClaimIPAddress(t *testing.T) {
+	pool := newTestIPPool()
+	machine1 := newTestIPPoolMachine("machine1")
+	machine2 := newTestIPPoolMachine("machine2")
+
+	// .0 is the network address, .1 the gateway, .2, .4 and .5 are excluded
+	// and .7 is the broadcast address, the second cidr has a single address
+	expected := []struct {
+		machine *clusterv1.Machine
+		index   int
+		ip      string
+		claimed bool
+	}{
+		{machine1, 0, "10.0.0.3", true},
+		{machine1, 0, "10.0.0.3", false},
+		{machine1, 1, "10.0.0.6", true},
+		{machine2, 0, "10.0.1.1", true},
+		{machine2, 1, "10.0.1.2", true},
+		{machine1, 1, "10.0.0.6", false},
+	}
+	for _, e := range expected {
+		ip, claimed, err := claimIPAddress(pool, e.machine, e.index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != e.ip || claimed != e.claimed {
+			t.Errorf("%s network %d: expected %s claimed %t, got %s claimed %t", e.machine.Name, e.index, e.ip, e.claimed, ip, claimed)
+		}
+	}
+	if _, _, err := claimIPAddress(pool, newTestIPPoolMachine("machine3"), 0); err == nil {
+		t.Error("expected an error for an exhausted pool")
+	}
+	allocation := pool.Status.Allocations["10.0.1.2"]
+	if allocation.Machine != "default/machine2" || allocation.MachineUID != "machine2-uid" || allocation.NetworkIndex != 1 {
+		t.Errorf("unexpected allocation %+v", allocation)
+	}
+
+	for _, spec := range []vsphereconfigv1.VsphereIPPoolSpec{
+		{},
+		{CIDRs: []string{"10.0.0.0"}},
+		{CIDRs: []string{"10.0.0.0/24"}, Exclusions: []string{"10.0.0"}},
+	} {
+		pool := &vsphereconfigv1.VsphereIPPool{Spec: spec}
+		if _, _, err := claimIPAddress(pool, machine1, 0); err == nil {
+			t.Errorf("expected an error for the pool %+v", spec)
+		}
+	}
+}
+
+func TestClaimIPv6Address(t *testing.T) {
+	pool := &vsphereconfigv1.VsphereIPPool{
+		Spec: vsphereconfigv1.VsphereIPPoolSpec{
+			CIDRs:      []string{"fd00::/126"},
+			Gateway:    "fd00::1",
+			Exclusions: []string{"fd00::2"},
+		},
+	}
+	// The subnet-router anycast address is skipped, the last address is
+	// usable
+	ip, _, err := claimIPAddress(pool, newTestIPPoolMachine("machine1"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "fd00::3" {
+		t.Errorf("expected fd00::3, got %s", ip)
+	}
+
+	// The exclusions of a /64 are skipped at once
+	large := &vsphereconfigv1.VsphereIPPool{
+		Spec: vsphereconfigv1.VsphereIPPoolSpec{
+			CIDRs:      []string{"fd00::/64"},
+			Exclusions: []string{"fd00::/65", "fd00::8000:0:0:0/96"},
+		},
+	}
+	ip, _, err = claimIPAddress(large, newTestIPPoolMachine("machine1"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "fd00::8000:1:0:0" {
+		t.Errorf("expected fd00::8000:1:0:0, got %s", ip)
+	}
+	large.Spec.Exclusions = []string{"fd00::/65", "fd00::8000:0:0:0/65"}
+	if _, _, err = claimIPAddress(large, newTestIPPoolMachine("machine2"), 0); err == nil {
+		t.Error("expected an error for a fully excluded pool")
+	}
+	// The scan is capped
+	large.Spec.Exclusions = nil
+	large.Status.Allocations = make(map[string]vsphereconfigv1.IPAllocation)
+	for addr := nextIP(net.ParseIP("fd00::")); len(large.Status.Allocations) < maxIPPoolScan; addr = nextIP(addr) {
+		large.Status.Allocations[addr.String()] = vsphereconfigv1.IPAllocation{MachineUID: "other-uid"}
+	}
+	if _, _, err = claimIPAddress(large, newTestIPPoolMachine("machine3"), 0); err == nil {
+		t.Error("expected an error once the scan is capped")
+	}
+
+	c := newIPPoolClient(&vsphereconfigv1.VsphereIPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool6", Namespace: "default"},
+		Spec:       pool.Spec,
+	})
+	machineConfig := &vsphereconfigv1.VsphereMachineProviderConfig{
+		MachineSpec: vsphereconfigv1.VsphereMachineSpec{
+			Networks: []vsphereconfigv1.NetworkSpec{{NetworkName: "VM Network", IPPool: "pool6"}},
+		},
+	}
+	if err := newProvisionerWithClient(c).allocateIPAddresses(context.TODO(), newTestIPPoolMachine("machine1"), machineConfig); err != nil {
+		t.Fatal(err)
+	}
+	ipConfig := machineConfig.MachineSpec.Networks[0].IPConfig
+	if ipConfig.IP != "" || len(ipConfig.IPs) != 1 || ipConfig.IPs[0] != "fd00::3/126" || ipConfig.Gateway6 != "fd00::1" {
+		t.Errorf("unexpected ipConfig %+v", ipConfig)
+	}
+}
+
+func TestAllocateIPAddresses(t *testing.T) {
+	c := newIPPoolClient(newTestIPPool())
+	p := newSimulatorProvisioner()
+	p.controllerClient = c
+	machine := newTestIPPoolMachine("machine1")
+	newMachineConfig := func() *vsphereconfigv1.VsphereMachineProviderConfig {
+		return &vsphereconfigv1.VsphereMachineProviderConfig{
+			MachineSpec: vsphereconfigv1.VsphereMachineSpec{
+				Networks: []vsphereconfigv1.NetworkSpec{
+					{NetworkName: "VM Network", IPPool: "pool1"},
+					{NetworkName: "VM Network", IPConfig: vsphereconfigv1.IPConfig{NetworkType: vsphereconfigv1.DHCP}},
+					{NetworkName: "VM Network", IPPool: "pool1", IPConfig: vsphereconfigv1.IPConfig{Gateway: "10.0.0.254"}},
+				},
+			},
+		}
+	}
+
+	machineConfig := newMachineConfig()
+	if err := p.allocateIPAddresses(context.TODO(), machine, machineConfig); err != nil {
+		t.Fatal(err)
+	}
+	ipConfig := machineConfig.MachineSpec.Networks[0].IPConfig
+	if ipConfig.NetworkType != vsphereconfigv1.Static || ipConfig.IP != "10.0.0.3" || ipConfig.Netmask != "255.255.255.248" ||
+		ipConfig.Gateway != "10.0.0.1" || len(ipConfig.Dns) != 1 || ipConfig.Dns[0] != "10.0.0.53" {
+		t.Errorf("unexpected ipConfig %+v", ipConfig)
+	}
+	if ipConfig := machineConfig.MachineSpec.Networks[1].IPConfig; ipConfig.IP != "" {
+		t.Errorf("expected no address for the DHCP network, got %s", ipConfig.IP)
+	}
+	ipConfig = machineConfig.MachineSpec.Networks[2].IPConfig
+	if ipConfig.IP != "10.0.0.6" || ipConfig.Gateway != "10.0.0.254" {
+		t.Errorf("unexpected ipConfig %+v", ipConfig)
+	}
+
+	// The claims are found again, e.g. after a restart of the controller
+	machineConfig = newMachineConfig()
+	if err := newProvisionerWithClient(c).allocateIPAddresses(context.TODO(), machine, machineConfig); err != nil {
+		t.Fatal(err)
+	}
+	if ip := machineConfig.MachineSpec.Networks[0].IPConfig.IP; ip != "10.0.0.3" {
+		t.Errorf("expected the allocated address 10.0.0.3, got %s", ip)
+	}
+	pool := c.pools[client.ObjectKey{Namespace: "default", Name: "pool1"}]
+	if len(pool.Status.Allocations) != 2 {
+		t.Errorf("expected 2 allocations, got %v", pool.Status.Allocations)
+	}
+
+	if err := p.releaseIPAddresses(context.TODO(), machine, machineConfig); err != nil {
+		t.Fatal(err)
+	}
+	pool = c.pools[client.ObjectKey{Namespace: "default", Name: "pool1"}]
+	if len(pool.Status.Allocations) != 0 {
+		t.Errorf("expected no allocations, got %v", pool.Status.Allocations)
+	}
+
+	machineConfig.MachineSpec.Networks[0].IPPool = "missing"
+	if err := p.allocateIPAddresses(context.TODO(), machine, machineConfig); err == nil {
+		t.Error("expected an error for a missing pool")
+	}
+	if err := p.releaseIPAddresses(context.TODO(), machine, machineConfig); err != nil {
+		t.Errorf("expected no error releasing the addresses of a missing pool, got %v", err)
+	}
+}
+
+func TestAllocateIPAddressConflict(t *testing.T) {
+	c := newIPPoolClient(newTestIPPool())
+	other := newTestIPPoolMachine("other")
+	// Another controller claims the first free address meanwhile
+	c.beforeUpdate = func(pool *vsphereconfigv1.VsphereIPPool) {
+		if _, _, err := claimIPAddress(pool, other, 0); err != nil {
+			t.Fatal(err)
+		}
+		pool.ResourceVersion = "2"
+	}
+	_, ip, err := newProvisionerWithClient(c).allocateIPAddress(context.TODO(), newTestIPPoolMachine("machine1"), "pool1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.0.0.6" {
+		t.Errorf("expected the address 10.0.0.6 after the conflict, got %s", ip)
+	}
+
+	// Concurrent allocations by several controllers never hand out an
+	// address twice
+	c = newIPPoolClient(newTestIPPool())
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		p := newProvisionerWithClient(c)
+		machine := newTestIPPoolMachine(fmt.Sprintf("machine%d", i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := p.allocateIPAddress(context.TODO(), machine, "pool1", 0); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	pool := c.pools[client.ObjectKey{Namespace: "default", Name: "pool1"}]
+	if len(pool.Status.Allocations) != 3 {
+		t.Errorf("expected 3 allocations, got %v", pool.Status.Allocations)
+	}
+}
+
+func newProvisionerWithClient(c client.Client) *Provisioner {
+	p := newSimulatorProvisioner()
+	p.controllerClient = c
+	return p
+}
@@ -0,0 +1,172 @@
+package govmomi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+)
+
+// findNetwork returns the network of the NIC, referenced by opaque network ID,
+// by port group key, by port group name on a distributed switch, or by name or
+// inventory path. Opaque network IDs and port group keys are searched in the
+// network folder of the datacenter and its subfolders. An error listing the
+// candidates is returned when the reference matches more than one network.
+func findNetwork(ctx context.Context, s *SessionContext, network vsphereconfigv1.NetworkSpec) (object.NetworkReference, error) {
+	var candidates []object.NetworkReference
+	var err error
+	var description string
+	switch {
+	case network.OpaqueNetworkID != "":
+		description = fmt.Sprintf("opaque network ID %s", network.OpaqueNetworkID)
+		candidates, err = findOpaqueNetworks(ctx, s, network.OpaqueNetworkID)
+	case network.PortGroupKey != "":
+		description = fmt.Sprintf("port group key %s", network.PortGroupKey)
+		candidates, err = findPortGroups(ctx, s, "./...", func(pg *mo.DistributedVirtualPortgroup) bool {
+			return pg.Key == network.PortGroupKey
+		})
+	case network.DistributedSwitch != "":
+		description = fmt.Sprintf("port group %s on the distributed switch %s", network.NetworkName, network.DistributedSwitch)
+		var dvs types.ManagedObjectReference
+		dvs, err = findDistributedSwitch(ctx, s, network.DistributedSwitch)
+		if err == nil {
+			candidates, err = findPortGroups(ctx, s, network.NetworkName, func(pg *mo.DistributedVirtualPortgroup) bool {
+				return pg.Config.DistributedVirtualSwitch != nil && *pg.Config.DistributedVirtualSwitch == dvs
+			})
+		}
+	default:
+		description = fmt.Sprintf("network %s", network.NetworkName)
+		candidates, err = findNetworks(ctx, s, network.NetworkName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, fmt.Errorf("[FATAL] No network found for the %s", description)
+	case 1:
+		return candidates[0], nil
+	}
+	paths := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		paths = append(paths, fmt.Sprintf("%s (%s)", networkPath(candidate), candidate.Reference().Value))
+	}
+	return nil, fmt.Errorf("[FATAL] The %s is ambiguous, it matches the networks %s. Please reference the network by inventory path, distributed switch, port group key or opaque network ID",
+		description, strings.Join(paths, ", "))
+}
+
+// findNetworks returns the networks matching the name or path, leaving out
+// the distributed switches which cannot back a NIC.
+func findNetworks(ctx context.Context, s *SessionContext, path string) ([]object.NetworkReference, error) {
+	networks, err := s.finder.NetworkList(ctx, path)
+	if err != nil {
+		if _, ok := err.(*find.NotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var found []object.NetworkReference
+	for _, network := range networks {
+		if _, ok := network.(*object.DistributedVirtualSwitch); !ok {
+			found = append(found, network)
+		}
+	}
+	return found, nil
+}
+
+// findPortGroups returns the distributed port groups matching the name or
+// path for which the filter returns true.
+func findPortGroups(ctx context.Context, s *SessionContext, path string, filter func(*mo.DistributedVirtualPortgroup) bool) ([]object.NetworkReference, error) {
+	networks, err := findNetworks(ctx, s, path)
+	if err != nil {
+		return nil, err
+	}
+	var refs []types.ManagedObjectReference
+	byRef := make(map[types.ManagedObjectReference]object.NetworkReference)
+	for _, network := range networks {
+		if _, ok := network.(*object.DistributedVirtualPortgroup); ok {
+			refs = append(refs, network.Reference())
+			byRef[network.Reference()] = network
+		}
+	}
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	var portGroups []mo.DistributedVirtualPortgroup
+	pc := property.DefaultCollector(s.session.Client)
+	if err := pc.Retrieve(ctx, refs, []string{"key", "config.distributedVirtualSwitch"}, &portGroups); err != nil {
+		return nil, err
+	}
+	var found []object.NetworkReference
+	for i := range portGroups {
+		if filter(&portGroups[i]) {
+			found = append(found, byRef[portGroups[i].Reference()])
+		}
+	}
+	return found, nil
+}
+
+// findOpaqueNetworks returns the opaque networks with the given ID, searched
+// in the network folder of the datacenter and its subfolders.
+func findOpaqueNetworks(ctx context.Context, s *SessionContext, id string) ([]object.NetworkReference, error) {
+	networks, err := findNetworks(ctx, s, "./...")
+	if err != nil {
+		return nil, err
+	}
+	var found []object.NetworkReference
+	for _, network := range networks {
+		opaque, ok := network.(*object.OpaqueNetwork)
+		if !ok {
+			continue
+		}
+		var net mo.OpaqueNetwork
+		if err := opaque.Properties(ctx, opaque.Reference(), []string{"summary"}, &net); err != nil {
+			return nil, err
+		}
+		if summary, ok := net.Summary.(*types.OpaqueNetworkSummary); ok && summary.OpaqueNetworkId == id {
+			found = append(found, network)
+		}
+	}
+	return found, nil
+}
+
+// findDistributedSwitch returns the reference of the named distributed switch.
+func findDistributedSwitch(ctx context.Context, s *SessionContext, name string) (types.ManagedObjectReference, error) {
+	networks, err := s.finder.NetworkList(ctx, name)
+	if err != nil {
+		if _, ok := err.(*find.NotFoundError); !ok {
+			return types.ManagedObjectReference{}, err
+		}
+	}
+	var found []types.ManagedObjectReference
+	for _, network := range networks {
+		if _, ok := network.(*object.DistributedVirtualSwitch); ok {
+			found = append(found, network.Reference())
+		}
+	}
+	switch len(found) {
+	case 0:
+		return types.ManagedObjectReference{}, fmt.Errorf("[FATAL] Distributed switch %s not found", name)
+	case 1:
+		return found[0], nil
+	}
+	return types.ManagedObjectReference{}, fmt.Errorf("[FATAL] Distributed switch %s is ambiguous, %d switches have that name. Please reference it by inventory path", name, len(found))
+}
+
+func networkPath(network object.NetworkReference) string {
+	switch n := network.(type) {
+	case *object.Network:
+		return n.InventoryPath
+	case *object.OpaqueNetwork:
+		return n.InventoryPath
+	case *object.DistributedVirtualPortgroup:
+		return n.InventoryPath
+	}
+	return network.Reference().Value
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package govmomi
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+)
+
+func TestFindNetwork(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	p := newSimulatorProvisioner()
+	session, err := p.sessionFromProviderConfig(newSimulatorCluster(s), newSimulatorMachine(newSimulatorMachineSpec(vm, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	dc, err := session.finder.DefaultDatacenter(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.finder.SetDatacenter(dc)
+	folders, err := dc.Folders(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second distributed switch with a port group of the same name in
+	// another network folder
+	pg, err := session.finder.Network(ctx, "DC0_DVPG0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder, err := folders.NetworkFolder.CreateFolder(ctx, "net2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task, err := folder.CreateDVS(ctx, types.DVSCreateSpec{ConfigSpec: &types.VMwareDVSConfigSpec{
+		DVSConfigSpec: types.DVSConfigSpec{Name: "DVS1"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := task.WaitForResult(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dvs := object.NewDistributedVirtualSwitch(session.session.Client, info.Result.(types.ManagedObjectReference))
+	task, err = dvs.AddPortgroup(ctx, []types.DVPortgroupConfigSpec{{Name: "DC0_DVPG0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	pg1, err := session.finder.Network(ctx, "/DC0/network/net2/DC0_DVPG0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An opaque network in a network folder
+	networkFolder := simulator.Map.Get(folder.Reference()).(*simulator.Folder)
+	opaque := &mo.OpaqueNetwork{}
+	opaque.Name = "nsx-segment"
+	opaque.Summary = &types.OpaqueNetworkSummary{
+		NetworkSummary:    types.NetworkSummary{Name: opaque.Name, Accessible: true},
+		OpaqueNetworkId:   "b4f5b1a2-nsx",
+		OpaqueNetworkType: "nsx.LogicalSwitch",
+	}
+	simulator.Map.PutEntity(networkFolder, opaque)
+	networkFolder.ChildEntity = append(networkFolder.ChildEntity, opaque.Reference())
+
+	if _, err = findNetwork(ctx, session, vsphereconfigv1.NetworkSpec{NetworkName: "DC0_DVPG0"}); err == nil ||
+		!strings.Contains(err.Error(), pg.Reference().Value) || !strings.Contains(err.Error(), pg1.Reference().Value) {
+		t.Errorf("expected an ambiguity error listing both port groups, got %v", err)
+	}
+	if _, err = findNetwork(ctx, session, vsphereconfigv1.NetworkSpec{NetworkName: "missing"}); err == nil {
+		t.Error("expected an unknown network to fail")
+	}
+
+	tests := []struct {
+		name     string
+		network  vsphereconfigv1.NetworkSpec
+		expected types.ManagedObjectReference
+	}{
+		{
+			name:     "inventory path",
+			network:  vsphereconfigv1.NetworkSpec{NetworkName: "/DC0/network/net2/DC0_DVPG0"},
+			expected: pg1.Reference(),
+		},
+		{
+			name:     "distributed switch",
+			network:  vsphereconfigv1.NetworkSpec{NetworkName: "DC0_DVPG0", DistributedSwitch: "DVS1"},
+			expected: pg1.Reference(),
+		},
+		{
+			name:     "port group key",
+			network:  vsphereconfigv1.NetworkSpec{PortGroupKey: pg.Reference().Value},
+			expected: pg.Reference(),
+		},
+		{
+			name:     "port group key in a network folder",
+			network:  vsphereconfigv1.NetworkSpec{PortGroupKey: pg1.Reference().Value},
+			expected: pg1.Reference(),
+		},
+		{
+			name:     "opaque network ID",
+			network:  vsphereconfigv1.NetworkSpec{OpaqueNetworkID: "b4f5b1a2-nsx"},
+			expected: opaque.Reference(),
+		},
+	}
+	for _, tt := range tests {
+		network, err := findNetwork(ctx, session, tt.network)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if network.Reference() != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.expected, network.Reference())
+		}
+	}
+
+	// Each network type gets its own backing
+	network, err := findNetwork(ctx, session, vsphereconfigv1.NetworkSpec{PortGroupKey: pg1.Reference().Value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backing, err := network.EthernetCardBackingInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port, ok := backing.(*types.VirtualEthernetCardDistributedVirtualPortBackingInfo); !ok || port.Port.PortgroupKey != pg1.Reference().Value {
+		t.Errorf("unexpected port group backing %+v", backing)
+	}
+	network, err = findNetwork(ctx, session, vsphereconfigv1.NetworkSpec{OpaqueNetworkID: "b4f5b1a2-nsx"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backing, err = network.EthernetCardBackingInfo(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if opaque, ok := backing.(*types.VirtualEthernetCardOpaqueNetworkBackingInfo); !ok || opaque.OpaqueNetworkId != "b4f5b1a2-nsx" {
+		t.Errorf("unexpected opaque network backing %+v", backing)
+	}
+}
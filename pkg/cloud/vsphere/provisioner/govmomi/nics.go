@@ -0,0 +1,115 @@
+package govmomi
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/klog"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+)
+
+// getNICSpecs returns the device changes replacing the NICs of the template
+// with the ones of the networks of the machine spec, along with the status of
+// the new NICs. The NICs are added in the order of the networks, with
+// increasing temporary keys so that vSphere keeps that order.
+func getNICSpecs(ctx context.Context, s *SessionContext, devices object.VirtualDeviceList,
+	networks []vsphereconfigv1.NetworkSpec) ([]types.BaseVirtualDeviceConfigSpec, []vsphereconfigv1.NetworkStatus, error) {
+	deviceSpecs := []types.BaseVirtualDeviceConfigSpec{}
+	// Remove any existing nics on the source vm
+	for _, dev := range devices.SelectByType((*types.VirtualEthernetCard)(nil)) {
+		deviceSpecs = append(deviceSpecs, &types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationRemove,
+			Device:    dev,
+		})
+	}
+	// Add new nics based on the user info
+	statuses := []vsphereconfigv1.NetworkStatus{}
+	nicid := int32(-100)
+	for i, network := range networks {
+		netRef, err := findNetwork(ctx, s, network)
+		if err != nil {
+			return nil, nil, err
+		}
+		backing, err := netRef.EthernetCardBackingInfo(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		nic, err := newNIC(i, network, backing)
+		if err != nil {
+			return nil, nil, err
+		}
+		nic.GetVirtualDevice().Key = nicid
+		deviceSpecs = append(deviceSpecs, &types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationAdd,
+			Device:    nic,
+		})
+		networkName := network.NetworkName
+		if networkName == "" {
+			networkName = networkPath(netRef)
+		}
+		klog.V(4).Infof("[cloneVirtualMachine] Adding a %s NIC on network %s", deviceType(network), networkName)
+		statuses = append(statuses, vsphereconfigv1.NetworkStatus{
+			NetworkName: networkName,
+			DeviceType:  deviceType(network),
+			MACAddress:  network.MACAddress,
+		})
+		nicid--
+	}
+	return deviceSpecs, statuses, nil
+}
+
+// newNIC returns a NIC of the device type of the network, with the manual MAC
+// address of the network if set.
+func newNIC(index int, network vsphereconfigv1.NetworkSpec, backing types.BaseVirtualDeviceBackingInfo) (types.BaseVirtualDevice, error) {
+	switch deviceType(network) {
+	case vsphereconfigv1.Vmxnet3NetworkDevice, vsphereconfigv1.Vmxnet2NetworkDevice,
+		vsphereconfigv1.E1000NetworkDevice, vsphereconfigv1.E1000eNetworkDevice:
+	default:
+		return nil, fmt.Errorf("[FATAL] Unknown deviceType %q for network %d in the machineSpec", network.DeviceType, index)
+	}
+	nic, err := object.VirtualDeviceList{}.CreateEthernetCard(string(deviceType(network)), backing)
+	if err != nil {
+		return nil, err
+	}
+	if network.MACAddress != "" {
+		mac, err := net.ParseMAC(network.MACAddress)
+		if err != nil || len(mac) != 6 {
+			return nil, fmt.Errorf("[FATAL] Invalid macAddress %q for network %d in the machineSpec", network.MACAddress, index)
+		}
+		if mac[0]&1 == 1 {
+			return nil, fmt.Errorf("[FATAL] macAddress %q for network %d in the machineSpec is a multicast address", network.MACAddress, index)
+		}
+		card := nic.(types.BaseVirtualEthernetCard).GetVirtualEthernetCard()
+		card.AddressType = string(types.VirtualEthernetCardMacTypeManual)
+		card.MacAddress = mac.String()
+	}
+	return nic, nil
+}
+
+func deviceType(network vsphereconfigv1.NetworkSpec) vsphereconfigv1.NetworkDeviceType {
+	if network.DeviceType == "" {
+		return vsphereconfigv1.Vmxnet3NetworkDevice
+	}
+	return network.DeviceType
+}
+
+// getMACAddresses returns the MAC addresses of the NICs of the VM, in the
+// order of the NICs.
+func getMACAddresses(ctx context.Context, s *SessionContext, vmref types.ManagedObjectReference) ([]string, error) {
+	var vm mo.VirtualMachine
+	if err := s.session.RetrieveOne(ctx, vmref, []string{"config.hardware.device"}, &vm); err != nil {
+		return nil, err
+	}
+	if vm.Config == nil {
+		return nil, fmt.Errorf("VM %s has no config", vmref.Value)
+	}
+	macs := []string{}
+	for _, dev := range object.VirtualDeviceList(vm.Config.Hardware.Device).SelectByType((*types.VirtualEthernetCard)(nil)) {
+		macs = append(macs, dev.(types.BaseVirtualEthernetCard).GetVirtualEthernetCard().MacAddress)
+	}
+	return macs, nil
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package govmomi
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"testing"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+)
+
+func TestNewNIC(t *testing.T) {
+	backing := &types.VirtualEthernetCardNetworkBackingInfo{}
+	tests := []struct {
+		network vsphereconfigv1.NetworkSpec
+		wantErr bool
+	}{
+		{network: vsphereconfigv1.NetworkSpec{}},
+		{network: vsphereconfigv1.NetworkSpec{DeviceType: vsphereconfigv1.E1000NetworkDevice, MACAddress: "00:50:56:00:00:01"}},
+		{network: vsphereconfigv1.NetworkSpec{DeviceType: "pcnet32"}, wantErr: true},
+		{network: vsphereconfigv1.NetworkSpec{MACAddress: "00:50:56"}, wantErr: true},
+		{network: vsphereconfigv1.NetworkSpec{MACAddress: "01:00:5e:00:00:01"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if _, err := newNIC(0, tt.network, backing); (err != nil) != tt.wantErr {
+			t.Errorf("%+v: expected error %t, got %v", tt.network, tt.wantErr, err)
+		}
+	}
+}
+
+func TestCreateWithNICs(t *testing.T) {
+	model := simulator.VPX()
+	model.Host = 0 // ClusterHost only
+
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	cluster := newSimulatorCluster(s)
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	machineSpec := newSimulatorMachineSpec(vm, nil)
+	machineSpec.Networks = append(machineSpec.Networks, vsphereconfigv1.NetworkSpec{
+		NetworkName: "DC0_DVPG0",
+		DeviceType:  vsphereconfigv1.E1000eNetworkDevice,
+		MACAddress:  "00:50:56:3f:00:01",
+	})
+	machine := newSimulatorMachine(machineSpec)
+	machine.Namespace = "default"
+
+	client := newSimulatorMachineClient(machine)
+	p := newSimulatorProvisioner()
+	p.eventRecorder = record.NewFakeRecorder(10)
+	p.clusterV1alpha1 = client
+
+	if err = p.Create(context.Background(), cluster, machine); err != nil {
+		t.Fatal(err)
+	}
+	clone := findSimulatorVM(machine.Name)
+	if clone == nil {
+		t.Fatal("failed to clone vm")
+	}
+	nics := object.VirtualDeviceList(clone.Config.Hardware.Device).SelectByType((*types.VirtualEthernetCard)(nil))
+	if len(nics) != 2 {
+		t.Fatalf("expected 2 NICs on the clone, found %d", len(nics))
+	}
+	if _, ok := nics[0].(*types.VirtualVmxnet3); !ok {
+		t.Errorf("expected the first NIC to be a vmxnet3 device, found %T", nics[0])
+	}
+	e1000e, ok := nics[1].(*types.VirtualE1000e)
+	if !ok {
+		t.Fatalf("expected the second NIC to be an e1000e device, found %T", nics[1])
+	}
+	if e1000e.AddressType != string(types.VirtualEthernetCardMacTypeManual) || e1000e.MacAddress != "00:50:56:3f:00:01" {
+		t.Errorf("expected the second NIC to have the manual MAC address, found %s %s", e1000e.AddressType, e1000e.MacAddress)
+	}
+
+	// The MAC addresses are reported once the clone task is done
+	if machine, err = client.Machines(machine.Namespace).Get(machine.Name, metav1.GetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	session, err := p.sessionFromProviderConfig(cluster, machine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.verifyAndUpdateTask(session, cluster, machine, vsphereutils.GetActiveTasks(machine)); err != nil {
+		t.Fatal(err)
+	}
+	if machine, err = client.Machines(machine.Namespace).Get(machine.Name, metav1.GetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	status, err := vsphereutils.GetMachineProviderStatus(machine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Networks) != 2 {
+		t.Fatalf("expected the status of 2 networks, found %+v", status.Networks)
+	}
+	if network := status.Networks[1]; network.NetworkName != "DC0_DVPG0" || network.DeviceType != vsphereconfigv1.E1000eNetworkDevice || network.MACAddress != "00:50:56:3f:00:01" {
+		t.Errorf("unexpected network status %+v", network)
+	}
+}
@@ -0,0 +1,193 @@
+package govmomi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+// CollectOrphanedVMs looks for the VMs of the cluster whose instance UUID is
+// the UID of none of the machines, e.g. the clones which completed after their
+// Machine was deleted. The orphaned VMs are reported by events and in the
+// provider status of the cluster, and destroyed once orphaned for the grace
+// period of the orphaned VM policy of the cluster, if any.
+func (pv *Provisioner) CollectOrphanedVMs(cluster *clusterv1.Cluster, machineUIDs map[string]bool) error {
+	clusterConfig, err := vsphereutils.GetClusterProviderSpec(cluster.Spec.ProviderSpec)
+	if err != nil {
+		return err
+	}
+	status, err := vsphereutils.GetClusterProviderStatus(cluster)
+	if err != nil {
+		return err
+	}
+	if status == nil {
+		status = &vsphereconfigv1.VsphereClusterProviderStatus{}
+	}
+	s, err := pv.sessionFromProviderConfig(cluster, nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(*s.context)
+	defer cancel()
+
+	// The VMs of every datacenter, the session finder being bound to the
+	// datacenter of a machine
+	vmos, err := find.NewFinder(s.session.Client, false).VirtualMachineList(ctx, "/...")
+	if err != nil {
+		if _, ok := err.(*find.NotFoundError); !ok {
+			return err
+		}
+	}
+	var vms []mo.VirtualMachine
+	if len(vmos) > 0 {
+		vmrefs := make([]types.ManagedObjectReference, 0, len(vmos))
+		for _, vmo := range vmos {
+			vmrefs = append(vmrefs, vmo.Reference())
+		}
+		if err := s.session.Retrieve(ctx, vmrefs, append([]string{"name", "config.template", "runtime.powerState"}, ownershipProperties...), &vms); err != nil {
+			return err
+		}
+	}
+
+	var candidates []*mo.VirtualMachine
+	for i := range vms {
+		vm := &vms[i]
+		if vm.Config == nil || vm.Config.Template || machineUIDs[vm.Config.InstanceUuid] {
+			continue
+		}
+		if verifyClusterOwnership(cluster, vm) != nil {
+			continue
+		}
+		candidates = append(candidates, vm)
+	}
+	confirmed := pv.confirmOrphanedVMs(ctx, s, cluster, candidates)
+
+	detected := make(map[string]vsphereconfigv1.OrphanedVM)
+	for _, orphan := range status.OrphanedVMs {
+		detected[orphan.MachineRef] = orphan
+	}
+	var orphans []vsphereconfigv1.OrphanedVM
+	for _, vm := range candidates {
+		orphan, ok := detected[vm.Reference().Value]
+		if !ok || orphan.InstanceUUID != vm.Config.InstanceUuid {
+			orphan = vsphereconfigv1.OrphanedVM{
+				Name:         vm.Name,
+				MachineRef:   vm.Reference().Value,
+				InstanceUUID: vm.Config.InstanceUuid,
+				DetectedAt:   metav1.Now(),
+			}
+			if confirmed[vm.Reference()] {
+				klog.Warningf("Found the VM %s of cluster %s which belongs to no Machine", vm.Name, cluster.Name)
+				pv.eventRecorder.Eventf(cluster, corev1.EventTypeWarning, "OrphanedVM", "VM %s (%s) belongs to no Machine", vm.Name, orphan.MachineRef)
+			} else {
+				klog.Warningf("Found the VM %s annotated as part of cluster %s which belongs to no Machine", vm.Name, cluster.Name)
+				pv.eventRecorder.Eventf(cluster, corev1.EventTypeWarning, "OrphanedVM",
+					"VM %s (%s) belongs to no Machine, it is only annotated as part of the cluster thus never destroyed", vm.Name, orphan.MachineRef)
+			}
+		}
+		if clusterConfig.OrphanedVMPolicy != nil && confirmed[vm.Reference()] && time.Since(orphan.DetectedAt.Time) >= clusterConfig.OrphanedVMPolicy.GracePeriod.Duration {
+			if err := destroyOrphanedVM(ctx, s, vm); err != nil {
+				klog.Warningf("Error destroying the orphaned VM %s of cluster %s: %s", vm.Name, cluster.Name, err)
+				pv.eventRecorder.Eventf(cluster, corev1.EventTypeWarning, "FailedOrphanedVMDeletion", "Error destroying the orphaned VM %s (%s): %s", vm.Name, orphan.MachineRef, err)
+			} else {
+				klog.Infof("Destroyed the orphaned VM %s of cluster %s", vm.Name, cluster.Name)
+				pv.eventRecorder.Eventf(cluster, corev1.EventTypeNormal, "OrphanedVMDeleted", "Destroyed the orphaned VM %s (%s)", vm.Name, orphan.MachineRef)
+				continue
+			}
+		}
+		orphans = append(orphans, orphan)
+	}
+	if reflect.DeepEqual(orphans, status.OrphanedVMs) {
+		return nil
+	}
+	status.OrphanedVMs = orphans
+	out, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	ncluster := cluster.DeepCopy()
+	ncluster.Status.ProviderStatus = &runtime.RawExtension{Raw: out}
+	if _, err := pv.clusterV1alpha1.Clusters(ncluster.Namespace).UpdateStatus(ncluster); err != nil {
+		return fmt.Errorf("error updating the orphaned VMs of cluster %s: %s", cluster.Name, err)
+	}
+	return nil
+}
+
+// confirmOrphanedVMs returns the orphaned VMs confirmed to belong to the
+// cluster, which are the only ones that may be destroyed. The ownership is
+// confirmed by the custom attributes of the VM naming the cluster and its
+// namespace, or else by the tag of the cluster attached to the VM. The VMs
+// which are only annotated as part of the cluster are not confirmed, as the
+// annotation does not name the namespace of the cluster.
+func (pv *Provisioner) confirmOrphanedVMs(ctx context.Context, s *SessionContext, cluster *clusterv1.Cluster, vms []*mo.VirtualMachine) map[types.ManagedObjectReference]bool {
+	confirmed := make(map[types.ManagedObjectReference]bool)
+	var unconfirmed []*mo.VirtualMachine
+	for _, vm := range vms {
+		if confirmedClusterOwnership(cluster, vm) {
+			confirmed[vm.Reference()] = true
+		} else {
+			unconfirmed = append(unconfirmed, vm)
+		}
+	}
+	if len(unconfirmed) == 0 {
+		return confirmed
+	}
+	err := pv.withRestClient(ctx, s, cluster, func(rc *rest.Client) error {
+		m := tags.NewManager(rc)
+		tagID, err := findClusterTag(ctx, m, cluster)
+		if err != nil || tagID == "" {
+			return err
+		}
+		for _, vm := range unconfirmed {
+			tagIDs, err := m.ListAttachedTags(ctx, vm.Reference())
+			if err != nil {
+				return err
+			}
+			for _, id := range tagIDs {
+				if id == tagID {
+					confirmed[vm.Reference()] = true
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		klog.Warningf("Error checking the tags of the orphaned VMs of cluster %s: %s", cluster.Name, err)
+	}
+	return confirmed
+}
+
+// destroyOrphanedVM powers off and destroys the orphaned VM.
+func destroyOrphanedVM(ctx context.Context, s *SessionContext, vm *mo.VirtualMachine) error {
+	vmo := object.NewVirtualMachine(s.session.Client, vm.Reference())
+	if vm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn {
+		task, err := vmo.PowerOff(ctx)
+		if err != nil {
+			return err
+		}
+		if err := task.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	task, err := vmo.Destroy(ctx)
+	if err != nil {
+		return err
+	}
+	return task.Wait(ctx)
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package govmomi
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	vapi "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	clusterv1alpha1 "sigs.k8s.io/cluster-api/pkg/client/clientset_generated/clientset/typed/cluster/v1alpha1"
+)
+
+// simulatorClusterClient is a client storing a single Cluster in memory, for
+// the tests to follow the updates of the Cluster status.
+type simulatorClusterClient struct {
+	clusterv1alpha1.ClusterV1alpha1Interface
+	clusterv1alpha1.ClusterInterface
+	cluster *clusterv1.Cluster
+}
+
+func (c *simulatorClusterClient) Clusters(namespace string) clusterv1alpha1.ClusterInterface {
+	return c
+}
+
+func (c *simulatorClusterClient) UpdateStatus(cluster *clusterv1.Cluster) (*clusterv1.Cluster, error) {
+	c.cluster.Status = cluster.Status
+	return c.cluster.DeepCopy(), nil
+}
+
+func TestCollectOrphanedVMs(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+	model.Service.Handle(vapi.New(s.URL, simulator.Map.OptionManager().Setting))
+
+	cluster := newSimulatorCluster(s)
+	cluster.Namespace, cluster.Name = "default", "cluster1"
+	vms := simulator.Map.All("VirtualMachine")
+	owned := vms[0].(*simulator.VirtualMachine)
+	owned.Config.Annotation = vmAnnotation(cluster)
+	// The ownership of the orphaned VMs is confirmed by their custom attributes
+	// or by the tag of the cluster, while the annotated VM may belong to a
+	// cluster of another namespace
+	orphaned := vms[1].(*simulator.VirtualMachine)
+	orphaned.Config.Annotation = vmAnnotation(cluster)
+	annotated := vms[2].(*simulator.VirtualMachine)
+	annotated.Config.Annotation = vmAnnotation(cluster)
+	tagged := vms[3].(*simulator.VirtualMachine)
+	tagged.Config.Annotation = vmAnnotation(cluster)
+	machineUIDs := map[string]bool{owned.Config.InstanceUuid: true}
+
+	client := &simulatorClusterClient{cluster: cluster.DeepCopy()}
+	recorder := record.NewFakeRecorder(10)
+	p := newSimulatorProvisioner()
+	p.eventRecorder = recorder
+	p.clusterV1alpha1 = client
+
+	session, err := p.sessionFromProviderConfig(cluster, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := &clusterv1.Machine{}
+	machine.Namespace, machine.Name = cluster.Namespace, "machine1"
+	if err = setCustomAttributes(context.Background(), session, orphaned.Reference(), machineCustomAttributes(cluster, machine)); err != nil {
+		t.Fatal(err)
+	}
+	err = p.withRestClient(context.Background(), session, cluster, func(rc *rest.Client) error {
+		return attachTags(context.Background(), tags.NewManager(rc), tagged.Reference(), machineTags(cluster, machine, &vsphereconfigv1.VsphereMachineSpec{}))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := func() map[string]bool {
+		received := make(map[string]bool)
+		for len(recorder.Events) > 0 {
+			received[<-recorder.Events] = true
+		}
+		return received
+	}
+
+	// The orphaned VMs are only reported without policy
+	if err = p.CollectOrphanedVMs(cluster, machineUIDs); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]bool{
+		fmt.Sprintf("Warning OrphanedVM VM %s (%s) belongs to no Machine", orphaned.Name, orphaned.Reference().Value): true,
+		fmt.Sprintf("Warning OrphanedVM VM %s (%s) belongs to no Machine", tagged.Name, tagged.Reference().Value):     true,
+		fmt.Sprintf("Warning OrphanedVM VM %s (%s) belongs to no Machine, it is only annotated as part of the cluster thus never destroyed",
+			annotated.Name, annotated.Reference().Value): true,
+	}
+	if received := events(); !reflect.DeepEqual(received, expected) {
+		t.Errorf("unexpected events %v", received)
+	}
+	status, err := vsphereutils.GetClusterProviderStatus(client.cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status == nil || len(status.OrphanedVMs) != 3 {
+		t.Fatalf("expected the orphaned VMs in the cluster status, got %+v", status)
+	}
+	if simulator.Map.Get(orphaned.Reference()) == nil {
+		t.Fatal("expected the orphaned VM not to be destroyed without policy")
+	}
+
+	// The orphaned VMs are destroyed once orphaned for the grace period
+	clusterConfig, err := vsphereutils.GetClusterProviderSpec(cluster.Spec.ProviderSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterConfig.OrphanedVMPolicy = &vsphereconfigv1.OrphanedVMPolicy{GracePeriod: metav1.Duration{Duration: time.Hour}}
+	if cluster.Spec.ProviderSpec.Value.Raw, err = json.Marshal(clusterConfig); err != nil {
+		t.Fatal(err)
+	}
+	cluster.Status = client.cluster.Status
+	if err = p.CollectOrphanedVMs(cluster, machineUIDs); err != nil {
+		t.Fatal(err)
+	}
+	if simulator.Map.Get(orphaned.Reference()) == nil {
+		t.Fatal("expected the orphaned VM not to be destroyed within the grace period")
+	}
+
+	for i := range status.OrphanedVMs {
+		status.OrphanedVMs[i].DetectedAt = metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	}
+	raw, err := json.Marshal(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster.Status.ProviderStatus.Raw = raw
+	if err = p.CollectOrphanedVMs(cluster, machineUIDs); err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]bool{
+		fmt.Sprintf("Normal OrphanedVMDeleted Destroyed the orphaned VM %s (%s)", orphaned.Name, orphaned.Reference().Value): true,
+		fmt.Sprintf("Normal OrphanedVMDeleted Destroyed the orphaned VM %s (%s)", tagged.Name, tagged.Reference().Value):     true,
+	}
+	if received := events(); !reflect.DeepEqual(received, expected) {
+		t.Errorf("unexpected events %v", received)
+	}
+	if simulator.Map.Get(orphaned.Reference()) != nil || simulator.Map.Get(tagged.Reference()) != nil {
+		t.Error("expected the orphaned VMs to be destroyed")
+	}
+	if simulator.Map.Get(annotated.Reference()) == nil {
+		t.Error("expected the VM only annotated as part of the cluster to be kept")
+	}
+	if simulator.Map.Get(owned.Reference()) == nil {
+		t.Error("expected the VM of the Machine to be kept")
+	}
+	if status, err = vsphereutils.GetClusterProviderStatus(client.cluster); err != nil || status == nil || len(status.OrphanedVMs) != 1 ||
+		status.OrphanedVMs[0].MachineRef != annotated.Reference().Value {
+		t.Errorf("expected only the annotated VM in the cluster status, got %+v", status)
+	}
+}
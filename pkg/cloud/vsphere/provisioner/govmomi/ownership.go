@@ -0,0 +1,75 @@
+package govmomi
+
+import (
+	"fmt"
+
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+// ownershipProperties are the properties of the VM needed to verify its
+// ownership.
+var ownershipProperties = []string{"config.instanceUuid", "config.annotation", "availableField", "customValue"}
+
+// vmAnnotation returns the annotation set on the VMs of the cluster.
+func vmAnnotation(cluster *clusterv1.Cluster) string {
+	return fmt.Sprintf("Virtual Machine is part of the cluster %s managed by cluster-api", cluster.Name)
+}
+
+// verifyOwnership returns an error unless the VM was cloned for the machine,
+// its instance UUID being the UID of the machine, and belongs to the cluster.
+func verifyOwnership(cluster *clusterv1.Cluster, machine *clusterv1.Machine, vm *mo.VirtualMachine) error {
+	if vm.Config == nil {
+		return fmt.Errorf("the VM %s has no configuration", vm.Name)
+	}
+	if machine.UID == "" || vm.Config.InstanceUuid != string(machine.UID) {
+		return fmt.Errorf("the instance UUID %s of the VM %s is not the UID %s of the Machine", vm.Config.InstanceUuid, vm.Name, machine.UID)
+	}
+	return verifyClusterOwnership(cluster, vm)
+}
+
+// verifyClusterOwnership returns an error unless the VM belongs to the cluster.
+// The cluster of the VM is given by its custom attributes, or by its annotation
+// when it has no custom attributes, e.g. when the VM could not be tagged.
+func verifyClusterOwnership(cluster *clusterv1.Cluster, vm *mo.VirtualMachine) error {
+	if vm.Config == nil {
+		return fmt.Errorf("the VM %s has no configuration", vm.Name)
+	}
+	attributes := vmCustomAttributes(vm)
+	if name, ok := attributes[clusterAttribute]; ok {
+		if namespace, ok := attributes[namespaceAttribute]; name != cluster.Name || (ok && namespace != cluster.Namespace) {
+			return fmt.Errorf("the VM %s belongs to the cluster %s/%s", vm.Name, attributes[namespaceAttribute], name)
+		}
+		return nil
+	}
+	if vm.Config.Annotation != vmAnnotation(cluster) {
+		return fmt.Errorf("the VM %s is not annotated as part of the cluster %s", vm.Name, cluster.Name)
+	}
+	return nil
+}
+
+// confirmedClusterOwnership returns true when the custom attributes of the VM
+// name both the cluster and its namespace. The annotation of a VM only names
+// its cluster, thus does not confirm the ownership.
+func confirmedClusterOwnership(cluster *clusterv1.Cluster, vm *mo.VirtualMachine) bool {
+	attributes := vmCustomAttributes(vm)
+	return attributes[clusterAttribute] == cluster.Name && attributes[namespaceAttribute] == cluster.Namespace
+}
+
+// vmCustomAttributes returns the custom attributes of the VM by name.
+func vmCustomAttributes(vm *mo.VirtualMachine) map[string]string {
+	names := make(map[int32]string)
+	for _, field := range vm.AvailableField {
+		names[field.Key] = field.Name
+	}
+	attributes := make(map[string]string)
+	for _, value := range vm.CustomValue {
+		if value, ok := value.(*types.CustomFieldStringValue); ok {
+			if name, ok := names[value.Key]; ok {
+				attributes[name] = value.Value
+			}
+		}
+	}
+	return attributes
+}
@@ -0,0 +1,61 @@
+package govmomi
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/constants"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	apierrors "sigs.k8s.io/cluster-api/pkg/errors"
+)
+
+const powerOnTask = "VirtualMachine.powerOn"
+
+// reconcilePowerState records the power state of the VM in the provider status
+// of the machine, along with an event when it changed, and powers the VM on
+// again when not powered on and the power policy of the machine is alwaysOn.
+// The power on is tracked via the task reference of the Machine.
+func (pv *Provisioner) reconcilePowerState(ctx context.Context, s *SessionContext, machine *clusterv1.Machine, vm *mo.VirtualMachine) error {
+	machineConfig, err := vsphereutils.GetMachineProviderSpec(machine.Spec.ProviderSpec)
+	if err != nil {
+		return err
+	}
+	status, err := vsphereutils.GetMachineProviderStatus(machine)
+	if err != nil {
+		return err
+	}
+	policy := machineConfig.MachineSpec.PowerPolicy
+	if policy != "" && policy != vsphereconfigv1.PowerPolicyAlwaysOn && policy != vsphereconfigv1.PowerPolicyManual {
+		return pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"invalid power policy %s", policy), constants.UpdateEventAction)
+	}
+	powerState := string(vm.Runtime.PowerState)
+	if status != nil && status.PowerState != "" && status.PowerState != powerState {
+		pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "PowerStateChanged", "Machine %s is %s, was %s", machine.Name, powerState, status.PowerState)
+	}
+	if vm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn || policy == vsphereconfigv1.PowerPolicyManual {
+		if vm.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOn {
+			klog.V(4).Infof("Leaving Machine %s %s as its power policy is %s", machine.Name, powerState, policy)
+		}
+		return pv.updateProviderStatus(machine, func(status *vsphereconfigv1.VsphereMachineProviderStatus) {
+			status.PowerState = powerState
+		})
+	}
+	vmo := object.NewVirtualMachine(s.session.Client, vm.Reference())
+	task, err := vmo.PowerOn(ctx)
+	if err != nil {
+		return fmt.Errorf("error powering on Machine %s: %s", machine.Name, err)
+	}
+	pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "PoweringOn", "Powering on Machine %s as it is %s", machine.Name, powerState)
+	return pv.updateProviderStatus(machine, func(status *vsphereconfigv1.VsphereMachineProviderStatus) {
+		status.TaskRef = task.Reference().Value
+		status.PowerState = powerState
+	})
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package govmomi
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/constants"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+func TestUpdatePowerPolicy(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	c, err := govmomi.NewClient(context.Background(), s.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster := newSimulatorCluster(s)
+	vms := simulator.Map.All("VirtualMachine")
+	newMachine := func(vm *simulator.VirtualMachine, policy vsphereconfigv1.PowerPolicy) *clusterv1.Machine {
+		machineSpec := newSimulatorMachineSpec(vm, nil)
+		machineSpec.NumCPUs = vm.Config.Hardware.NumCPU
+		machineSpec.MemoryMB = int64(vm.Config.Hardware.MemoryMB)
+		machineSpec.PowerPolicy = policy
+		machine := newSimulatorMachine(machineSpec)
+		machine.Namespace = "default"
+		machine.Annotations = map[string]string{constants.VmIpAnnotationKey: "10.0.0.1"}
+		setSimulatorMachineRef(machine, vm.Reference().Value)
+		raw, err := json.Marshal(&vsphereconfigv1.VsphereMachineProviderStatus{PowerState: string(types.VirtualMachinePowerStatePoweredOn)})
+		if err != nil {
+			log.Fatal(err)
+		}
+		machine.Status.ProviderStatus = &runtime.RawExtension{Raw: raw}
+		return machine
+	}
+
+	t.Run("alwaysOn", func(t *testing.T) {
+		vm := vms[0].(*simulator.VirtualMachine)
+		task, err := object.NewVirtualMachine(c.Client, vm.Reference()).PowerOff(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = task.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		machine := newMachine(vm, "")
+		client := newSimulatorMachineClient(machine)
+		recorder := record.NewFakeRecorder(10)
+		p := newSimulatorProvisioner()
+		p.eventRecorder = recorder
+		p.clusterV1alpha1 = client
+
+		if err = p.Update(context.Background(), cluster, machine); err != nil {
+			t.Fatal(err)
+		}
+		for _, expected := range []string{
+			"Normal PowerStateChanged Machine machine1 is poweredOff, was poweredOn",
+			"Normal PoweringOn Powering on Machine machine1 as it is poweredOff",
+		} {
+			if event := <-recorder.Events; event != expected {
+				t.Errorf("unexpected event %q", event)
+			}
+		}
+		if machine, err = client.Machines(machine.Namespace).Get(machine.Name, metav1.GetOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if vsphereutils.GetActiveTasks(machine) == "" {
+			t.Fatal("expected the power on to be tracked")
+		}
+
+		if err = p.Update(context.Background(), cluster, machine); err != nil {
+			t.Fatal(err)
+		}
+		if event := <-recorder.Events; event != "Normal PoweredOn Powered on Machine machine1" {
+			t.Errorf("unexpected event %q", event)
+		}
+		if machine, err = client.Machines(machine.Namespace).Get(machine.Name, metav1.GetOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		status, err := vsphereutils.GetMachineProviderStatus(machine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.TaskRef != "" || status.PowerState != string(types.VirtualMachinePowerStatePoweredOn) {
+			t.Errorf("unexpected provider status %+v", status)
+		}
+		if vm.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOn {
+			t.Errorf("expected the VM to be powered on, got %s", vm.Runtime.PowerState)
+		}
+	})
+
+	t.Run("manual", func(t *testing.T) {
+		vm := vms[1].(*simulator.VirtualMachine)
+		task, err := object.NewVirtualMachine(c.Client, vm.Reference()).Suspend(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = task.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		machine := newMachine(vm, vsphereconfigv1.PowerPolicyManual)
+		client := newSimulatorMachineClient(machine)
+		recorder := record.NewFakeRecorder(10)
+		p := newSimulatorProvisioner()
+		p.eventRecorder = recorder
+		p.clusterV1alpha1 = client
+
+		if err = p.Update(context.Background(), cluster, machine); err != nil {
+			t.Fatal(err)
+		}
+		if event := <-recorder.Events; event != "Normal PowerStateChanged Machine machine1 is suspended, was poweredOn" {
+			t.Errorf("unexpected event %q", event)
+		}
+		if machine, err = client.Machines(machine.Namespace).Get(machine.Name, metav1.GetOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		status, err := vsphereutils.GetMachineProviderStatus(machine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.TaskRef != "" || status.PowerState != string(types.VirtualMachinePowerStateSuspended) {
+			t.Errorf("unexpected provider status %+v", status)
+		}
+		if vm.Runtime.PowerState != types.VirtualMachinePowerStateSuspended {
+			t.Errorf("expected the VM to be left suspended, got %s", vm.Runtime.PowerState)
+		}
+	})
+}
@@ -1,10 +1,13 @@
 package govmomi
 
 import (
+	"sync"
+
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/record"
 	clusterv1alpha1 "sigs.k8s.io/cluster-api/pkg/client/clientset_generated/clientset/typed/cluster/v1alpha1"
 	"sigs.k8s.io/cluster-api/pkg/client/informers_generated/externalversions/cluster/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type Provisioner struct {
@@ -13,14 +16,25 @@ type Provisioner struct {
 	eventRecorder   record.EventRecorder
 	sessioncache    map[string]interface{}
 	k8sClient       kubernetes.Interface
+	// controllerClient reads and updates the VsphereIPPools, the allocations
+	// are serialized by ipPoolMutex
+	controllerClient client.Client
+	ipPoolMutex      sync.Mutex
+	// libraryImports are the imports of content library items running in the
+	// background, keyed by the inventory path of the template and guarded by
+	// libraryImportsMutex
+	libraryImports      map[string]*libraryImport
+	libraryImportsMutex sync.Mutex
 }
 
-func New(clusterV1alpha1 clusterv1alpha1.ClusterV1alpha1Interface, k8sClient kubernetes.Interface, lister v1alpha1.Interface, eventRecorder record.EventRecorder) (*Provisioner, error) {
+func New(clusterV1alpha1 clusterv1alpha1.ClusterV1alpha1Interface, k8sClient kubernetes.Interface, lister v1alpha1.Interface, eventRecorder record.EventRecorder,
+	controllerClient client.Client) (*Provisioner, error) {
 	return &Provisioner{
-		clusterV1alpha1: clusterV1alpha1,
-		lister:          lister,
-		eventRecorder:   eventRecorder,
-		sessioncache:    make(map[string]interface{}),
-		k8sClient:       k8sClient,
+		clusterV1alpha1:  clusterV1alpha1,
+		lister:           lister,
+		eventRecorder:    eventRecorder,
+		sessioncache:     make(map[string]interface{}),
+		k8sClient:        k8sClient,
+		controllerClient: controllerClient,
 	}, nil
 }
@@ -0,0 +1,170 @@
+package govmomi
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/constants"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	apierrors "sigs.k8s.io/cluster-api/pkg/errors"
+)
+
+const reconfigureTask = "VirtualMachine.reconfigure"
+
+// resize reconfigures the VM in case the CPUs, the memory or the disk sizes of
+// the machine spec differ from the actual hardware of the VM. Changes which
+// cannot be hot-added require the VM to be powered off. The VM is only powered
+// off when the Machine has the AllowPowerCycleAnnotationKey annotation set to
+// true, and it is then powered on again once reconfigured. True is returned
+// when a task was started, which is then tracked via the task reference of the
+// Machine.
+func (pv *Provisioner) resize(ctx context.Context, s *SessionContext, machine *clusterv1.Machine, vm *mo.VirtualMachine) (bool, error) {
+	machineConfig, err := vsphereutils.GetMachineProviderSpec(machine.Spec.ProviderSpec)
+	if err != nil {
+		return false, err
+	}
+	status, err := vsphereutils.GetMachineProviderStatus(machine)
+	if err != nil {
+		return false, err
+	}
+	spec, hot, err := getResizeSpec(&machineConfig.MachineSpec, vm)
+	if err != nil {
+		return false, pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"invalid resize of Machine %s: %v", machine.Name, err), constants.UpdateEventAction)
+	}
+	vmo := object.NewVirtualMachine(s.session.Client, vm.Reference())
+	poweredOn := vm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn
+	switch {
+	case spec == nil:
+		if poweredOn || status == nil || !status.PowerCycle {
+			return false, nil
+		}
+		// The VM was powered off for being resized, thus power it on again
+		task, err := vmo.PowerOn(ctx)
+		if err != nil {
+			return false, err
+		}
+		pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "PoweringOn", "Powering on Machine %s after the resize", machine.Name)
+		return true, pv.updateProviderStatus(machine, func(status *vsphereconfigv1.VsphereMachineProviderStatus) {
+			status.TaskRef = task.Reference().Value
+			status.PowerCycle = false
+		})
+	case hot || !poweredOn:
+		klog.V(4).Infof("Reconfiguring the VM %s of Machine %s", vm.Name, machine.Name)
+		task, err := vmo.Reconfigure(ctx, *spec)
+		if err != nil {
+			return false, err
+		}
+		pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Resizing", "Resizing Machine %s", machine.Name)
+		return true, pv.setTaskRef(machine, task.Reference().Value)
+	case machine.Annotations[constants.AllowPowerCycleAnnotationKey] == "true":
+		task, err := vmo.PowerOff(ctx)
+		if err != nil {
+			return false, err
+		}
+		pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "PoweringOff", "Powering off Machine %s for the resize", machine.Name)
+		return true, pv.updateProviderStatus(machine, func(status *vsphereconfigv1.VsphereMachineProviderStatus) {
+			status.TaskRef = task.Reference().Value
+			status.PowerCycle = true
+		})
+	default:
+		pv.eventRecorder.Eventf(machine, corev1.EventTypeWarning, "ResizePending",
+			"Machine %s can only be resized while powered off, set the %s annotation to true to allow powering it off", machine.Name, constants.AllowPowerCycleAnnotationKey)
+		return false, nil
+	}
+}
+
+// getResizeSpec returns the config spec for resizing the VM to the machine
+// spec, and whether the changes can be applied while the VM is powered on. A
+// nil spec is returned when the VM already matches the machine spec.
+func getResizeSpec(machineSpec *vsphereconfigv1.VsphereMachineSpec, vm *mo.VirtualMachine) (*types.VirtualMachineConfigSpec, bool, error) {
+	if vm.Config == nil {
+		return nil, false, fmt.Errorf("VM %s has no config", vm.Name)
+	}
+	hardware := vm.Config.Hardware
+	spec := &types.VirtualMachineConfigSpec{}
+	changed, hot := false, true
+	numCPUs := hardware.NumCPU
+	if machineSpec.NumCPUs > 0 && machineSpec.NumCPUs != hardware.NumCPU {
+		numCPUs = machineSpec.NumCPUs
+		spec.NumCPUs = numCPUs
+		changed = true
+		if numCPUs > hardware.NumCPU {
+			hot = hot && isTrue(vm.Config.CpuHotAddEnabled)
+		} else {
+			hot = hot && isTrue(vm.Config.CpuHotRemoveEnabled)
+		}
+	}
+	if machineSpec.NumCoresPerSocket > 0 {
+		if numCPUs%machineSpec.NumCoresPerSocket != 0 {
+			return nil, false, fmt.Errorf("numCPUs %d is not a multiple of numCoresPerSocket %d", numCPUs, machineSpec.NumCoresPerSocket)
+		}
+		if machineSpec.NumCoresPerSocket != hardware.NumCoresPerSocket {
+			spec.NumCoresPerSocket = machineSpec.NumCoresPerSocket
+			changed, hot = true, false
+		}
+	}
+	if machineSpec.MemoryMB > 0 && machineSpec.MemoryMB != int64(hardware.MemoryMB) {
+		spec.MemoryMB = machineSpec.MemoryMB
+		changed = true
+		if machineSpec.MemoryMB < int64(hardware.MemoryMB) {
+			hot = false
+		} else {
+			hot = hot && isTrue(vm.Config.MemoryHotAddEnabled)
+		}
+	}
+	// Disks can be extended while the VM is running, but never shrunk
+	devices := object.VirtualDeviceList(hardware.Device)
+	for _, diskSpec := range machineSpec.Disks {
+		if diskSpec.DiskLabel == "" {
+			continue
+		}
+		disk := findDiskByLabel(devices, diskSpec.DiskLabel)
+		if disk == nil {
+			return nil, false, fmt.Errorf("disk %q not found on the VM", diskSpec.DiskLabel)
+		}
+		size := vsphereutils.GiBToByte(diskSpec.DiskSizeGB)
+		if size == disk.CapacityInBytes {
+			continue
+		}
+		if size < disk.CapacityInBytes {
+			return nil, false, fmt.Errorf("disk %q cannot be shrunk to %dGB", diskSpec.DiskLabel, diskSpec.DiskSizeGB)
+		}
+		disk.CapacityInBytes = size
+		disk.CapacityInKB = size / 1024
+		spec.DeviceChange = append(spec.DeviceChange, &types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationEdit,
+			Device:    disk,
+		})
+		changed = true
+	}
+	if !changed {
+		return nil, false, nil
+	}
+	return spec, hot, nil
+}
+
+func findDiskByLabel(devices object.VirtualDeviceList, label string) *types.VirtualDisk {
+	for _, dev := range devices.SelectByType((*types.VirtualDisk)(nil)) {
+		disk := dev.(*types.VirtualDisk)
+		if disk.DeviceInfo != nil && disk.DeviceInfo.GetDescription().Label == label {
+			return disk
+		}
+	}
+	return nil
+}
+
+// taskError returns the message of the error of a failed task.
+func taskError(info types.TaskInfo) string {
+	if info.Error == nil {
+		return "unknown error"
+	}
+	return info.Error.LocalizedMessage
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package govmomi
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/constants"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	clusterv1alpha1 "sigs.k8s.io/cluster-api/pkg/client/clientset_generated/clientset/typed/cluster/v1alpha1"
+	clustererror "sigs.k8s.io/cluster-api/pkg/controller/error"
+)
+
+func TestGetResizeSpec(t *testing.T) {
+	vm := &mo.VirtualMachine{
+		Config: &types.VirtualMachineConfigInfo{
+			CpuHotAddEnabled: types.NewBool(true),
+			Hardware: types.VirtualHardware{
+				NumCPU:            2,
+				NumCoresPerSocket: 1,
+				MemoryMB:          2048,
+				Device: []types.BaseVirtualDevice{
+					&types.VirtualDisk{
+						VirtualDevice: types.VirtualDevice{
+							Key:        2000,
+							DeviceInfo: &types.Description{Label: "Hard disk 1"},
+						},
+						CapacityInBytes: vsphereutils.GiBToByte(10),
+					},
+				},
+			},
+		},
+	}
+	tests := []struct {
+		name    string
+		spec    vsphereconfigv1.VsphereMachineSpec
+		changed bool
+		hot     bool
+		wantErr bool
+	}{
+		{
+			name: "unchanged",
+			spec: vsphereconfigv1.VsphereMachineSpec{NumCPUs: 2, MemoryMB: 2048},
+		},
+		{
+			name:    "CPU hot-add",
+			spec:    vsphereconfigv1.VsphereMachineSpec{NumCPUs: 4, MemoryMB: 2048},
+			changed: true,
+			hot:     true,
+		},
+		{
+			name:    "CPU removal",
+			spec:    vsphereconfigv1.VsphereMachineSpec{NumCPUs: 1},
+			changed: true,
+		},
+		{
+			name:    "memory without hot-add",
+			spec:    vsphereconfigv1.VsphereMachineSpec{MemoryMB: 4096},
+			changed: true,
+		},
+		{
+			name: "disk extension",
+			spec: vsphereconfigv1.VsphereMachineSpec{
+				Disks: []vsphereconfigv1.DiskSpec{{DiskLabel: "Hard disk 1", DiskSizeGB: 20}},
+			},
+			changed: true,
+			hot:     true,
+		},
+		{
+			name: "disk shrink",
+			spec: vsphereconfigv1.VsphereMachineSpec{
+				Disks: []vsphereconfigv1.DiskSpec{{DiskLabel: "Hard disk 1", DiskSizeGB: 5}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown disk",
+			spec: vsphereconfigv1.VsphereMachineSpec{
+				Disks: []vsphereconfigv1.DiskSpec{{DiskLabel: "Hard disk 2", DiskSizeGB: 20}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		spec, hot, err := getResizeSpec(&tt.spec, vm)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %t, got %v", tt.name, tt.wantErr, err)
+			continue
+		}
+		if (spec != nil) != tt.changed || hot != tt.hot {
+			t.Errorf("%s: expected changed %t and hot %t, got %+v and %t", tt.name, tt.changed, tt.hot, spec, hot)
+		}
+	}
+}
+
+func TestUpdateResize(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	cluster := newSimulatorCluster(s)
+	machineSpec := newSimulatorMachineSpec(vm, nil)
+	machineSpec.NumCPUs = vm.Config.Hardware.NumCPU
+	machineSpec.MemoryMB = int64(vm.Config.Hardware.MemoryMB) * 2
+	machine := newSimulatorMachine(machineSpec)
+	machine.Namespace = "default"
+	machine.Annotations = map[string]string{constants.VmIpAnnotationKey: "10.0.0.1"}
+	setSimulatorMachineRef(machine, vm.Reference().Value)
+
+	recorder := record.NewFakeRecorder(10)
+	client := newSimulatorMachineClient(machine)
+	p := newSimulatorProvisioner()
+	p.eventRecorder = recorder
+	p.clusterV1alpha1 = client
+
+	// The memory cannot be hot-added, thus the resize waits for the annotation
+	if err = p.Update(context.Background(), cluster, machine); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-recorder.Events; event != "Warning ResizePending Machine machine1 can only be resized while powered off, set the allow-power-cycle annotation to true to allow powering it off" {
+		t.Errorf("unexpected event %q", event)
+	}
+	if vm.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOn {
+		t.Fatalf("expected the VM to be kept powered on")
+	}
+
+	// The VM is powered off, reconfigured and powered on again
+	machine.Annotations[constants.AllowPowerCycleAnnotationKey] = "true"
+	if machine, err = client.Machines(machine.Namespace).Update(machine); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		err = p.Update(context.Background(), cluster, machine)
+		if _, ok := err.(*clustererror.RequeueAfterError); !ok && err != nil {
+			t.Fatal(err)
+		}
+		if machine, err = client.Machines(machine.Namespace).Get(machine.Name, metav1.GetOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if vsphereutils.GetActiveTasks(machine) == "" && vm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn &&
+			int64(vm.Config.Hardware.MemoryMB) == machineSpec.MemoryMB {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if int64(vm.Config.Hardware.MemoryMB) != machineSpec.MemoryMB {
+		t.Errorf("expected the memory to be resized to %d, got %d", machineSpec.MemoryMB, vm.Config.Hardware.MemoryMB)
+	}
+	if vm.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOn {
+		t.Errorf("expected the VM to be powered on again, got %s", vm.Runtime.PowerState)
+	}
+	status, err := vsphereutils.GetMachineProviderStatus(machine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.PowerCycle || status.TaskRef != "" {
+		t.Errorf("unexpected provider status %+v", status)
+	}
+}
+
+// simulatorMachineClient is a client storing a single Machine in memory, for
+// the tests to follow the updates of the Machine.
+type simulatorMachineClient struct {
+	clusterv1alpha1.ClusterV1alpha1Interface
+	clusterv1alpha1.MachineInterface
+	machine *clusterv1.Machine
+}
+
+func newSimulatorMachineClient(machine *clusterv1.Machine) *simulatorMachineClient {
+	return &simulatorMachineClient{machine: machine.DeepCopy()}
+}
+
+func (c *simulatorMachineClient) Machines(namespace string) clusterv1alpha1.MachineInterface {
+	return c
+}
+
+func (c *simulatorMachineClient) Get(name string, options metav1.GetOptions) (*clusterv1.Machine, error) {
+	return c.machine.DeepCopy(), nil
+}
+
+func (c *simulatorMachineClient) Update(machine *clusterv1.Machine) (*clusterv1.Machine, error) {
+	c.machine = machine.DeepCopy()
+	return machine, nil
+}
+
+func (c *simulatorMachineClient) UpdateStatus(machine *clusterv1.Machine) (*clusterv1.Machine, error) {
+	c.machine.Status = machine.Status
+	return c.machine.DeepCopy(), nil
+}
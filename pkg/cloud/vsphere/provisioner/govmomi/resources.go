@@ -0,0 +1,124 @@
+package govmomi
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+)
+
+// applyResourceConfig sets the CPU and memory configuration of the machine
+// spec on the VM config spec. Only the properties set in the machine spec are
+// changed, the others are kept as on the template.
+func applyResourceConfig(config *types.VirtualMachineConfigSpec, machineSpec *vsphereconfigv1.VsphereMachineSpec) error {
+	if machineSpec.NumCoresPerSocket > 0 {
+		numCPUs := machineSpec.NumCPUs
+		if numCPUs > 0 && numCPUs%machineSpec.NumCoresPerSocket != 0 {
+			return fmt.Errorf("numCPUs %d is not a multiple of numCoresPerSocket %d", numCPUs, machineSpec.NumCoresPerSocket)
+		}
+		config.NumCoresPerSocket = machineSpec.NumCoresPerSocket
+	}
+	if machineSpec.CPUHotAddEnabled {
+		config.CpuHotAddEnabled = types.NewBool(true)
+	}
+	if machineSpec.MemoryHotAddEnabled {
+		config.MemoryHotAddEnabled = types.NewBool(true)
+	}
+	if machineSpec.MemoryReservationLockedToMax {
+		config.MemoryReservationLockedToMax = types.NewBool(true)
+	}
+	if machineSpec.Resources == nil {
+		return nil
+	}
+	var err error
+	config.CpuAllocation, err = resourceAllocationInfo("cpu", machineSpec.Resources.CPU)
+	if err != nil {
+		return err
+	}
+	if machineSpec.MemoryReservationLockedToMax && machineSpec.Resources.Memory != nil && machineSpec.Resources.Memory.Reservation != nil {
+		return fmt.Errorf("memory reservation cannot be set along with memoryReservationLockedToMax")
+	}
+	config.MemoryAllocation, err = resourceAllocationInfo("memory", machineSpec.Resources.Memory)
+	return err
+}
+
+func resourceAllocationInfo(resource string, info *vsphereconfigv1.ResourceAllocationInfo) (*types.ResourceAllocationInfo, error) {
+	if info == nil {
+		return nil, nil
+	}
+	allocation := &types.ResourceAllocationInfo{}
+	if info.Reservation != nil {
+		if *info.Reservation < 0 {
+			return nil, fmt.Errorf("%s reservation %d must not be negative", resource, *info.Reservation)
+		}
+		allocation.Reservation = types.NewInt64(*info.Reservation)
+	}
+	if info.Limit != nil {
+		if *info.Limit < -1 {
+			return nil, fmt.Errorf("%s limit %d must be -1 (unlimited) or more", resource, *info.Limit)
+		}
+		if *info.Limit != -1 && info.Reservation != nil && *info.Reservation > *info.Limit {
+			return nil, fmt.Errorf("%s reservation %d exceeds the limit %d", resource, *info.Reservation, *info.Limit)
+		}
+		allocation.Limit = types.NewInt64(*info.Limit)
+	}
+	if info.Shares != nil {
+		shares := &types.SharesInfo{Level: types.SharesLevel(info.Shares.Level)}
+		switch info.Shares.Level {
+		case vsphereconfigv1.SharesLevelLow, vsphereconfigv1.SharesLevelNormal, vsphereconfigv1.SharesLevelHigh:
+		case vsphereconfigv1.SharesLevelCustom:
+			if info.Shares.Shares <= 0 {
+				return nil, fmt.Errorf("%s shares must be set for the custom shares level", resource)
+			}
+			shares.Shares = info.Shares.Shares
+		default:
+			return nil, fmt.Errorf("unknown %s shares level %q", resource, info.Shares.Level)
+		}
+		allocation.Shares = shares
+	}
+	return allocation, nil
+}
+
+// getResourcesStatus returns the CPU and memory configuration of the VM.
+func getResourcesStatus(ctx context.Context, s *SessionContext, vmref types.ManagedObjectReference) (*vsphereconfigv1.ResourcesStatus, error) {
+	var vm mo.VirtualMachine
+	if err := s.session.RetrieveOne(ctx, vmref, []string{"config"}, &vm); err != nil {
+		return nil, err
+	}
+	if vm.Config == nil {
+		return nil, fmt.Errorf("VM %s has no config", vmref.Value)
+	}
+	config := vm.Config
+	status := &vsphereconfigv1.ResourcesStatus{
+		NumCPUs:                      config.Hardware.NumCPU,
+		NumCoresPerSocket:            config.Hardware.NumCoresPerSocket,
+		MemoryMB:                     int64(config.Hardware.MemoryMB),
+		CPUHotAddEnabled:             isTrue(config.CpuHotAddEnabled),
+		MemoryHotAddEnabled:          isTrue(config.MemoryHotAddEnabled),
+		MemoryReservationLockedToMax: isTrue(config.MemoryReservationLockedToMax),
+		Allocation: vsphereconfigv1.ResourceAllocation{
+			CPU:    resourceAllocationStatus(config.CpuAllocation),
+			Memory: resourceAllocationStatus(config.MemoryAllocation),
+		},
+	}
+	return status, nil
+}
+
+func resourceAllocationStatus(info *types.ResourceAllocationInfo) *vsphereconfigv1.ResourceAllocationInfo {
+	if info == nil {
+		return nil
+	}
+	status := &vsphereconfigv1.ResourceAllocationInfo{
+		Reservation: info.Reservation,
+		Limit:       info.Limit,
+	}
+	if info.Shares != nil {
+		status.Shares = &vsphereconfigv1.SharesInfo{
+			Level:  vsphereconfigv1.SharesLevel(info.Shares.Level),
+			Shares: info.Shares.Shares,
+		}
+	}
+	return status
+}
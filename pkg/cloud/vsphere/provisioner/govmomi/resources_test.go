@@ -0,0 +1,165 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package govmomi
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"testing"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/types"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+)
+
+func TestApplyResourceConfig(t *testing.T) {
+	int64Ptr := func(i int64) *int64 { return &i }
+	tests := []struct {
+		name    string
+		spec    vsphereconfigv1.VsphereMachineSpec
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			spec: vsphereconfigv1.VsphereMachineSpec{
+				NumCPUs:           4,
+				NumCoresPerSocket: 2,
+				Resources: &vsphereconfigv1.ResourceAllocation{
+					CPU: &vsphereconfigv1.ResourceAllocationInfo{
+						Reservation: int64Ptr(1000),
+						Limit:       int64Ptr(-1),
+						Shares:      &vsphereconfigv1.SharesInfo{Level: vsphereconfigv1.SharesLevelHigh},
+					},
+					Memory: &vsphereconfigv1.ResourceAllocationInfo{
+						Reservation: int64Ptr(1024),
+						Limit:       int64Ptr(2048),
+						Shares:      &vsphereconfigv1.SharesInfo{Level: vsphereconfigv1.SharesLevelCustom, Shares: 500},
+					},
+				},
+			},
+		},
+		{
+			name:    "cores per socket not dividing the CPUs",
+			spec:    vsphereconfigv1.VsphereMachineSpec{NumCPUs: 3, NumCoresPerSocket: 2},
+			wantErr: true,
+		},
+		{
+			name: "reservation above the limit",
+			spec: vsphereconfigv1.VsphereMachineSpec{
+				Resources: &vsphereconfigv1.ResourceAllocation{
+					CPU: &vsphereconfigv1.ResourceAllocationInfo{Reservation: int64Ptr(2000), Limit: int64Ptr(1000)},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown shares level",
+			spec: vsphereconfigv1.VsphereMachineSpec{
+				Resources: &vsphereconfigv1.ResourceAllocation{
+					Memory: &vsphereconfigv1.ResourceAllocationInfo{Shares: &vsphereconfigv1.SharesInfo{Level: "max"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "custom shares without shares",
+			spec: vsphereconfigv1.VsphereMachineSpec{
+				Resources: &vsphereconfigv1.ResourceAllocation{
+					CPU: &vsphereconfigv1.ResourceAllocationInfo{Shares: &vsphereconfigv1.SharesInfo{Level: vsphereconfigv1.SharesLevelCustom}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "memory reservation along with locked to max",
+			spec: vsphereconfigv1.VsphereMachineSpec{
+				MemoryReservationLockedToMax: true,
+				Resources: &vsphereconfigv1.ResourceAllocation{
+					Memory: &vsphereconfigv1.ResourceAllocationInfo{Reservation: int64Ptr(1024)},
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		config := &types.VirtualMachineConfigSpec{}
+		err := applyResourceConfig(config, &tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %t, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
+
+func TestResourcesStatus(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	reservation, limit := int64(1024), int64(-1)
+	machineSpec := newSimulatorMachineSpec(vm, nil)
+	machineSpec.NumCPUs = 4
+	machineSpec.NumCoresPerSocket = 2
+	machineSpec.CPUHotAddEnabled = true
+	machineSpec.Resources = &vsphereconfigv1.ResourceAllocation{
+		Memory: &vsphereconfigv1.ResourceAllocationInfo{
+			Reservation: &reservation,
+			Limit:       &limit,
+			Shares:      &vsphereconfigv1.SharesInfo{Level: vsphereconfigv1.SharesLevelCustom, Shares: 500},
+		},
+	}
+	machine := newSimulatorMachine(machineSpec)
+
+	p := newSimulatorProvisioner()
+	session, err := p.sessionFromProviderConfig(newSimulatorCluster(s), machine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := types.VirtualMachineConfigSpec{NumCPUs: machineSpec.NumCPUs}
+	if err = applyResourceConfig(&config, &machineSpec); err != nil {
+		t.Fatal(err)
+	}
+	task, err := object.NewVirtualMachine(session.session.Client, vm.Reference()).Reconfigure(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := getResourcesStatus(context.Background(), session, vm.Reference())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.NumCPUs != 4 || status.NumCoresPerSocket != 2 || !status.CPUHotAddEnabled {
+		t.Errorf("unexpected CPU configuration %+v", status)
+	}
+	memory := status.Allocation.Memory
+	if memory == nil || memory.Reservation == nil || *memory.Reservation != reservation ||
+		memory.Shares == nil || memory.Shares.Level != vsphereconfigv1.SharesLevelCustom || memory.Shares.Shares != 500 {
+		t.Errorf("unexpected memory allocation %+v", memory)
+	}
+}
@@ -0,0 +1,281 @@
+package govmomi
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/constants"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	apierrors "sigs.k8s.io/cluster-api/pkg/errors"
+)
+
+const createSnapshotTask = "VirtualMachine.createSnapshot"
+
+// snapshotDescription starts the description of the snapshots taken by the
+// provider, which are the only ones removed beyond the retention.
+const snapshotDescription = "Taken by cluster-api"
+
+// isRevertSnapshotTask returns true if the task reverts the VM to a snapshot.
+// The description ID of the task differs between vCenter and the simulator.
+func isRevertSnapshotTask(info types.TaskInfo) bool {
+	return info.DescriptionId == "vm.Snapshot.revert" || info.DescriptionId == "VirtualMachineSnapshot.revertToSnapshot"
+}
+
+// isRemoveSnapshotTask returns true if the task removes a snapshot of the VM.
+func isRemoveSnapshotTask(info types.TaskInfo) bool {
+	return info.DescriptionId == "vm.Snapshot.remove" || info.DescriptionId == "VirtualMachineSnapshot.removeSnapshot"
+}
+
+// reconcileSnapshots reverts the VM of the machine to the snapshot named by the
+// RollbackAnnotationKey annotation, or else snapshots the VM when the Machine
+// has the SnapshotAnnotationKey annotation, which names the snapshot. The
+// annotations are removed once the task is started. With the BeforeUpdate
+// snapshot policy, the VM is also snapshotted before a change of the versions of
+// the Machine or a reconfigure of the VM. The oldest snapshots taken by the
+// provider are then removed beyond the retention, and the snapshots of the VM
+// are listed in the provider status. True is returned when a task was started,
+// which is then tracked via the task reference of the Machine, or when the
+// Machine was updated, in which case the update continues at the next reconcile.
+func (pv *Provisioner) reconcileSnapshots(ctx context.Context, s *SessionContext, machine *clusterv1.Machine, vm *mo.VirtualMachine) (bool, error) {
+	machineConfig, err := vsphereutils.GetMachineProviderSpec(machine.Spec.ProviderSpec)
+	if err != nil {
+		return false, err
+	}
+	status, err := vsphereutils.GetMachineProviderStatus(machine)
+	if err != nil {
+		return false, err
+	}
+	if status == nil {
+		status = &vsphereconfigv1.VsphereMachineProviderStatus{}
+	}
+	policy := vsphereconfigv1.SnapshotPolicy{Retention: constants.DefaultSnapshotRetention}
+	if machineConfig.MachineSpec.SnapshotPolicy != nil {
+		policy = *machineConfig.MachineSpec.SnapshotPolicy
+		if policy.Retention == 0 {
+			policy.Retention = constants.DefaultSnapshotRetention
+		}
+	}
+	if policy.Retention < 0 {
+		return false, pv.HandleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"invalid snapshot retention %d", policy.Retention), constants.UpdateEventAction)
+	}
+	vmo := object.NewVirtualMachine(s.session.Client, vm.Reference())
+	snapshots := listSnapshots(vm.Snapshot)
+
+	if name, ok := machine.Annotations[constants.RollbackAnnotationKey]; ok {
+		var matches []types.VirtualMachineSnapshotTree
+		for _, snapshot := range snapshots {
+			if snapshot.Name == name {
+				matches = append(matches, snapshot)
+			}
+		}
+		if len(matches) != 1 {
+			pv.eventRecorder.Eventf(machine, corev1.EventTypeWarning, "FailedRollback", "Cannot roll back Machine %s as %d snapshots are named %s", machine.Name, len(matches), name)
+			_, err := pv.removeAnnotation(machine, constants.RollbackAnnotationKey)
+			return true, err
+		}
+		task, err := vmo.RevertToSnapshot(ctx, matches[0].Snapshot.Value, false)
+		if err != nil {
+			return false, fmt.Errorf("error reverting Machine %s to the snapshot %s: %s", machine.Name, name, err)
+		}
+		pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "RollingBack", "Reverting Machine %s to the snapshot %s", machine.Name, name)
+		return true, pv.trackSnapshotTask(machine, constants.RollbackAnnotationKey, task, nil)
+	}
+
+	if name, ok := machine.Annotations[constants.SnapshotAnnotationKey]; ok {
+		if name == "" {
+			name = snapshotName(machine, "")
+		}
+		task, err := vmo.CreateSnapshot(ctx, name, snapshotDescription+" on request", policy.Memory, policy.Quiesce)
+		if err != nil {
+			return false, fmt.Errorf("error snapshotting Machine %s: %s", machine.Name, err)
+		}
+		pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Snapshotting", "Taking the snapshot %s of Machine %s", name, machine.Name)
+		return true, pv.trackSnapshotTask(machine, constants.SnapshotAnnotationKey, task, nil)
+	}
+
+	if policy.BeforeUpdate {
+		changed, recorded := versionsChanged(machine)
+		// An invalid resize is reported by the resize itself
+		resizeSpec, _, _ := getResizeSpec(&machineConfig.MachineSpec, vm)
+		pending := changed || resizeSpec != nil
+		switch {
+		case pending && status.PreUpdateSnapshot == "":
+			name := snapshotName(machine, "pre-update")
+			task, err := vmo.CreateSnapshot(ctx, name, snapshotDescription+" before an update", policy.Memory, policy.Quiesce)
+			if err != nil {
+				return false, fmt.Errorf("error snapshotting Machine %s: %s", machine.Name, err)
+			}
+			pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Snapshotting", "Taking the snapshot %s of Machine %s before its update", name, machine.Name)
+			return true, pv.trackSnapshotTask(machine, "", task, func(status *vsphereconfigv1.VsphereMachineProviderStatus) {
+				status.PreUpdateSnapshot = name
+			})
+		case changed || !recorded:
+			// The VM was snapshotted, if needed, thus the new versions can be recorded
+			_, err := pv.recordVersions(machine)
+			return true, err
+		case !pending && status.PreUpdateSnapshot != "":
+			return true, pv.updateProviderStatus(machine, func(status *vsphereconfigv1.VsphereMachineProviderStatus) {
+				status.PreUpdateSnapshot = ""
+			})
+		}
+	}
+
+	var taken []types.VirtualMachineSnapshotTree
+	for _, snapshot := range snapshots {
+		if strings.HasPrefix(snapshot.Description, snapshotDescription) {
+			taken = append(taken, snapshot)
+		}
+	}
+	if len(taken) > policy.Retention {
+		oldest := taken[0]
+		task, err := vmo.RemoveSnapshot(ctx, oldest.Snapshot.Value, false, types.NewBool(true))
+		if err != nil {
+			return false, fmt.Errorf("error removing the snapshot %s of Machine %s: %s", oldest.Name, machine.Name, err)
+		}
+		pv.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "RemovingSnapshot", "Removing the snapshot %s of Machine %s beyond the retention of %d", oldest.Name, machine.Name, policy.Retention)
+		return true, pv.trackSnapshotTask(machine, "", task, nil)
+	}
+
+	if current := snapshotsStatus(snapshots); !equalSnapshotsStatus(status.Snapshots, current) {
+		klog.V(4).Infof("Updating the snapshots of Machine %s", machine.Name)
+		return true, pv.updateProviderStatus(machine, func(status *vsphereconfigv1.VsphereMachineProviderStatus) {
+			status.Snapshots = current
+		})
+	}
+	return false, nil
+}
+
+// trackSnapshotTask removes the annotation which requested the task from the
+// machine, if any, and tracks the task via the task reference of the Machine
+// along with the passed changes to its provider status.
+func (pv *Provisioner) trackSnapshotTask(machine *clusterv1.Machine, annotation string, task *object.Task,
+	update func(*vsphereconfigv1.VsphereMachineProviderStatus)) error {
+	if annotation != "" {
+		updatedmachine, err := pv.removeAnnotation(machine, annotation)
+		if err != nil {
+			return err
+		}
+		machine = updatedmachine
+	}
+	return pv.updateProviderStatus(machine, func(status *vsphereconfigv1.VsphereMachineProviderStatus) {
+		status.TaskRef = task.Reference().Value
+		if update != nil {
+			update(status)
+		}
+	})
+}
+
+// removeAnnotation removes the annotation from the machine and returns the
+// updated Machine.
+func (pv *Provisioner) removeAnnotation(machine *clusterv1.Machine, annotation string) (*clusterv1.Machine, error) {
+	newMachine := machine.DeepCopy()
+	delete(newMachine.ObjectMeta.Annotations, annotation)
+	return pv.clusterV1alpha1.Machines(newMachine.Namespace).Update(newMachine)
+}
+
+// versionsChanged returns whether the versions of the machine spec differ from
+// the versions recorded by the annotations of the Machine, and whether any
+// versions were recorded at all.
+func versionsChanged(machine *clusterv1.Machine) (bool, bool) {
+	kubelet, ok := machine.Annotations[constants.KubeletVersionAnnotationKey]
+	if !ok {
+		return false, false
+	}
+	controlPlane := machine.Annotations[constants.ControlPlaneVersionAnnotationKey]
+	return kubelet != machine.Spec.Versions.Kubelet || controlPlane != machine.Spec.Versions.ControlPlane, true
+}
+
+// recordVersions records the versions of the machine spec in the annotations
+// of the Machine, and returns the updated Machine.
+func (pv *Provisioner) recordVersions(machine *clusterv1.Machine) (*clusterv1.Machine, error) {
+	newMachine := machine.DeepCopy()
+	if newMachine.ObjectMeta.Annotations == nil {
+		newMachine.ObjectMeta.Annotations = make(map[string]string)
+	}
+	newMachine.ObjectMeta.Annotations[constants.KubeletVersionAnnotationKey] = machine.Spec.Versions.Kubelet
+	newMachine.ObjectMeta.Annotations[constants.ControlPlaneVersionAnnotationKey] = machine.Spec.Versions.ControlPlane
+	return pv.clusterV1alpha1.Machines(newMachine.Namespace).Update(newMachine)
+}
+
+// snapshotName returns a name for a snapshot of the machine, made unique by the
+// current time.
+func snapshotName(machine *clusterv1.Machine, reason string) string {
+	name := machine.Name
+	if reason != "" {
+		name += "-" + reason
+	}
+	return name + "-" + time.Now().UTC().Format("20060102-150405")
+}
+
+// listSnapshots returns the snapshots of the snapshot tree of a VM, oldest
+// first.
+func listSnapshots(info *types.VirtualMachineSnapshotInfo) []types.VirtualMachineSnapshotTree {
+	if info == nil {
+		return nil
+	}
+	var snapshots []types.VirtualMachineSnapshotTree
+	var walk func([]types.VirtualMachineSnapshotTree)
+	walk = func(trees []types.VirtualMachineSnapshotTree) {
+		for _, tree := range trees {
+			snapshots = append(snapshots, tree)
+			walk(tree.ChildSnapshotList)
+		}
+	}
+	walk(info.RootSnapshotList)
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].CreateTime.Before(snapshots[j].CreateTime)
+	})
+	return snapshots
+}
+
+// snapshotsStatus returns the status of the snapshots. The creation times are
+// truncated to the second, as serialized in the provider status.
+func snapshotsStatus(snapshots []types.VirtualMachineSnapshotTree) []vsphereconfigv1.SnapshotStatus {
+	var status []vsphereconfigv1.SnapshotStatus
+	for _, snapshot := range snapshots {
+		status = append(status, vsphereconfigv1.SnapshotStatus{
+			Name:       snapshot.Name,
+			CreateTime: metav1.NewTime(snapshot.CreateTime.Truncate(time.Second)),
+		})
+	}
+	return status
+}
+
+func equalSnapshotsStatus(a, b []vsphereconfigv1.SnapshotStatus) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || !a[i].CreateTime.Equal(&b[i].CreateTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// getMachineSnapshotsStatus returns the status of the snapshots of the VM of
+// the machine.
+func (pv *Provisioner) getMachineSnapshotsStatus(ctx context.Context, s *SessionContext, machine *clusterv1.Machine) ([]vsphereconfigv1.SnapshotStatus, error) {
+	moref, err := vsphereutils.GetMachineRef(machine)
+	if err != nil {
+		return nil, err
+	}
+	var vm mo.VirtualMachine
+	vmref := types.ManagedObjectReference{Type: "VirtualMachine", Value: moref}
+	if err := s.session.RetrieveOne(ctx, vmref, []string{"snapshot"}, &vm); err != nil {
+		return nil, err
+	}
+	return snapshotsStatus(listSnapshots(vm.Snapshot)), nil
+}
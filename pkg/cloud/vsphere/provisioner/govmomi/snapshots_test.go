@@ -0,0 +1,228 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package govmomi
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/simulator"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/constants"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+// updateSimulatorMachine calls Update the passed number of times, with the
+// latest Machine as the controller would, and returns the events recorded and
+// the updated Machine.
+func updateSimulatorMachine(p *Provisioner, cluster *clusterv1.Cluster, machine *clusterv1.Machine, recorder *record.FakeRecorder, times int) ([]string, *clusterv1.Machine, error) {
+	var events []string
+	for i := 0; i < times; i++ {
+		err := p.Update(context.Background(), cluster, machine)
+		for len(recorder.Events) > 0 {
+			events = append(events, <-recorder.Events)
+		}
+		if err != nil {
+			return events, machine, err
+		}
+		if machine, err = p.clusterV1alpha1.Machines(machine.Namespace).Get(machine.Name, metav1.GetOptions{}); err != nil {
+			return events, machine, err
+		}
+	}
+	return events, machine, nil
+}
+
+func snapshotNames(t *testing.T, machine *clusterv1.Machine) []string {
+	status, err := vsphereutils.GetMachineProviderStatus(machine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, snapshot := range status.Snapshots {
+		names = append(names, snapshot.Name)
+	}
+	return names
+}
+
+func TestUpdateSnapshots(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	cluster := newSimulatorCluster(s)
+	vms := simulator.Map.All("VirtualMachine")
+	newMachine := func(vm *simulator.VirtualMachine, policy *vsphereconfigv1.SnapshotPolicy) *clusterv1.Machine {
+		machineSpec := newSimulatorMachineSpec(vm, nil)
+		machineSpec.NumCPUs = vm.Config.Hardware.NumCPU
+		machineSpec.MemoryMB = int64(vm.Config.Hardware.MemoryMB)
+		machineSpec.SnapshotPolicy = policy
+		machine := newSimulatorMachine(machineSpec)
+		machine.Namespace = "default"
+		machine.Annotations = map[string]string{constants.VmIpAnnotationKey: "10.0.0.1"}
+		setSimulatorMachineRef(machine, vm.Reference().Value)
+		return machine
+	}
+
+	t.Run("on request with retention and rollback", func(t *testing.T) {
+		vm := vms[0].(*simulator.VirtualMachine)
+		machine := newMachine(vm, &vsphereconfigv1.SnapshotPolicy{Retention: 1})
+		machine.Annotations[constants.SnapshotAnnotationKey] = "first"
+		client := newSimulatorMachineClient(machine)
+		recorder := record.NewFakeRecorder(10)
+		p := newSimulatorProvisioner()
+		p.eventRecorder = recorder
+		p.clusterV1alpha1 = client
+
+		events, machine, err := updateSimulatorMachine(p, cluster, machine, recorder, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{
+			"Normal Snapshotting Taking the snapshot first of Machine machine1",
+			"Normal Snapshotted Took a snapshot of Machine machine1",
+		}
+		if !reflect.DeepEqual(events, expected) {
+			t.Errorf("unexpected events %q", events)
+		}
+		if _, ok := machine.Annotations[constants.SnapshotAnnotationKey]; ok {
+			t.Error("expected the snapshot annotation to be removed")
+		}
+		if names := snapshotNames(t, machine); !reflect.DeepEqual(names, []string{"first"}) {
+			t.Errorf("unexpected snapshots %q", names)
+		}
+
+		// The oldest snapshot is removed beyond the retention
+		machine.Annotations[constants.SnapshotAnnotationKey] = "second"
+		if machine, err = client.Update(machine); err != nil {
+			t.Fatal(err)
+		}
+		events, machine, err = updateSimulatorMachine(p, cluster, machine, recorder, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = []string{
+			"Normal Snapshotting Taking the snapshot second of Machine machine1",
+			"Normal Snapshotted Took a snapshot of Machine machine1",
+			"Normal RemovingSnapshot Removing the snapshot first of Machine machine1 beyond the retention of 1",
+			"Normal RemovedSnapshot Removed a snapshot of Machine machine1",
+		}
+		if !reflect.DeepEqual(events, expected) {
+			t.Errorf("unexpected events %q", events)
+		}
+		if names := snapshotNames(t, machine); !reflect.DeepEqual(names, []string{"second"}) {
+			t.Errorf("unexpected snapshots %q", names)
+		}
+
+		// Rollbacks to an unknown snapshot are refused
+		machine.Annotations[constants.RollbackAnnotationKey] = "first"
+		if machine, err = client.Update(machine); err != nil {
+			t.Fatal(err)
+		}
+		events, machine, err = updateSimulatorMachine(p, cluster, machine, recorder, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 || events[0] != "Warning FailedRollback Cannot roll back Machine machine1 as 0 snapshots are named first" {
+			t.Errorf("unexpected events %q", events)
+		}
+		if _, ok := machine.Annotations[constants.RollbackAnnotationKey]; ok {
+			t.Error("expected the rollback annotation to be removed")
+		}
+
+		machine.Annotations[constants.RollbackAnnotationKey] = "second"
+		if machine, err = client.Update(machine); err != nil {
+			t.Fatal(err)
+		}
+		events, machine, err = updateSimulatorMachine(p, cluster, machine, recorder, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = []string{
+			"Normal RollingBack Reverting Machine machine1 to the snapshot second",
+			"Normal RolledBack Rolled back Machine machine1",
+		}
+		if !reflect.DeepEqual(events, expected) {
+			t.Errorf("unexpected events %q", events)
+		}
+		if _, ok := machine.Annotations[constants.RollbackAnnotationKey]; ok {
+			t.Error("expected the rollback annotation to be removed")
+		}
+		if vsphereutils.GetActiveTasks(machine) != "" {
+			t.Error("expected no active task once rolled back")
+		}
+	})
+
+	t.Run("before a version change", func(t *testing.T) {
+		vm := vms[1].(*simulator.VirtualMachine)
+		machine := newMachine(vm, &vsphereconfigv1.SnapshotPolicy{BeforeUpdate: true})
+		machine.Spec.Versions.Kubelet = "1.13.0"
+		client := newSimulatorMachineClient(machine)
+		recorder := record.NewFakeRecorder(10)
+		p := newSimulatorProvisioner()
+		p.eventRecorder = recorder
+		p.clusterV1alpha1 = client
+
+		// The versions are first recorded without snapshot
+		events, machine, err := updateSimulatorMachine(p, cluster, machine, recorder, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 0 || vm.Snapshot != nil {
+			t.Errorf("expected no snapshot, got events %q", events)
+		}
+		if version := machine.Annotations[constants.KubeletVersionAnnotationKey]; version != "1.13.0" {
+			t.Errorf("expected the kubelet version to be recorded, got %q", version)
+		}
+
+		machine.Spec.Versions.Kubelet = "1.14.0"
+		if machine, err = client.Update(machine); err != nil {
+			t.Fatal(err)
+		}
+		events, machine, err = updateSimulatorMachine(p, cluster, machine, recorder, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 2 || !strings.HasPrefix(events[0], "Normal Snapshotting Taking the snapshot machine1-pre-update-") ||
+			events[1] != "Normal Snapshotted Took a snapshot of Machine machine1" {
+			t.Errorf("unexpected events %q", events)
+		}
+		if version := machine.Annotations[constants.KubeletVersionAnnotationKey]; version != "1.14.0" {
+			t.Errorf("expected the new kubelet version to be recorded, got %q", version)
+		}
+		status, err := vsphereutils.GetMachineProviderStatus(machine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.PreUpdateSnapshot != "" || len(status.Snapshots) != 1 || !strings.HasPrefix(status.Snapshots[0].Name, "machine1-pre-update-") {
+			t.Errorf("unexpected provider status %+v", status)
+		}
+	})
+}
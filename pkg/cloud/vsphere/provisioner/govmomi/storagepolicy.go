@@ -0,0 +1,152 @@
+package govmomi
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/pbm"
+	pbmtypes "github.com/vmware/govmomi/pbm/types"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/klog"
+)
+
+// storagePolicyPlacer resolves storage policies by name and picks the
+// datastores compatible with them among the candidate datastores. The PBM
+// client is only created when a storage policy is used.
+type storagePolicyPlacer struct {
+	s          *SessionContext
+	client     *pbm.Client
+	candidates []types.ManagedObjectReference
+	profileIDs map[string]string
+}
+
+func newStoragePolicyPlacer(s *SessionContext, candidates []types.ManagedObjectReference) *storagePolicyPlacer {
+	return &storagePolicyPlacer{
+		s:          s,
+		candidates: candidates,
+		profileIDs: make(map[string]string),
+	}
+}
+
+// profileID returns the ID of the named storage policy.
+func (p *storagePolicyPlacer) profileID(ctx context.Context, policyName string) (string, error) {
+	if id, ok := p.profileIDs[policyName]; ok {
+		return id, nil
+	}
+	if p.client == nil {
+		client, err := pbm.NewClient(ctx, p.s.session.Client)
+		if err != nil {
+			return "", fmt.Errorf("error setting up the storage policy client: %s", err)
+		}
+		p.client = client
+	}
+	id, err := profileIDByName(ctx, p.client, policyName)
+	if err != nil {
+		return "", fmt.Errorf("error querying the storage policy %s: %s", policyName, err)
+	}
+	if id == "" {
+		return "", fmt.Errorf("[FATAL] Storage policy %s not found", policyName)
+	}
+	p.profileIDs[policyName] = id
+	return id, nil
+}
+
+// place returns the profile spec of the named storage policy and the
+// datastore to place on. When a datastore name is given, that datastore is
+// checked to be compatible with the storage policy. Otherwise the compatible
+// datastore with the most free space is picked.
+func (p *storagePolicyPlacer) place(ctx context.Context, policyName string, datastoreName string) ([]types.BaseVirtualMachineProfileSpec, *object.Datastore, error) {
+	id, err := p.profileID(ctx, policyName)
+	if err != nil {
+		return nil, nil, err
+	}
+	candidates := p.candidates
+	if datastoreName != "" {
+		ds, err := p.s.finder.Datastore(ctx, datastoreName)
+		if err != nil {
+			return nil, nil, err
+		}
+		candidates = []types.ManagedObjectReference{ds.Reference()}
+	}
+	matching, err := compatibleDatastores(ctx, p.client, id, candidates)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error querying the datastores compatible with the storage policy %s: %s", policyName, err)
+	}
+	if len(matching) == 0 {
+		if datastoreName != "" {
+			return nil, nil, fmt.Errorf("[FATAL] Datastore %s is not compatible with the storage policy %s", datastoreName, policyName)
+		}
+		return nil, nil, fmt.Errorf("[FATAL] None of the datastores is compatible with the storage policy %s", policyName)
+	}
+	var datastores []mo.Datastore
+	pc := property.DefaultCollector(p.s.session.Client)
+	if err := pc.Retrieve(ctx, matching, []string{"summary"}, &datastores); err != nil {
+		return nil, nil, err
+	}
+	var best *types.DatastoreSummary
+	for i := range datastores {
+		summary := &datastores[i].Summary
+		if !summary.Accessible {
+			continue
+		}
+		if best == nil || summary.FreeSpace > best.FreeSpace {
+			best = summary
+		}
+	}
+	if best == nil {
+		return nil, nil, fmt.Errorf("[FATAL] None of the datastores compatible with the storage policy %s is accessible", policyName)
+	}
+	klog.V(4).Infof("Picked datastore %s for the storage policy %s", best.Name, policyName)
+	ds, err := p.s.finder.Datastore(ctx, best.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	profile := []types.BaseVirtualMachineProfileSpec{
+		&types.VirtualMachineDefinedProfileSpec{ProfileId: id},
+	}
+	return profile, ds, nil
+}
+
+// profileIDByName returns the ID of the storage policy with the given name.
+// An empty ID is returned if no such policy exists.
+func profileIDByName(ctx context.Context, c *pbm.Client, name string) (string, error) {
+	ids, err := c.QueryProfile(ctx, pbmtypes.PbmProfileResourceType{
+		ResourceType: string(pbmtypes.PbmProfileResourceTypeEnumSTORAGE),
+	}, string(pbmtypes.PbmProfileCategoryEnumREQUIREMENT))
+	if err != nil || len(ids) == 0 {
+		return "", err
+	}
+	profiles, err := c.RetrieveContent(ctx, ids)
+	if err != nil {
+		return "", err
+	}
+	for _, profile := range profiles {
+		if profile.GetPbmProfile().Name == name {
+			return profile.GetPbmProfile().ProfileId.UniqueId, nil
+		}
+	}
+	return "", nil
+}
+
+// compatibleDatastores filters the passed datastores down to the ones that are
+// compatible with the storage policy.
+func compatibleDatastores(ctx context.Context, c *pbm.Client, profileID string, datastores []types.ManagedObjectReference) ([]types.ManagedObjectReference, error) {
+	hubs := make([]pbmtypes.PbmPlacementHub, 0, len(datastores))
+	for _, ds := range datastores {
+		hubs = append(hubs, pbmtypes.PbmPlacementHub{HubType: ds.Type, HubId: ds.Value})
+	}
+	result, err := c.CheckRequirements(ctx, hubs, nil, []pbmtypes.BasePbmPlacementRequirement{
+		&pbmtypes.PbmPlacementCapabilityProfileRequirement{ProfileId: pbmtypes.PbmProfileId{UniqueId: profileID}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var compatible []types.ManagedObjectReference
+	for _, hub := range result.CompatibleDatastores() {
+		compatible = append(compatible, types.ManagedObjectReference{Type: hub.HubType, Value: hub.HubId})
+	}
+	return compatible, nil
+}
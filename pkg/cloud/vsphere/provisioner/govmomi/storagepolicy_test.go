@@ -0,0 +1,306 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package govmomi
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/pbm"
+	pbmmethods "github.com/vmware/govmomi/pbm/methods"
+	pbmsim "github.com/vmware/govmomi/pbm/simulator"
+	pbmtypes "github.com/vmware/govmomi/pbm/types"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/govmomi/vim25/xml"
+	"k8s.io/client-go/tools/record"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+)
+
+// The default storage policies of the pbm simulator
+const (
+	vsanPolicy       = "vSAN Default Storage Policy"
+	vsanPolicyID     = "aa6d5a82-1c88-45da-85d3-3d74b91a5bad"
+	vvolPolicy       = "VVol No Requirements Policy"
+	vvolPolicyID     = "f4e5bade-15a2-4805-bf8e-52318c4ce443"
+	encryptionPolicy = "VM Encryption Policy"
+)
+
+// placementSolver replaces the placement solver of the pbm simulator, which
+// finds all the datastores compatible with any storage policy, for the tests to
+// set the datastores compatible with each storage policy.
+type placementSolver struct {
+	types.ManagedObjectReference
+	// compatible maps the storage policy IDs to the compatible datastores
+	compatible map[string][]types.ManagedObjectReference
+}
+
+func (m *placementSolver) PbmCheckRequirements(req *pbmtypes.PbmCheckRequirements) soap.HasFault {
+	body := &pbmmethods.PbmCheckRequirementsBody{Res: new(pbmtypes.PbmCheckRequirementsResponse)}
+	for _, requirement := range req.PlacementSubjectRequirement {
+		profile, ok := requirement.(*pbmtypes.PbmPlacementCapabilityProfileRequirement)
+		if !ok {
+			continue
+		}
+		for _, hub := range req.HubsToSearch {
+			for _, ds := range m.compatible[profile.ProfileId.UniqueId] {
+				if ds.Value == hub.HubId {
+					body.Res.Returnval = append(body.Res.Returnval, pbmtypes.PbmPlacementCompatibilityResult{Hub: hub})
+				}
+			}
+		}
+	}
+	return body
+}
+
+// registerSimulatorPbm registers the pbm simulator with the datastores
+// compatible with each storage policy.
+func registerSimulatorPbm(model *simulator.Model, compatible map[string][]types.ManagedObjectReference) {
+	r := pbmsim.New()
+	content := r.Get(pbm.ServiceInstance).(*pbmsim.ServiceInstance).Content
+	r.Put(&placementSolver{ManagedObjectReference: content.PlacementSolver, compatible: compatible})
+	model.Service.RegisterSDK(r)
+}
+
+// cloneRecorder passes the calls on to the simulator and keeps the bodies of
+// the CloneVM_Task requests for the tests to check the clone spec, which the
+// simulator only partly applies to the clone.
+type cloneRecorder struct {
+	proxy  *httputil.ReverseProxy
+	server *httptest.Server
+	clones [][]byte
+}
+
+func newCloneRecorder(s *simulator.Server) (*cloneRecorder, *simulator.Server) {
+	cr := &cloneRecorder{
+		proxy: httputil.NewSingleHostReverseProxy(&url.URL{Scheme: s.URL.Scheme, Host: s.URL.Host}),
+	}
+	cr.proxy.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	cr.server = httptest.NewTLSServer(cr)
+	u, err := url.Parse(cr.server.URL + s.URL.Path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	u.User = s.URL.User
+	return cr, &simulator.Server{URL: u}
+}
+
+func (cr *cloneRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if bytes.Contains(body, []byte("<CloneVM_Task")) {
+		cr.clones = append(cr.clones, body)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	cr.proxy.ServeHTTP(w, r)
+}
+
+// cloneSpecs returns the clone specs of the CloneVM_Task requests.
+func (cr *cloneRecorder) cloneSpecs(t *testing.T) []types.VirtualMachineCloneSpec {
+	var specs []types.VirtualMachineCloneSpec
+	for _, clone := range cr.clones {
+		var body methods.CloneVM_TaskBody
+		dec := xml.NewDecoder(bytes.NewReader(clone))
+		dec.TypeFunc = types.TypeFunc()
+		if err := dec.Decode(&soap.Envelope{Body: &body}); err != nil {
+			t.Fatal(err)
+		}
+		specs = append(specs, body.Req.Spec)
+	}
+	return specs
+}
+
+func profileIDOf(profile []types.BaseVirtualMachineProfileSpec) string {
+	if len(profile) != 1 {
+		return ""
+	}
+	if spec, ok := profile[0].(*types.VirtualMachineDefinedProfileSpec); ok {
+		return spec.ProfileId
+	}
+	return ""
+}
+
+func TestStoragePolicyPlace(t *testing.T) {
+	model := simulator.VPX()
+	model.Datastore = 3
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	var datastores []types.ManagedObjectReference
+	for i, obj := range simulator.Map.All("Datastore") {
+		ds := obj.(*simulator.Datastore)
+		ds.Summary.FreeSpace = int64(i+1) * 1024 * 1024 * 1024
+		ds.Summary.Accessible = true
+		datastores = append(datastores, ds.Reference())
+	}
+	registerSimulatorPbm(model, map[string][]types.ManagedObjectReference{
+		vsanPolicyID: {datastores[0], datastores[1]},
+		vvolPolicyID: {datastores[2]},
+	})
+
+	p := newSimulatorProvisioner()
+	cluster := newSimulatorCluster(s)
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	session, err := p.sessionFromProviderConfig(cluster, newSimulatorMachine(newSimulatorMachineSpec(vm, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, err := session.finder.DefaultDatacenter(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.finder.SetDatacenter(dc)
+	placer := newStoragePolicyPlacer(session, datastores)
+
+	t.Run("most free space wins", func(t *testing.T) {
+		profile, ds, err := placer.place(context.Background(), vsanPolicy, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ds.Reference() != datastores[1] {
+			t.Errorf("expected the compatible datastore with the most free space %s, got %s", datastores[1].Value, ds.Reference().Value)
+		}
+		if id := profileIDOf(profile); id != vsanPolicyID {
+			t.Errorf("expected the profile of the storage policy, got %q", id)
+		}
+	})
+
+	t.Run("named datastore", func(t *testing.T) {
+		name := simulator.Map.Get(datastores[0]).(*simulator.Datastore).Name
+		_, ds, err := placer.place(context.Background(), vsanPolicy, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ds.Reference() != datastores[0] {
+			t.Errorf("expected the named datastore %s, got %s", datastores[0].Value, ds.Reference().Value)
+		}
+		if _, _, err = placer.place(context.Background(), vvolPolicy, name); err == nil || !strings.Contains(err.Error(), "is not compatible") {
+			t.Errorf("expected the incompatible named datastore to fail, got %v", err)
+		}
+	})
+
+	t.Run("no compatible datastore", func(t *testing.T) {
+		if _, _, err := placer.place(context.Background(), encryptionPolicy, ""); err == nil || !strings.Contains(err.Error(), "None of the datastores is compatible") {
+			t.Errorf("expected an error without compatible datastore, got %v", err)
+		}
+	})
+
+	t.Run("unknown storage policy", func(t *testing.T) {
+		if _, _, err := placer.place(context.Background(), "Gold Storage Policy", ""); err == nil || !strings.Contains(err.Error(), "not found") {
+			t.Errorf("expected an error for an unknown storage policy, got %v", err)
+		}
+	})
+}
+
+func TestCreateStoragePolicy(t *testing.T) {
+	model := simulator.VPX()
+	model.Datastore = 2
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	var datastores []types.ManagedObjectReference
+	for _, obj := range simulator.Map.All("Datastore") {
+		obj.(*simulator.Datastore).Summary.Accessible = true
+		datastores = append(datastores, obj.Reference())
+	}
+	registerSimulatorPbm(model, map[string][]types.ManagedObjectReference{
+		vsanPolicyID: {datastores[0]},
+		vvolPolicyID: {datastores[1]},
+	})
+	cr, server := newCloneRecorder(s)
+	defer cr.server.Close()
+
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	machineSpec := newSimulatorMachineSpec(vm, []vsphereconfigv1.DiskSpec{
+		{DiskSizeGB: 10},
+		{DiskSizeGB: 20, StoragePolicyName: vvolPolicy},
+	})
+	machineSpec.StoragePolicyName = vsanPolicy
+	p := newSimulatorProvisioner()
+	p.eventRecorder = record.NewFakeRecorder(10)
+	if err = p.Create(context.Background(), newSimulatorCluster(server), newSimulatorMachine(machineSpec)); err != nil {
+		t.Fatal(err)
+	}
+
+	specs := cr.cloneSpecs(t)
+	if len(specs) != 1 {
+		t.Fatalf("expected a single clone, got %d", len(specs))
+	}
+	spec := specs[0]
+	// The VM home is placed according to the storage policy of the VM
+	if spec.Location.Datastore == nil || *spec.Location.Datastore != datastores[0] || profileIDOf(spec.Location.Profile) != vsanPolicyID {
+		t.Errorf("expected the VM home on %s with the vSAN profile, got %v with %q", datastores[0].Value, spec.Location.Datastore, profileIDOf(spec.Location.Profile))
+	}
+	// The new disks default to the storage policy of the VM, unless they
+	// specify their own
+	expected := map[int64]struct {
+		datastore types.ManagedObjectReference
+		profileID string
+	}{
+		10: {datastores[0], vsanPolicyID},
+		20: {datastores[1], vvolPolicyID},
+	}
+	found := 0
+	for _, change := range spec.Config.DeviceChange {
+		deviceSpec := change.GetVirtualDeviceConfigSpec()
+		disk, ok := deviceSpec.Device.(*types.VirtualDisk)
+		if !ok || deviceSpec.Operation != types.VirtualDeviceConfigSpecOperationAdd {
+			continue
+		}
+		want, ok := expected[disk.CapacityInKB/1024/1024]
+		if !ok {
+			continue
+		}
+		found++
+		backing := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+		if backing.Datastore == nil || *backing.Datastore != want.datastore || profileIDOf(deviceSpec.Profile) != want.profileID {
+			t.Errorf("expected the %dGB disk on %s with the profile %s, got %v with %q", disk.CapacityInKB/1024/1024,
+				want.datastore.Value, want.profileID, backing.Datastore, profileIDOf(deviceSpec.Profile))
+		}
+	}
+	if found != len(expected) {
+		t.Errorf("expected %d new disks in the clone spec, got %d", len(expected), found)
+	}
+}
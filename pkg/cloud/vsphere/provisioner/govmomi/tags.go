@@ -0,0 +1,278 @@
+package govmomi
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/types"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	vsphereutils "sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere/utils"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+const (
+	// clusterTagCategory is the tag category of the cluster of the VM, the tag
+	// being named <namespace>/<cluster name>
+	clusterTagCategory = "cluster-api-cluster"
+	// roleTagCategory is the tag category of the role of the VM
+	roleTagCategory = "cluster-api-role"
+
+	clusterAttribute           = "cluster-api.cluster"
+	namespaceAttribute         = "cluster-api.namespace"
+	machineAttribute           = "cluster-api.machine"
+	roleAttribute              = "cluster-api.role"
+	kubernetesVersionAttribute = "cluster-api.kubernetes-version"
+)
+
+// machineTags returns the tags of the VM of the machine, the ones identifying
+// the cluster and role of the machine followed by the tags of the machine spec.
+func machineTags(cluster *clusterv1.Cluster, machine *clusterv1.Machine, machineSpec *vsphereconfigv1.VsphereMachineSpec) []vsphereconfigv1.TagSpec {
+	tagSpecs := []vsphereconfigv1.TagSpec{
+		{Category: clusterTagCategory, Name: fmt.Sprintf("%s/%s", cluster.Namespace, cluster.Name)},
+		{Category: roleTagCategory, Name: machineRole(machine)},
+	}
+	return append(tagSpecs, machineSpec.Tags...)
+}
+
+// machineCustomAttributes returns the custom attributes set on the VM of the
+// machine.
+func machineCustomAttributes(cluster *clusterv1.Cluster, machine *clusterv1.Machine) map[string]string {
+	return map[string]string{
+		clusterAttribute:           cluster.Name,
+		namespaceAttribute:         machine.Namespace,
+		machineAttribute:           machine.Name,
+		roleAttribute:              machineRole(machine),
+		kubernetesVersionAttribute: machine.Spec.Versions.Kubelet,
+	}
+}
+
+// validateTags returns an error when a tag of the machine spec has no category
+// or name.
+func validateTags(machineSpec *vsphereconfigv1.VsphereMachineSpec) error {
+	for _, t := range machineSpec.Tags {
+		if t.Category == "" || t.Name == "" {
+			return fmt.Errorf("a tag has no category or name")
+		}
+	}
+	return nil
+}
+
+// tagVirtualMachine sets the custom attributes and attaches the tags of the
+// machine to its VM once cloned. Failures are only reported, the VM is usable
+// without its tags.
+func (pv *Provisioner) tagVirtualMachine(ctx context.Context, s *SessionContext, cluster *clusterv1.Cluster, machine *clusterv1.Machine, vmref types.ManagedObjectReference) {
+	err := setCustomAttributes(ctx, s, vmref, machineCustomAttributes(cluster, machine))
+	if err == nil {
+		err = pv.withRestClient(ctx, s, cluster, func(rc *rest.Client) error {
+			machineConfig, err := vsphereutils.GetMachineProviderSpec(machine.Spec.ProviderSpec)
+			if err != nil {
+				return err
+			}
+			return attachTags(ctx, tags.NewManager(rc), vmref, machineTags(cluster, machine, &machineConfig.MachineSpec))
+		})
+	}
+	if err != nil {
+		klog.Warningf("Error tagging the VM of Machine %s: %s", machine.Name, err)
+		if pv.eventRecorder != nil {
+			pv.eventRecorder.Eventf(machine, corev1.EventTypeWarning, "FailedTagging", "Error tagging the VM: %s", err)
+		}
+	}
+}
+
+// untagVirtualMachine detaches all the tags of the VM of the machine before it
+// is destroyed. Failures are only reported.
+func (pv *Provisioner) untagVirtualMachine(ctx context.Context, s *SessionContext, cluster *clusterv1.Cluster, machine *clusterv1.Machine, vmref types.ManagedObjectReference) {
+	err := pv.withRestClient(ctx, s, cluster, func(rc *rest.Client) error {
+		return detachAllTags(ctx, tags.NewManager(rc), vmref)
+	})
+	if err != nil {
+		klog.Warningf("Error detaching the tags of the VM of Machine %s: %s", machine.Name, err)
+	}
+}
+
+// withRestClient calls f with a client logged in to the REST API of vCenter.
+func (pv *Provisioner) withRestClient(ctx context.Context, s *SessionContext, cluster *clusterv1.Cluster, f func(*rest.Client) error) error {
+	username, password, err := pv.GetVsphereCredentials(cluster)
+	if err != nil {
+		return err
+	}
+	rc := rest.NewClient(s.session.Client)
+	if err := rc.Login(ctx, url.UserPassword(username, password)); err != nil {
+		return fmt.Errorf("error logging in to the vSphere REST API: %s", err)
+	}
+	defer func() {
+		if err := rc.Logout(ctx); err != nil {
+			klog.Warningf("Error logging out of the vSphere REST API: %s", err)
+		}
+	}()
+	return f(rc)
+}
+
+// setCustomAttributes sets the custom attributes on the VM, defining the
+// attributes missing in vCenter.
+func setCustomAttributes(ctx context.Context, s *SessionContext, vmref types.ManagedObjectReference, attributes map[string]string) error {
+	m, err := object.GetCustomFieldsManager(s.session.Client)
+	if err != nil {
+		return err
+	}
+	fields, err := m.Field(ctx)
+	if err != nil {
+		return err
+	}
+	for name, value := range attributes {
+		key := int32(-1)
+		for _, field := range fields {
+			if field.Name == name && (field.ManagedObjectType == "" || field.ManagedObjectType == vmref.Type) {
+				key = field.Key
+				break
+			}
+		}
+		if key == -1 {
+			field, err := m.Add(ctx, name, vmref.Type, nil, nil)
+			if err != nil {
+				// The attribute may have been defined by a concurrent reconcile
+				if key, err = m.FindKey(ctx, name); err != nil {
+					return fmt.Errorf("error defining the custom attribute %s: %s", name, err)
+				}
+			} else {
+				key = field.Key
+			}
+		}
+		if err := m.Set(ctx, vmref, key, value); err != nil {
+			return fmt.Errorf("error setting the custom attribute %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// attachTags attaches the tags to the VM, creating the categories and tags
+// which do not exist yet.
+func attachTags(ctx context.Context, m *tags.Manager, vmref types.ManagedObjectReference, tagSpecs []vsphereconfigv1.TagSpec) error {
+	categoryIDs := make(map[string]string)
+	for _, t := range tagSpecs {
+		categoryID, ok := categoryIDs[t.Category]
+		if !ok {
+			// The provider categories only allow a single tag per VM
+			cardinality := "MULTIPLE"
+			if t.Category == clusterTagCategory || t.Category == roleTagCategory {
+				cardinality = "SINGLE"
+			}
+			var err error
+			if categoryID, err = getOrCreateTagCategory(ctx, m, t.Category, cardinality); err != nil {
+				return err
+			}
+			categoryIDs[t.Category] = categoryID
+		}
+		tagID, err := getOrCreateTag(ctx, m, categoryID, t.Name)
+		if err != nil {
+			return err
+		}
+		if err := m.AttachTag(ctx, tagID, vmref); err != nil {
+			return fmt.Errorf("error attaching the tag %s/%s: %s", t.Category, t.Name, err)
+		}
+	}
+	return nil
+}
+
+// findClusterTag returns the ID of the tag attached to the VMs of the cluster,
+// or an empty ID when there is no such tag.
+func findClusterTag(ctx context.Context, m *tags.Manager, cluster *clusterv1.Cluster) (string, error) {
+	categoryID, err := findTagCategory(ctx, m, clusterTagCategory)
+	if err != nil || categoryID == "" {
+		return "", err
+	}
+	return findTag(ctx, m, categoryID, fmt.Sprintf("%s/%s", cluster.Namespace, cluster.Name))
+}
+
+// detachAllTags detaches all the tags attached to the VM.
+func detachAllTags(ctx context.Context, m *tags.Manager, vmref types.ManagedObjectReference) error {
+	tagIDs, err := m.ListAttachedTags(ctx, vmref)
+	if err != nil {
+		return err
+	}
+	for _, tagID := range tagIDs {
+		if err := m.DetachTag(ctx, tagID, vmref); err != nil {
+			return fmt.Errorf("error detaching the tag %s: %s", tagID, err)
+		}
+	}
+	return nil
+}
+
+// getOrCreateTagCategory returns the ID of the named tag category, created
+// for VMs when missing.
+func getOrCreateTagCategory(ctx context.Context, m *tags.Manager, name, cardinality string) (string, error) {
+	id, err := findTagCategory(ctx, m, name)
+	if err != nil || id != "" {
+		return id, err
+	}
+	klog.V(4).Infof("Creating the tag category %s", name)
+	id, err = m.CreateCategory(ctx, &tags.Category{
+		Name:            name,
+		Description:     "Created by cluster-api",
+		Cardinality:     cardinality,
+		AssociableTypes: []string{"VirtualMachine"},
+	})
+	if err != nil {
+		// The category may have been created by a concurrent reconcile
+		if id, findErr := findTagCategory(ctx, m, name); findErr == nil && id != "" {
+			return id, nil
+		}
+		return "", fmt.Errorf("error creating the tag category %s: %s", name, err)
+	}
+	return id, nil
+}
+
+// findTagCategory returns the ID of the named tag category, or an empty ID
+// when there is no such category.
+func findTagCategory(ctx context.Context, m *tags.Manager, name string) (string, error) {
+	categories, err := m.GetCategories(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, category := range categories {
+		if category.Name == name {
+			return category.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// getOrCreateTag returns the ID of the named tag of the category, created when
+// missing.
+func getOrCreateTag(ctx context.Context, m *tags.Manager, categoryID, name string) (string, error) {
+	id, err := findTag(ctx, m, categoryID, name)
+	if err != nil || id != "" {
+		return id, err
+	}
+	klog.V(4).Infof("Creating the tag %s", name)
+	id, err = m.CreateTag(ctx, &tags.Tag{Name: name, Description: "Created by cluster-api", CategoryID: categoryID})
+	if err != nil {
+		// The tag may have been created by a concurrent reconcile
+		if id, findErr := findTag(ctx, m, categoryID, name); findErr == nil && id != "" {
+			return id, nil
+		}
+		return "", fmt.Errorf("error creating the tag %s: %s", name, err)
+	}
+	return id, nil
+}
+
+// findTag returns the ID of the named tag of the category, or an empty ID when
+// there is no such tag.
+func findTag(ctx context.Context, m *tags.Manager, categoryID, name string) (string, error) {
+	categoryTags, err := m.GetTagsForCategory(ctx, categoryID)
+	if err != nil {
+		return "", err
+	}
+	for _, t := range categoryTags {
+		if t.Name == name {
+			return t.ID, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package govmomi
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/rest"
+	vapi "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/types"
+	vsphereconfigv1 "sigs.k8s.io/cluster-api-provider-vsphere/pkg/apis/vsphereproviderconfig/v1alpha1"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+// concurrentTagging creates the categories and tags of the creation requests
+// before serving them when concurrent is set, as if they had just been created
+// by another client.
+type concurrentTagging struct {
+	http.Handler
+	concurrent bool
+}
+
+func (h *concurrentTagging) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.concurrent && r.Method == http.MethodPost &&
+		(strings.HasSuffix(r.URL.Path, "/tagging/category") || strings.HasSuffix(r.URL.Path, "/tagging/tag")) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		concurrent := *r
+		concurrent.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h.Handler.ServeHTTP(httptest.NewRecorder(), &concurrent)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+func TestTags(t *testing.T) {
+	model := simulator.VPX()
+	model.Host = 0 // ClusterHost only
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+	path, handler := vapi.New(s.URL, simulator.Map.OptionManager().Setting)
+	tagging := &concurrentTagging{Handler: handler}
+	model.Service.Handle(path, tagging)
+
+	ctx := context.Background()
+	c, err := govmomi.NewClient(ctx, s.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := rest.NewClient(c.Client)
+	if err = rc.Login(ctx, s.URL.User); err != nil {
+		t.Fatal(err)
+	}
+	m := tags.NewManager(rc)
+	categoryID, err := m.CreateCategory(ctx, &tags.Category{Name: "backup", Cardinality: "MULTIPLE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.CreateTag(ctx, &tags.Tag{Name: "daily", CategoryID: categoryID}); err != nil {
+		t.Fatal(err)
+	}
+
+	cluster := &clusterv1.Cluster{}
+	cluster.Namespace, cluster.Name = "default", "cluster1"
+	machine := &clusterv1.Machine{}
+	machineSpec := &vsphereconfigv1.VsphereMachineSpec{Tags: []vsphereconfigv1.TagSpec{{Category: "backup", Name: "daily"}}}
+	vms := simulator.Map.All("VirtualMachine")
+	vmref, vmref1 := vms[0].Reference(), vms[1].Reference()
+	if err = attachTags(ctx, m, vmref, machineTags(cluster, machine, machineSpec)); err != nil {
+		t.Fatal(err)
+	}
+
+	attachedTags, err := m.GetAttachedTags(ctx, vmref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attached []string
+	for _, tag := range attachedTags {
+		category, err := m.GetCategory(ctx, tag.CategoryID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attached = append(attached, category.Name+"/"+tag.Name)
+	}
+	sort.Strings(attached)
+	if expected := []string{"backup/daily", "cluster-api-cluster/default/cluster1", "cluster-api-role/" + workerRole}; !reflect.DeepEqual(attached, expected) {
+		t.Errorf("expected the tags %v, got %v", expected, attached)
+	}
+	categories, err := m.GetCategories(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagIDs, err := m.ListTags(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(categories) != 3 || len(tagIDs) != 3 {
+		t.Errorf("expected the existing category and tag to be reused, got %d categories and %d tags", len(categories), len(tagIDs))
+	}
+	for _, category := range categories {
+		if category.Name == roleTagCategory && (category.Cardinality != "SINGLE" || !reflect.DeepEqual(category.AssociableTypes, []string{"VirtualMachine"})) {
+			t.Errorf("unexpected role category %+v", category)
+		}
+	}
+
+	// The tag of the cluster confirms the ownership of the VM
+	tagID, err := findClusterTag(ctx, m, cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tagIDs, err = m.ListAttachedTags(ctx, vmref); err != nil {
+		t.Fatal(err)
+	}
+	if tagID == "" || !containsString(tagIDs, tagID) {
+		t.Errorf("expected the tag of the cluster %q among the attached tags %v", tagID, tagIDs)
+	}
+
+	// The categories and tags created concurrently are used
+	tagging.concurrent = true
+	machineSpec.Tags = []vsphereconfigv1.TagSpec{{Category: "tier", Name: "gold"}}
+	if err = attachTags(ctx, m, vmref1, machineSpec.Tags); err != nil {
+		t.Fatal(err)
+	}
+	if attachedTags, err = m.GetAttachedTags(ctx, vmref1); err != nil {
+		t.Fatal(err)
+	}
+	if len(attachedTags) != 1 || attachedTags[0].Name != "gold" {
+		t.Errorf("expected the concurrently created tag to be attached, got %v", attachedTags)
+	}
+
+	if err = detachAllTags(ctx, m, vmref); err != nil {
+		t.Fatal(err)
+	}
+	if tagIDs, err = m.ListAttachedTags(ctx, vmref); err != nil {
+		t.Fatal(err)
+	}
+	if len(tagIDs) != 0 {
+		t.Errorf("expected all the tags to be detached, got %v", tagIDs)
+	}
+}
+
+func TestSetCustomAttributes(t *testing.T) {
+	model := simulator.VPX()
+	model.Host = 0 // ClusterHost only
+	defer model.Remove()
+	err := model.Create()
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+
+	s := model.Service.NewServer()
+	defer s.Close()
+
+	c, err := govmomi.NewClient(context.Background(), s.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	session := &SessionContext{session: c, context: &ctx}
+
+	cluster := &clusterv1.Cluster{}
+	cluster.Name = "cluster1"
+	machine := &clusterv1.Machine{}
+	machine.Namespace, machine.Name = "default", "machine1"
+	machine.Spec.Versions.Kubelet = "1.13.1"
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	for i := 0; i < 2; i++ {
+		// The attributes are defined once and updated afterwards
+		if err = setCustomAttributes(ctx, session, vm.Reference(), machineCustomAttributes(cluster, machine)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fields := simulator.Map.Get(*c.ServiceContent.CustomFieldsManager).(*simulator.CustomFieldsManager).Field
+	names := make(map[int32]string)
+	for _, field := range fields {
+		names[field.Key] = field.Name
+	}
+	if len(names) != 5 {
+		t.Errorf("expected 5 custom attributes, got %v", names)
+	}
+	values := make(map[string]string)
+	for _, value := range vm.CustomValue {
+		value := value.(*types.CustomFieldStringValue)
+		values[names[value.Key]] = value.Value
+	}
+	expected := map[string]string{
+		clusterAttribute:           "cluster1",
+		namespaceAttribute:         "default",
+		machineAttribute:           "machine1",
+		roleAttribute:              workerRole,
+		kubernetesVersionAttribute: "1.13.1",
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected the custom attributes %v, got %v", expected, values)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"time"
 
 	"github.com/vmware/govmomi/object"
@@ -35,6 +34,10 @@ func (pv *Provisioner) Update(ctx context.Context, cluster *clusterv1.Cluster, m
 	}
 	updatectx, cancel := context.WithCancel(*s.context)
 	defer cancel()
+	if task := vsphereutils.GetActiveTasks(machine); task != "" {
+		// In case an active task is going on, wait for its completion
+		return pv.verifyAndUpdateTask(s, cluster, machine, task)
+	}
 
 	moref, err := vsphereutils.GetMachineRef(machine)
 	if err != nil {
@@ -45,13 +48,22 @@ func (pv *Provisioner) Update(ctx context.Context, cluster *clusterv1.Cluster, m
 		Type:  "VirtualMachine",
 		Value: moref,
 	}
-	err = s.session.RetrieveOne(updatectx, vmref, []string{"name", "runtime"}, &vmmo)
+	err = s.session.RetrieveOne(updatectx, vmref, []string{"name", "runtime", "config", "snapshot"}, &vmmo)
 	if err != nil {
 		return nil
 	}
+	if snapshotting, err := pv.reconcileSnapshots(updatectx, s, machine, &vmmo); err != nil || snapshotting {
+		return err
+	}
+	if resizing, err := pv.resize(updatectx, s, machine, &vmmo); err != nil || resizing {
+		return err
+	}
+	if err := pv.reconcilePowerState(updatectx, s, machine, &vmmo); err != nil {
+		return err
+	}
 	if vmmo.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOn {
-		klog.Warningf("Machine %s is not running, rather it is in %s state", vmmo.Name, vmmo.Runtime.PowerState)
-		return fmt.Errorf("Machine %s is not running, rather it is in %s state", vmmo.Name, vmmo.Runtime.PowerState)
+		// The VM is being powered on, or left as is by the manual power policy
+		return nil
 	}
 
 	if _, err := vsphereutils.GetIP(cluster, machine); err != nil {
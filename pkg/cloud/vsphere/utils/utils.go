@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math"
+	"net"
 	"os"
 	"os/exec"
 	"strings"
@@ -43,6 +44,13 @@ func GetMasterForCluster(cluster *clusterv1.Cluster, lister v1alpha1.Interface)
 	return masters, nil
 }
 
+// GetMachinesForCluster returns the machines of the cluster, which are the
+// Machines of the namespace of the cluster labeled with the cluster name
+func GetMachinesForCluster(cluster *clusterv1.Cluster, lister v1alpha1.Interface) ([]*clusterv1.Machine, error) {
+	selector := labels.SelectorFromSet(labels.Set{clusterv1.MachineClusterLabelName: cluster.Name})
+	return lister.Machines().Lister().Machines(cluster.Namespace).List(selector)
+}
+
 func GetIP(_ *clusterv1.Cluster, machine *clusterv1.Machine) (string, error) {
 	if machine.ObjectMeta.Annotations == nil {
 		return "", errors.New("could not get IP")
@@ -116,6 +124,85 @@ func GetSubnet(netRange clusterv1.NetworkRanges) string {
 	return netRange.CIDRBlocks[0]
 }
 
+// GetSubnets returns all the ranges of the config, separated by commas as
+// expected by kubeadm for dual-stack clusters.
+func GetSubnets(netRange clusterv1.NetworkRanges) string {
+	return strings.Join(netRange.CIDRBlocks, ",")
+}
+
+// IsIPv6CIDR returns whether the CIDR is an IPv6 range.
+func IsIPv6CIDR(cidr string) bool {
+	ip, _, err := net.ParseCIDR(cidr)
+	return err == nil && ip.To4() == nil
+}
+
+// IPAddress is a static address of an IPConfig with its prefix length. The
+// Netmask is only set for the address given by the IP and Netmask of the
+// IPConfig.
+type IPAddress struct {
+	IP      net.IP
+	Prefix  int
+	Netmask string
+}
+
+// IsIPv6 returns whether the address is an IPv6 address.
+func (a IPAddress) IsIPv6() bool {
+	return a.IP.To4() == nil
+}
+
+// CIDR returns the address with its prefix length, e.g. fd00::10/64.
+func (a IPAddress) CIDR() string {
+	return fmt.Sprintf("%s/%d", a.IP, a.Prefix)
+}
+
+// GetIPAddresses returns the static addresses of the IPConfig: the IPv4
+// address given by the IP and Netmask, if any, followed by the IPv4 and IPv6
+// addresses in CIDR notation of the IPs.
+func GetIPAddresses(ipConfig vsphereconfigv1.IPConfig) ([]IPAddress, error) {
+	var addresses []IPAddress
+	if ipConfig.IP != "" {
+		ip := net.ParseIP(ipConfig.IP)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("[FATAL] ip %q is not an IPv4 address, IPv6 addresses are set in ips along with their prefix length", ipConfig.IP)
+		}
+		address := IPAddress{IP: ip, Netmask: ipConfig.Netmask}
+		if ipConfig.Netmask != "" {
+			mask := net.ParseIP(ipConfig.Netmask)
+			if mask == nil || mask.To4() == nil {
+				return nil, fmt.Errorf("[FATAL] netmask %q is not an IPv4 netmask", ipConfig.Netmask)
+			}
+			ones, bits := net.IPMask(mask.To4()).Size()
+			if bits == 0 {
+				return nil, fmt.Errorf("[FATAL] netmask %q is not a valid netmask", ipConfig.Netmask)
+			}
+			address.Prefix = ones
+		}
+		addresses = append(addresses, address)
+	}
+	for _, cidr := range ipConfig.IPs {
+		ip, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("[FATAL] ips entry %q is not an address with its prefix length: %v", cidr, err)
+		}
+		prefix, _ := ipnet.Mask.Size()
+		addresses = append(addresses, IPAddress{IP: ip, Prefix: prefix})
+	}
+	return addresses, nil
+}
+
+// GetGateways returns the default IPv4 and IPv6 gateways of the IPConfig. An
+// IPv6 Gateway is used as IPv6 gateway if no Gateway6 is set.
+func GetGateways(ipConfig vsphereconfigv1.IPConfig) (gateway4, gateway6 string) {
+	gateway4, gateway6 = ipConfig.Gateway, ipConfig.Gateway6
+	if ip := net.ParseIP(ipConfig.Gateway); ip != nil && ip.To4() == nil {
+		gateway4 = ""
+		if gateway6 == "" {
+			gateway6 = ipConfig.Gateway
+		}
+	}
+	return gateway4, gateway6
+}
+
 func GetMachineRef(machine *clusterv1.Machine) (string, error) {
 	pc, err := GetMachineProviderSpec(machine.Spec.ProviderSpec)
 	if err != nil {
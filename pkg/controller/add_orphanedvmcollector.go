@@ -0,0 +1,58 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+	"sigs.k8s.io/cluster-api-provider-vsphere/pkg/cloud/vsphere"
+	"sigs.k8s.io/cluster-api/pkg/client/clientset_generated/clientset"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+func init() {
+	// AddToManagerFuncs is a list of functions to create controllers and add them to a manager.
+	AddToManagerFuncs = append(AddToManagerFuncs, func(m manager.Manager) error {
+		factory := getSharedInformerFactory(m)
+		informer := factory.Cluster().V1alpha1()
+
+		client, err := clientset.NewForConfig(m.GetConfig())
+		if err != nil {
+			klog.Fatalf("Failed to create clientset: %v", err)
+		}
+
+		collectorClientSet, err := kubernetes.NewForConfig(
+			rest.AddUserAgent(m.GetConfig(), "orphaned-vm-collector"),
+		)
+		if err != nil {
+			klog.Fatalf("Failed to create client: %v", err)
+		}
+
+		collectorEventRecorder, err := createRecorder(collectorClientSet, "orphaned-vm-collector")
+		if err != nil {
+			klog.Fatalf("Could not create vSphere event recorder: %v", err)
+		}
+
+		collector, err := vsphere.NewOrphanedVMCollector(client.ClusterV1alpha1(), collectorClientSet, informer, collectorEventRecorder)
+		if err != nil {
+			klog.Fatalf("Could not create vSphere orphaned VM collector: %v", err)
+		}
+
+		return m.Add(collector)
+	})
+}